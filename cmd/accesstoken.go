@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/accesstoken"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/loginhistory"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/serviceaccount"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+const ErrCodeInvalidToken = "invalid_token"
+
+// tokenLoginInterval is how long a token must be unused before its next use is recorded as a login
+const tokenLoginInterval = time.Hour
+
+// BearerAuth authenticates requests which carry a personal access token or a service account key, requests without one fall through to the session
+func (s *serverCmd) BearerAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header := c.Request().Header.Get(echo.HeaderAuthorization)
+		if header == "" {
+			return next(c)
+		}
+		plaintext, found := strings.CutPrefix(header, "Bearer ")
+		if !found {
+			return newAPIError(http.StatusUnauthorized, ErrCodeInvalidToken, "expected a bearer token")
+		}
+
+		if strings.HasPrefix(plaintext, serviceaccount.KeyPrefix) {
+			sa, err := s.serviceAccounts.Authenticate(plaintext)
+			if errors.Is(err, serviceaccount.ErrInvalidKey) {
+				s.logger.Debug("invalid service account key", "ip", c.RealIP())
+				return newAPIError(http.StatusUnauthorized, ErrCodeInvalidToken, "invalid, expired or revoked key")
+			}
+			if err != nil {
+				s.logger.Error("failed to authenticate service account key", "err", err)
+				return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+			}
+			c.Set(util.EchoKeyServiceAccount, sa)
+			return next(c)
+		}
+
+		token, err := s.accessTokens.Authenticate(plaintext)
+		if errors.Is(err, accesstoken.ErrInvalidToken) {
+			s.logger.Debug("invalid access token", "ip", c.RealIP())
+			s.recordLogin(c, nil, "", loginhistory.MethodToken, loginhistory.OutcomeFailure, loginhistory.ReasonInvalidToken)
+			return newAPIError(http.StatusUnauthorized, ErrCodeInvalidToken, "invalid, expired or revoked token")
+		}
+		if err != nil {
+			s.logger.Error("failed to authenticate access token", "err", err)
+			return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+		}
+
+		// tokens are used for every request, only the first use in a while is a login
+		if token.LastUsedAt == nil || time.Since(*token.LastUsedAt) > tokenLoginInterval {
+			s.recordTokenLogin(c, token)
+		}
+
+		c.Set(util.EchoKeyAccessToken, token)
+		return next(c)
+	}
+}
+
+func (s *serverCmd) recordTokenLogin(c echo.Context, token *accesstoken.Token) {
+	u := &model.User{}
+	err := s.db.First(u, token.UserID).Error
+	if err != nil {
+		s.logger.Error("failed to get token user", "err", err)
+		return
+	}
+	s.recordLogin(c, u, u.Username, loginhistory.MethodToken, loginhistory.OutcomeSuccess, "")
+}
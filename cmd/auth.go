@@ -0,0 +1,468 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/authenticator"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/loginhistory"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/membership"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/password"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/usersession"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+// Error codes returned in the "code" field of error responses
+const (
+	ErrCodeInvalidRequest     = "invalid_request"
+	ErrCodeInvalidCredentials = "invalid_credentials"
+	ErrCodeTooManyAttempts    = "too_many_attempts"
+	ErrCodeNotLoggedIn        = "not_logged_in"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeInternal           = "internal_error"
+	ErrCodeWeakPassword       = "weak_password"
+	ErrCodeUserDeactivated    = "user_deactivated"
+
+	ErrCodeMfaRequired           = "mfa_required"
+	ErrCodeMfaEnrollmentRequired = "mfa_enrollment_required"
+	ErrCodeMfaAlreadyEnabled     = "mfa_already_enabled"
+	ErrCodeMfaNotEnrolled        = "mfa_not_enrolled"
+	ErrCodeInvalidCode           = "invalid_code"
+)
+
+// apiError is the body of error responses, echo's error handler serializes it as JSON
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newAPIError(status int, code string, message string) *echo.HTTPError {
+	return echo.NewHTTPError(status, apiError{Code: code, Message: message})
+}
+
+type signupRequest struct {
+	Username    string `json:"username" form:"username"`
+	Password    string `json:"password" form:"password"`
+	AccountName string `json:"accountname" form:"accountname"`
+}
+
+type loginRequest struct {
+	Username string `json:"username" form:"username"`
+	Password string `json:"password" form:"password"`
+}
+
+type authResponse struct {
+	User    authUser    `json:"user"`
+	Account authAccount `json:"account"`
+}
+
+type authUser struct {
+	Ulid          string `json:"ulid"`
+	Username      string `json:"username"`
+	EmailVerified bool   `json:"emailVerified"`
+}
+
+type authAccount struct {
+	Ulid string `json:"ulid"`
+	Name string `json:"name"`
+}
+
+func newAuthResponse(u *model.User, a *model.Account) *authResponse {
+	return &authResponse{
+		User:    authUser{Ulid: u.Ulid, Username: u.Username, EmailVerified: u.EmailVerifiedAt != nil},
+		Account: authAccount{Ulid: a.Ulid, Name: a.Name},
+	}
+}
+
+func (s *serverCmd) Signup(c echo.Context) error {
+	// parse input, json or form encoded
+	input := &signupRequest{}
+	err := c.Bind(input)
+	if err != nil {
+		s.logger.Debug("failed to parse signup request", "err", err)
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "failed to parse request")
+	}
+	s.logger.Debug("signup request", "username", input.Username)
+	if input.Username == "" || input.Password == "" || input.AccountName == "" {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "username, password and accountname are required")
+	}
+	if !isEmail(input.Username) {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "username must be an email address")
+	}
+	err = s.checkPassword(input.Password, input.Username)
+	if err != nil {
+		return err
+	}
+
+	// hash password
+	hashedPassword, err := s.passwordHasher.Hash(input.Password)
+	if err != nil {
+		s.logger.Error("password hash error", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "failed to hash password")
+	}
+
+	// create user and account in the database, the account is rolled back if the username is taken
+	newAccount := &model.Account{
+		Ulid: s.ulidManager.NewULID().String(),
+		Name: input.AccountName,
+	}
+	user := &model.User{
+		Ulid:     s.ulidManager.NewULID().String(),
+		Username: input.Username,
+		Password: hashedPassword,
+		Account:  newAccount,
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&newAccount).Error
+		if err != nil {
+			return errors.Wrap(err, "failed to create account")
+		}
+		err = tx.Create(&user).Error
+		if err != nil {
+			return errors.Wrap(err, "failed to create user")
+		}
+		return membership.Add(tx, user.ID, newAccount.ID)
+	})
+	if util.IsUniqueViolation(err, util.ConstraintUniqueUsername) {
+		s.logger.Debug("username taken", "username", input.Username)
+		return newAPIError(http.StatusConflict, ErrCodeUsernameTaken, "a user with this username already exists")
+	}
+	if err != nil {
+		s.logger.Error("failed to create user", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "failed to create user")
+	}
+	s.logger.Debug("created user", "username", user.Username)
+
+	// the signup succeeded even if the email can't be sent, the user can ask for another one
+	err = s.sendVerificationEmail(user)
+	if err != nil {
+		s.logger.Error("failed to send verification email", "err", err)
+	}
+
+	return c.JSON(http.StatusCreated, newAuthResponse(user, newAccount))
+}
+
+const OneHourSeconds = 3600   // 1 hour
+const OneWeekSeconds = 604800 // 1 week
+
+func (s *serverCmd) Login(c echo.Context) error {
+	// parse input, json or form encoded
+	input := &loginRequest{}
+	err := c.Bind(input)
+	if err != nil {
+		s.logger.Debug("failed to parse login request", "err", err)
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "failed to parse request")
+	}
+	s.logger.Debug("login request", "username", input.Username)
+	if input.Username == "" || input.Password == "" {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "username and password are required")
+	}
+
+	// brute-force protection, per username and per IP
+	ip := c.RealIP()
+	wait, err := s.loginGuard.Check(input.Username, ip)
+	if err != nil {
+		s.logger.Error("failed to check login throttle", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	if wait > 0 {
+		s.logger.Debug("login throttled", "username", input.Username, "ip", ip, "wait", wait)
+		s.recordLogin(c, nil, input.Username, loginhistory.MethodPassword, loginhistory.OutcomeFailure, loginhistory.ReasonThrottled)
+		c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(wait.Seconds())+1))
+		return newAPIError(http.StatusTooManyRequests, ErrCodeTooManyAttempts, "too many failed login attempts, try again later")
+	}
+
+	// check the password with the local password hashes or the directory
+	u, err := s.authenticator.Authenticate(input.Username, input.Password)
+	switch {
+	case errors.Is(err, authenticator.ErrUnknownUser):
+		s.logger.Debug("failed to find user", "username", input.Username)
+		s.recordLoginFailure(input.Username, ip)
+		s.recordLogin(c, nil, input.Username, loginhistory.MethodPassword, loginhistory.OutcomeFailure, loginhistory.ReasonUnknownUser)
+		return newAPIError(http.StatusUnauthorized, ErrCodeInvalidCredentials, "invalid username or password")
+	case errors.Is(err, authenticator.ErrWrongPassword):
+		s.recordLoginFailure(input.Username, ip)
+		s.recordLogin(c, s.knownUser(input.Username), input.Username, loginhistory.MethodPassword, loginhistory.OutcomeFailure, loginhistory.ReasonWrongPassword)
+		return newAPIError(http.StatusUnauthorized, ErrCodeInvalidCredentials, "invalid username or password")
+	case errors.Is(err, authenticator.ErrUsernameTaken):
+		s.recordLogin(c, nil, input.Username, loginhistory.MethodPassword, loginhistory.OutcomeFailure, loginhistory.ReasonUsernameTaken)
+		return newAPIError(http.StatusConflict, ErrCodeUsernameTaken, "a local user with this username already exists")
+	case err != nil:
+		s.logger.Error("failed to authenticate", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	mfaCode, err := s.startLogin(c, u, loginhistory.MethodPassword, nil)
+	if err != nil {
+		return err
+	}
+	switch mfaCode {
+	case ErrCodeMfaRequired:
+		return newAPIError(http.StatusUnauthorized, ErrCodeMfaRequired, "a one-time code is required, submit it to /auth/mfa/verify")
+	case ErrCodeMfaEnrollmentRequired:
+		return newAPIError(http.StatusUnauthorized, ErrCodeMfaEnrollmentRequired, "the account requires two-factor authentication, enroll at /auth/mfa/enroll")
+	}
+	// the throttle is reset once the login is complete, a pending second factor keeps counting the failures
+	s.resetLoginThrottle(u)
+
+	return c.JSON(http.StatusOK, newAuthResponse(u, u.Account))
+}
+
+// startLogin continues the login of a user whose first factor was verified, by password or by an identity provider.
+// The session stays pending until a one-time code is verified if the user or their account requires a second factor,
+// then the returned code tells the client how to continue, otherwise it's empty and the user is logged in.
+// The groups of an identity provider are synced to the user's home account once the login completes, nil if there are none.
+// Errors are safe to return to the client.
+func (s *serverCmd) startLogin(c echo.Context, u *model.User, method string, groups []string) (string, error) {
+	home := u.Account
+	err := s.setLoginAccount(c, u, method)
+	if err != nil {
+		return "", err
+	}
+	mfaEnabled, err := s.mfaService.IsEnabled(u.ID)
+	if err != nil {
+		s.logger.Error("failed to check mfa", "err", err)
+		return "", newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	if !mfaEnabled && !u.Account.RequireMfa {
+		err = s.syncGroups(u, home, groups)
+		if err != nil {
+			return "", err
+		}
+		return "", s.startSession(c, u, method)
+	}
+
+	err = s.startPendingSession(c, u, groups)
+	if err != nil {
+		s.logger.Error("failed to save session", "err", err)
+		return "", newAPIError(http.StatusInternalServerError, ErrCodeInternal, "failed to save session")
+	}
+	s.recordLogin(c, u, u.Username, method, loginhistory.OutcomeMfaRequired, "")
+	if mfaEnabled {
+		return ErrCodeMfaRequired, nil
+	}
+	return ErrCodeMfaEnrollmentRequired, nil
+}
+
+// startSession logs the user in and records the login, errors are safe to return to the client
+func (s *serverCmd) startSession(c echo.Context, u *model.User, method string) error {
+	// deactivated by a directory, e.g. while an MFA login was in progress
+	err := s.setLoginAccount(c, u, method)
+	if err != nil {
+		return err
+	}
+
+	// create session
+	session, _ := s.store.Get(c.Request(), util.CookieKeySessionName) // this func returns an error when a session is created
+	session.Options = s.cookieOptions(OneWeekSeconds)
+
+	// register the session server-side so that it can be revoked
+	sessionID := s.ulidManager.NewULID().String()
+	_, err = s.sessionRegistry.Create(sessionID, u.ID, OneWeekSeconds*time.Second, c.RealIP(), c.Request().UserAgent())
+	if err != nil {
+		s.logger.Error("failed to register session", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "failed to save session")
+	}
+
+	// a new session ID, so that an ID planted before the login isn't authenticated
+	clearSession(session)
+	err = usersession.Renew(session)
+	if err != nil {
+		s.logger.Error("failed to renew session", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "failed to save session")
+	}
+	session.Values[util.SessionKeyAccountID] = u.Account.Ulid
+	session.Values[util.SessionKeyUserID] = u.ID
+	session.Values[util.SessionKeySessionID] = sessionID
+
+	s.logger.Debug("found user", "username", u.ID, "account", u.Account.ID)
+
+	err = session.Save(c.Request(), c.Response())
+	if err != nil {
+		s.logger.Error("failed to save session", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "failed to save session")
+	}
+	s.recordLogin(c, u, u.Username, method, loginhistory.OutcomeSuccess, "")
+
+	return nil
+}
+
+// syncGroups grants the roles the account maps the identity provider's groups to, nil groups leave the roles alone.
+// Errors are safe to return to the client.
+func (s *serverCmd) syncGroups(u *model.User, account *model.Account, groups []string) error {
+	if groups == nil {
+		return nil
+	}
+	err := s.groupSyncer.Sync(u, account, groups)
+	if err != nil {
+		s.logger.Error("failed to sync groups", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	return nil
+}
+
+// resetLoginThrottle forgets the user's failed attempts after a complete login
+func (s *serverCmd) resetLoginThrottle(u *model.User) {
+	err := s.loginGuard.RecordSuccess(u.Username)
+	if err != nil {
+		s.logger.Error("failed to reset login throttle", "err", err)
+	}
+}
+
+// setLoginAccount sets the account the user lands in, their home account unless its directory deactivated them there,
+// users deactivated in all their accounts are rejected. Errors are safe to return to the client.
+func (s *serverCmd) setLoginAccount(c echo.Context, u *model.User, method string) error {
+	memberships, err := s.memberships.Memberships(u.ID)
+	if err != nil {
+		s.logger.Error("failed to get memberships", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	if len(memberships) == 0 {
+		return s.rejectDeactivated(c, u, method)
+	}
+	u.Account = memberships[0].Account
+	for _, m := range memberships {
+		if m.AccountID == u.AccountID {
+			u.Account = m.Account
+		}
+	}
+	return nil
+}
+
+func (s *serverCmd) rejectDeactivated(c echo.Context, u *model.User, method string) error {
+	s.recordLogin(c, u, u.Username, method, loginhistory.OutcomeFailure, loginhistory.ReasonDeactivated)
+	return newAPIError(http.StatusForbidden, ErrCodeUserDeactivated, "the user is deactivated")
+}
+
+// knownUser returns the user with the username, or nil, so that failed logins show up in the user's login history
+func (s *serverCmd) knownUser(username string) *model.User {
+	users := []*model.User{}
+	err := s.db.Where("LOWER(username) = LOWER(?)", username).Limit(1).Find(&users).Error
+	if err != nil {
+		s.logger.Error("failed to get user", "err", err)
+		return nil
+	}
+	if len(users) == 0 {
+		return nil
+	}
+	return users[0]
+}
+
+// recordLogin adds a login attempt to the login history, u is nil if the user wasn't found.
+// A failure to record is logged but doesn't fail the login.
+func (s *serverCmd) recordLogin(c echo.Context, u *model.User, username string, method string, outcome string, reason string) {
+	event := &loginhistory.Event{
+		Username:  username,
+		IP:        c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+		Method:    method,
+		Outcome:   outcome,
+		Reason:    reason,
+	}
+	if u != nil {
+		event.UserID = &u.ID
+	}
+	err := s.loginHistory.Record(event)
+	if err != nil {
+		s.logger.Error("failed to record login", "err", err)
+	}
+}
+
+func (s *serverCmd) recordLoginFailure(username string, ip string) {
+	err := s.loginGuard.RecordFailure(username, ip)
+	if err != nil {
+		s.logger.Error("failed to record login failure", "err", err)
+	}
+}
+
+func (s *serverCmd) Logout(c echo.Context) error {
+	sess, err := session.Get(util.CookieKeySessionName, c)
+	if err != nil {
+		s.logger.Error("failed to get session", "err", err)
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "failed to get session")
+	}
+
+	// revoke the current session, or all sessions of the user if requested
+	sessionID, hasSessionID := sess.Values[util.SessionKeySessionID].(string)
+	userID, hasUserID := sess.Values[util.SessionKeyUserID].(uint)
+	if impersonatorID, impersonating := util.ImpersonatorID(sess); impersonating {
+		// the session belongs to the impersonator, the impersonated user's sessions are left alone
+		userID = impersonatorID
+	}
+	if hasSessionID && hasUserID {
+		if c.FormValue("all") == "true" {
+			err = s.sessionRegistry.RevokeAllForUser(userID)
+		} else {
+			err = s.sessionRegistry.Revoke(sessionID)
+		}
+		if err != nil {
+			s.logger.Error("failed to revoke session", "err", err)
+			return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "failed to revoke session")
+		}
+		s.logger.Debug("logged out", "userid", userID, "session", sessionID)
+	}
+
+	// expire the cookie
+	clearSession(sess)
+	sess.Options = s.cookieOptions(-1)
+	err = sess.Save(c.Request(), c.Response())
+	if err != nil {
+		s.logger.Error("failed to save session", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "failed to save session")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *serverCmd) isSessionActive(sess *sessions.Session) (bool, error) {
+	sessionID, ok := sess.Values[util.SessionKeySessionID].(string)
+	if !ok {
+		return false, nil
+	}
+	return s.sessionRegistry.IsActive(sessionID)
+}
+
+// cookieOptions are the attributes of all session cookies, they must match for a logout to replace the login's cookie.
+// Lax cookies are sent on the redirect back from an identity provider, unlike strict ones.
+func (s *serverCmd) cookieOptions(maxAge int) *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   s.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func clearSession(sess *sessions.Session) {
+	delete(sess.Values, util.SessionKeyUserID)
+	delete(sess.Values, util.SessionKeyAccountID)
+	delete(sess.Values, util.SessionKeySessionID)
+	delete(sess.Values, util.SessionKeyPendingUserID)
+	delete(sess.Values, util.SessionKeyPendingUntil)
+	delete(sess.Values, util.SessionKeyPendingGroups)
+	delete(sess.Values, util.SessionKeyImpersonatorID)
+	delete(sess.Values, util.SessionKeyImpersonatorAccountID)
+	delete(sess.Values, util.SessionKeyImpersonationUntil)
+}
+
+// checkPassword applies the password policy to a new password, errors are safe to return to the client
+func (s *serverCmd) checkPassword(plaintext string, username string) error {
+	err := s.passwordPolicy.Check(plaintext, username)
+	var violation *password.Violation
+	if errors.As(err, &violation) {
+		return newAPIError(http.StatusBadRequest, ErrCodeWeakPassword, violation.Reason)
+	}
+	if err != nil {
+		s.logger.Error("failed to check password policy", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/authenticator"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/loginguard"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/membership"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/password"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/breachedtest"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+// a correct password doesn't reset the throttle while the second factor is pending,
+// otherwise every login would allow another round of guessed codes
+func TestLoginThrottleWithSecondFactor(t *testing.T) {
+	db := dbtest.Open(t)
+	hasher, err := password.NewPHCHasher(password.Config{Algorithm: password.AlgorithmBcrypt, BcryptCost: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme := dbtest.Account(t, db, "acme")
+	jane := dbtest.User(t, db, acme, "jane@example.com")
+	hash, err := hasher.Hash("correct-horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Model(jane).Update("password", hash).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &serverCmd{
+		db:            db,
+		logger:        dbtest.Logger(),
+		store:         sessions.NewCookieStore(securecookie.GenerateRandomKey(32)),
+		authenticator: authenticator.NewLocal(db, dbtest.Logger(), hasher),
+		loginGuard: loginguard.NewDbGuard(db, dbtest.Logger(), loginguard.Config{
+			MaxFailuresPerUser: 3,
+			MaxFailuresPerIP:   100,
+			LockoutDuration:    time.Hour,
+		}),
+		mfaService:   &fakeMfa{enabled: true},
+		memberships:  membership.NewDbService(db, dbtest.Logger()),
+		loginHistory: &fakeHistory{},
+	}
+	e := echo.New()
+	e.Use(session.Middleware(s.store))
+	e.POST("/auth/login", s.Login)
+	e.POST("/auth/mfa/verify", s.MfaVerify)
+
+	post := func(path string, body string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		rec := post("/auth/login", `{"username": "jane@example.com", "password": "correct-horse"}`, nil)
+		if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), ErrCodeMfaRequired) {
+			t.Fatalf("login %d: got %d %s, want the second factor to be required", i, rec.Code, rec.Body)
+		}
+		rec = post("/auth/mfa/verify", `{"code": "000000"}`, rec.Result().Cookies())
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("code %d: got %d %s, want an invalid code", i, rec.Code, rec.Body)
+		}
+	}
+
+	rec := post("/auth/login", `{"username": "jane@example.com", "password": "correct-horse"}`, nil)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("got %d %s, want jane to be locked out", rec.Code, rec.Body)
+	}
+}
+
+// the password policy is checked before anything is stored
+func TestSignupBreachedPassword(t *testing.T) {
+	tests := []struct {
+		name       string
+		password   string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "breached", password: "correct horse battery staple", wantStatus: http.StatusBadRequest, wantCode: ErrCodeWeakPassword},
+		{name: "breached list can't be read", password: "unreadable horse battery staple", wantStatus: http.StatusInternalServerError, wantCode: ErrCodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := breachedtest.Dir(t, "correct horse battery staple")
+			breachedtest.Unreadable(t, dir, "unreadable horse battery staple")
+			breached, err := password.NewPrefixDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &serverCmd{
+				logger:         dbtest.Logger(),
+				passwordPolicy: &password.Policy{MinLength: 12, Breached: breached},
+			}
+			e := echo.New()
+			e.POST("/auth/signup", s.Signup)
+
+			body, _ := json.Marshal(signupRequest{Username: "jane@example.com", Password: tt.password, AccountName: "acme"})
+			req := httptest.NewRequest(http.MethodPost, "/auth/signup", strings.NewReader(string(body)))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			got := &apiError{}
+			err = json.Unmarshal(rec.Body.Bytes(), got)
+			if rec.Code != tt.wantStatus || err != nil || got.Code != tt.wantCode {
+				t.Errorf("got %d %s, want %d %s", rec.Code, rec.Body, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// defaultSecretKey is the default of the secret key options, it's only accepted in dev mode
+const defaultSecretKey = "changemechangemechangemechangeme"
+
+// minSigningKeyLength is the length of the HMAC-SHA256 output, shorter keys weaken the signature
+const minSigningKeyLength = 32
+
+// cookieKeyPairs returns the cookie key pairs, newest first, as alternating signing and encryption keys.
+// The newest pair signs and encrypts, all pairs are tried when a cookie is decoded, so older pairs can be kept until their cookies expire.
+func (s *serverCmd) cookieKeyPairs() ([][]byte, error) {
+	pairs := s.CookieStoreKeys
+	if s.CookieStoreKeysFile != "" {
+		var err error
+		pairs, err = readKeyPairsFile(s.CookieStoreKeysFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(pairs) == 0 {
+		pairs = []string{s.CookieStoreSigningKey + ":" + s.CookieStoreEncryptionKey}
+	}
+
+	keyPairs := [][]byte{}
+	for i, pair := range pairs {
+		signingKey, encryptionKey, found := strings.Cut(pair, ":")
+		if !found || signingKey == "" {
+			return nil, errors.Errorf("cookie key pair %d: expected signing:encryption", i+1)
+		}
+		if len(signingKey) < minSigningKeyLength {
+			return nil, errors.Errorf("cookie key pair %d: signing key must be at least %d bytes long, got %d", i+1, minSigningKeyLength, len(signingKey))
+		}
+		// the encryption key selects AES-128, AES-192 or AES-256
+		switch len(encryptionKey) {
+		case 16, 24, 32:
+		default:
+			return nil, errors.Errorf("cookie key pair %d: encryption key must be 16, 24 or 32 bytes long, got %d", i+1, len(encryptionKey))
+		}
+		if !s.Dev && (signingKey == defaultSecretKey || encryptionKey == defaultSecretKey) {
+			return nil, errors.Errorf("cookie key pair %d: the default key is only allowed in dev mode", i+1)
+		}
+		keyPairs = append(keyPairs, []byte(signingKey), []byte(encryptionKey))
+	}
+	return keyPairs, nil
+}
+
+// readKeyPairsFile reads one signing:encryption pair per line, empty lines and lines starting with # are skipped
+func readKeyPairsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open cookie keys file")
+	}
+	defer f.Close()
+
+	pairs := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pairs = append(pairs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read cookie keys file")
+	}
+	if len(pairs) == 0 {
+		return nil, errors.New("cookie keys file has no key pairs")
+	}
+	return pairs, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCookieKeyPairs(t *testing.T) {
+	signing := strings.Repeat("s", 32)
+	tests := []struct {
+		name    string
+		s       serverCmd
+		want    int
+		wantErr string
+	}{
+		{name: "single keys", s: serverCmd{CookieStoreSigningKey: strings.Repeat("s", 64), CookieStoreEncryptionKey: strings.Repeat("e", 32)}, want: 2},
+		{name: "key pairs", s: serverCmd{CookieStoreKeys: []string{signing + ":" + strings.Repeat("e", 16), signing + ":" + strings.Repeat("e", 24)}}, want: 4},
+		{name: "short signing key", s: serverCmd{CookieStoreSigningKey: strings.Repeat("s", 31), CookieStoreEncryptionKey: strings.Repeat("e", 32)}, wantErr: "signing key must be at least 32 bytes long"},
+		{name: "short signing key in a pair", s: serverCmd{CookieStoreKeys: []string{signing + ":" + strings.Repeat("e", 32), "short:" + strings.Repeat("e", 32)}}, wantErr: "cookie key pair 2: signing key"},
+		{name: "encryption key of no AES size", s: serverCmd{CookieStoreKeys: []string{signing + ":" + strings.Repeat("e", 20)}}, wantErr: "encryption key must be 16, 24 or 32 bytes long"},
+		{name: "too long encryption key", s: serverCmd{CookieStoreKeys: []string{signing + ":" + strings.Repeat("e", 64)}}, wantErr: "encryption key must be 16, 24 or 32 bytes long"},
+		{name: "missing encryption key", s: serverCmd{CookieStoreKeys: []string{signing}}, wantErr: "expected signing:encryption"},
+		{name: "default key", s: serverCmd{CookieStoreSigningKey: defaultSecretKey, CookieStoreEncryptionKey: defaultSecretKey}, wantErr: "only allowed in dev mode"},
+		{name: "default key in dev mode", s: serverCmd{Dev: true, CookieStoreSigningKey: defaultSecretKey, CookieStoreEncryptionKey: defaultSecretKey}, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.s.cookieKeyPairs()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("got %d keys, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestCookieKeyPairsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	content := "# newest first\n" + strings.Repeat("a", 32) + ":" + strings.Repeat("b", 32) + "\n\n" + strings.Repeat("c", 16) + ":" + strings.Repeat("d", 32) + "\n"
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &serverCmd{CookieStoreKeysFile: path}
+	_, err = s.cookieKeyPairs()
+	if err == nil || !strings.Contains(err.Error(), "cookie key pair 2: signing key must be at least 32 bytes long") {
+		t.Errorf("got %v, want the short signing key of the second pair to be rejected", err)
+	}
+}
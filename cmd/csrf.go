@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	echomiddleware "github.com/labstack/echo/v4/middleware"
+)
+
+const ErrCodeCsrfFailed = "csrf_failed"
+
+const csrfContextKey = "csrf"
+
+type csrfResponse struct {
+	Token string `json:"token"`
+}
+
+// csrfMiddleware protects cookie-authenticated requests with a double-submit token: the token is set in a cookie
+// and must be sent back in the X-CSRF-Token header, which other sites can't do.
+// Bearer requests are skipped, a browser never attaches the credentials of those on its own.
+func (s *serverCmd) csrfMiddleware() echo.MiddlewareFunc {
+	return echomiddleware.CSRFWithConfig(echomiddleware.CSRFConfig{
+		Skipper: func(c echo.Context) bool {
+			return c.Request().Header.Get(echo.HeaderAuthorization) != ""
+		},
+		TokenLookup:    "header:" + echo.HeaderXCSRFToken,
+		ContextKey:     csrfContextKey,
+		CookieName:     "csrf",
+		CookiePath:     "/",
+		CookieHTTPOnly: true,
+		CookieSecure:   s.CookieSecure,
+		CookieSameSite: http.SameSiteStrictMode,
+		ErrorHandler: func(err error, c echo.Context) error {
+			s.logger.Debug("csrf check failed", "err", err)
+			return newAPIError(http.StatusForbidden, ErrCodeCsrfFailed, "missing or invalid csrf token, fetch one from /auth/csrf")
+		},
+	})
+}
+
+// CsrfToken returns the token the frontend sends in the X-CSRF-Token header
+func (s *serverCmd) CsrfToken(c echo.Context) error {
+	token, _ := c.Get(csrfContextKey).(string)
+	return c.JSON(http.StatusOK, &csrfResponse{Token: token})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+// a cross-site form post carries the cookies but can't set the token header
+func TestAuthRoutesRequireCsrf(t *testing.T) {
+	s := &serverCmd{logger: dbtest.Logger()}
+	e := echo.New()
+	s.authRoutes(e)
+
+	posts := 0
+	for _, route := range e.Routes() {
+		if route.Method != http.MethodPost {
+			continue
+		}
+		posts++
+		t.Run(route.Path, func(t *testing.T) {
+			form := url.Values{"username": {"jane@example.com"}, "password": {"secret"}, "code": {"123456"}, "token": {"token"}}
+			req := httptest.NewRequest(http.MethodPost, route.Path, strings.NewReader(form.Encode()))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+			req.AddCookie(&http.Cookie{Name: "csrf", Value: "planted"})
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			got := &apiError{}
+			err := json.Unmarshal(rec.Body.Bytes(), got)
+			if rec.Code != http.StatusForbidden || err != nil || got.Code != ErrCodeCsrfFailed {
+				t.Errorf("got %d %s, want the csrf check to fail", rec.Code, rec.Body)
+			}
+		})
+	}
+	if posts == 0 {
+		t.Fatal("no POST routes registered")
+	}
+}
+
+func TestAuthRoutesCsrfToken(t *testing.T) {
+	s := &serverCmd{logger: dbtest.Logger()}
+	e := echo.New()
+	s.authRoutes(e)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/auth/csrf", nil))
+	token := &csrfResponse{}
+	err := json.Unmarshal(rec.Body.Bytes(), token)
+	if err != nil || token.Token == "" {
+		t.Fatalf("got %d %s, want a token", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+	}{
+		{name: "token in the header", header: echo.HeaderXCSRFToken, value: token.Token},
+		{name: "bearer credentials", header: echo.HeaderAuthorization, value: "Bearer pat_token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// an empty login is rejected by the handler, after the csrf check
+			req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader("{}"))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			req.Header.Set(tt.header, tt.value)
+			for _, c := range rec.Result().Cookies() {
+				req.AddCookie(c)
+			}
+			got := httptest.NewRecorder()
+			e.ServeHTTP(got, req)
+
+			apiErr := &apiError{}
+			err := json.Unmarshal(got.Body.Bytes(), apiErr)
+			if got.Code != http.StatusBadRequest || err != nil || apiErr.Code != ErrCodeInvalidRequest {
+				t.Errorf("got %d %s, want the login handler to reject the empty login", got.Code, got.Body)
+			}
+		})
+	}
+}
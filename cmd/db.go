@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// dbFlags are the database connection options shared by all commands
+type dbFlags struct {
+	DbAddr     string `help:"address of the database server" default:"127.0.0.1:5432"`
+	DbPassword string `help:"password for the database server" default:"postgres"`
+	SslMode    string `help:"ssl mode for the database connection" default:"disable"`
+}
+
+func dsn(dbAddr string, dbPassword string, sslMode string) string {
+	return fmt.Sprintf("postgres://postgres:%s@%s/postgres?sslmode=%s", dbPassword, dbAddr, sslMode)
+}
+
+func (f *dbFlags) openDb() (*gorm.DB, error) {
+	psqlDsn := dsn(f.DbAddr, f.DbPassword, f.SslMode)
+	db, err := gorm.Open(postgres.Open(psqlDsn))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize gorm")
+	}
+	return db, nil
+}
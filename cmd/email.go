@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/emailtoken"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/identity"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/mailer"
+)
+
+const (
+	ErrCodeExpiredToken    = "expired_token"
+	ErrCodeAlreadyVerified = "already_verified"
+)
+
+type emailTokenRequest struct {
+	Token string `json:"token" form:"token"`
+}
+
+type forgotPasswordRequest struct {
+	Username string `json:"username" form:"username"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token" form:"token"`
+	Password string `json:"password" form:"password"`
+}
+
+func (s *serverCmd) setupMailer() error {
+	switch s.Mailer {
+	case "smtp":
+		smtpMailer, err := mailer.NewSmtpMailer(s.logger, s.SmtpAddr, s.SmtpUsername, s.SmtpPassword, s.MailFrom)
+		if err != nil {
+			return err
+		}
+		s.mailer = smtpMailer
+	case "file":
+		s.mailer = mailer.NewFileMailer(s.MailerFile, s.MailFrom)
+	default:
+		s.mailer = mailer.NewLogMailer(s.logger)
+	}
+	return nil
+}
+
+// isEmail returns true if the username is a bare email address, e.g. "jane@example.com"
+func isEmail(username string) bool {
+	addr, err := mail.ParseAddress(username)
+	return err == nil && addr.Address == username
+}
+
+// emailLink returns a link to a page of the frontend which submits the token
+func (s *serverCmd) emailLink(path string, token string) string {
+	return s.PublicURL + path + "?token=" + url.QueryEscape(token)
+}
+
+func (s *serverCmd) sendVerificationEmail(u *model.User) error {
+	token := s.emailTokenSigner.Issue(emailtoken.PurposeVerifyEmail, u, s.EmailVerificationTTL)
+	return s.mailer.Send(&mailer.Message{
+		To:      u.Username,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Open the link below to verify your email address, it expires in %s.\n\n%s\n",
+			s.EmailVerificationTTL, s.emailLink("/verify-email", token)),
+	})
+}
+
+func (s *serverCmd) sendPasswordResetEmail(u *model.User) error {
+	token := s.emailTokenSigner.Issue(emailtoken.PurposeResetPassword, u, s.PasswordResetTTL)
+	return s.mailer.Send(&mailer.Message{
+		To:      u.Username,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Open the link below to choose a new password, it expires in %s.\n"+
+			"If you didn't ask for a password reset you can ignore this email.\n\n%s\n",
+			s.PasswordResetTTL, s.emailLink("/reset-password", token)),
+	})
+}
+
+// tokenUser loads the user a token was issued for and verifies the token
+func (s *serverCmd) tokenUser(purpose emailtoken.Purpose, token string) (*model.User, error) {
+	userID, err := s.emailTokenSigner.UserID(purpose, token)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, ErrCodeInvalidToken, "invalid token")
+	}
+	users := []*model.User{}
+	err = s.db.Where("id = ?", userID).Limit(1).Find(&users).Error
+	if err != nil {
+		s.logger.Error("failed to get user", "err", err)
+		return nil, newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	if len(users) == 0 {
+		return nil, newAPIError(http.StatusBadRequest, ErrCodeInvalidToken, "invalid token")
+	}
+
+	err = s.emailTokenSigner.Verify(purpose, token, users[0])
+	if errors.Is(err, emailtoken.ErrExpiredToken) {
+		return nil, newAPIError(http.StatusBadRequest, ErrCodeExpiredToken, "the link has expired, request a new one")
+	}
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, ErrCodeInvalidToken, "invalid token")
+	}
+	return users[0], nil
+}
+
+// hasLocalPassword returns false for users who log in at an identity provider or the directory, a local password
+// would bypass it and the account's SSO policy
+func (s *serverCmd) hasLocalPassword(u *model.User) (bool, error) {
+	if u.Password == "" {
+		return false, nil
+	}
+	var identities int64
+	err := s.db.Model(&identity.Identity{}).Where("user_id = ?", u.ID).Count(&identities).Error
+	if err != nil {
+		return false, errors.Wrap(err, "failed to count identities")
+	}
+	return identities == 0, nil
+}
+
+// SendVerificationEmail sends a new verification link to the logged in user
+func (s *serverCmd) SendVerificationEmail(c echo.Context) error {
+	u, pending, err := s.mfaUser(c)
+	if err != nil {
+		return err
+	}
+	if pending {
+		return newAPIError(http.StatusUnauthorized, ErrCodeNotLoggedIn, "not logged in")
+	}
+	if u.EmailVerifiedAt != nil {
+		return newAPIError(http.StatusConflict, ErrCodeAlreadyVerified, "the email address is already verified")
+	}
+	if !isEmail(u.Username) {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "the username is not an email address")
+	}
+
+	err = s.sendVerificationEmail(u)
+	if err != nil {
+		s.logger.Error("failed to send verification email", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "failed to send email")
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// VerifyEmail marks the email address of the user the token was issued for as verified
+func (s *serverCmd) VerifyEmail(c echo.Context) error {
+	input := &emailTokenRequest{}
+	err := c.Bind(input)
+	if err != nil || input.Token == "" {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "token is required")
+	}
+
+	u, err := s.tokenUser(emailtoken.PurposeVerifyEmail, input.Token)
+	if err != nil {
+		return err
+	}
+	if u.EmailVerifiedAt != nil {
+		return newAPIError(http.StatusConflict, ErrCodeAlreadyVerified, "the email address is already verified")
+	}
+
+	err = s.db.Model(u).Update("email_verified_at", time.Now()).Error
+	if err != nil {
+		s.logger.Error("failed to update user", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	s.logger.Info("verified email", "userid", u.ID)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ForgotPassword sends a password reset link, the response doesn't reveal whether the user exists
+func (s *serverCmd) ForgotPassword(c echo.Context) error {
+	input := &forgotPasswordRequest{}
+	err := c.Bind(input)
+	if err != nil || input.Username == "" {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "username is required")
+	}
+
+	// every request counts, whether the user exists or not, so throttling doesn't reveal it either
+	ip := c.RealIP()
+	wait, err := s.resetGuard.Check(input.Username, ip)
+	if err != nil {
+		s.logger.Error("failed to check password reset throttle", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	if wait > 0 {
+		s.logger.Debug("password reset throttled", "username", input.Username, "ip", ip, "wait", wait)
+		c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(wait.Seconds())+1))
+		return newAPIError(http.StatusTooManyRequests, ErrCodeTooManyAttempts, "too many password reset requests, try again later")
+	}
+	err = s.resetGuard.RecordFailure(input.Username, ip)
+	if err != nil {
+		s.logger.Error("failed to record password reset request", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+
+	users := []*model.User{}
+	err = s.db.Where("LOWER(username) = LOWER(?)", input.Username).Limit(1).Find(&users).Error
+	if err != nil {
+		s.logger.Error("failed to get user", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	if len(users) == 0 || !isEmail(users[0].Username) {
+		s.logger.Debug("password reset for unknown user", "username", input.Username)
+		return c.NoContent(http.StatusAccepted)
+	}
+	local, err := s.hasLocalPassword(users[0])
+	if err != nil {
+		s.logger.Error("failed to check password", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	if !local {
+		s.logger.Debug("password reset for external user", "username", input.Username)
+		return c.NoContent(http.StatusAccepted)
+	}
+
+	err = s.sendPasswordResetEmail(users[0])
+	if err != nil {
+		s.logger.Error("failed to send password reset email", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "failed to send email")
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// ResetPassword sets a new password and logs the user out everywhere
+func (s *serverCmd) ResetPassword(c echo.Context) error {
+	input := &resetPasswordRequest{}
+	err := c.Bind(input)
+	if err != nil || input.Token == "" || input.Password == "" {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "token and password are required")
+	}
+
+	u, err := s.tokenUser(emailtoken.PurposeResetPassword, input.Token)
+	if err != nil {
+		return err
+	}
+	// a link sent before the user was linked to an identity provider
+	local, err := s.hasLocalPassword(u)
+	if err != nil {
+		s.logger.Error("failed to check password", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	if !local {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidToken, "invalid token")
+	}
+	err = s.checkPassword(input.Password, u.Username)
+	if err != nil {
+		return err
+	}
+
+	hashedPassword, err := s.passwordHasher.Hash(input.Password)
+	if err != nil {
+		s.logger.Error("password hash error", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "failed to hash password")
+	}
+	updates := map[string]interface{}{"password": hashedPassword}
+	if u.EmailVerifiedAt == nil {
+		// the link was delivered, so the user owns the address
+		updates["email_verified_at"] = time.Now()
+	}
+	// the token is bound to the old password hash, changing it makes the token unusable
+	result := s.db.Model(u).Where("password = ?", u.Password).Updates(updates)
+	if result.Error != nil {
+		s.logger.Error("failed to update password", "err", result.Error)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	if result.RowsAffected == 0 {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidToken, "invalid token")
+	}
+
+	err = s.sessionRegistry.RevokeAllForUser(u.ID)
+	if err != nil {
+		s.logger.Error("failed to revoke sessions", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	err = s.loginGuard.Unlock(u.Username)
+	if err != nil {
+		s.logger.Error("failed to reset login throttle", "err", err)
+	}
+	s.logger.Info("reset password", "userid", u.ID)
+
+	return c.NoContent(http.StatusNoContent)
+}
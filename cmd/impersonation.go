@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/usersession"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+const ErrCodeImpersonating = "impersonation_not_allowed"
+
+// HeaderImpersonation flags responses to impersonation sessions, its value is when the impersonation ends
+const HeaderImpersonation = "X-Impersonation-Until"
+
+// checkImpersonation ends expired impersonations and flags the responses of active ones
+func (s *serverCmd) checkImpersonation(c echo.Context, sess *sessions.Session) error {
+	impersonatorID, impersonating := util.ImpersonatorID(sess)
+	if !impersonating {
+		return nil
+	}
+	until := util.ImpersonationUntil(sess)
+	if time.Now().Before(until) {
+		c.Response().Header().Set(HeaderImpersonation, until.UTC().Format(time.RFC3339))
+		return nil
+	}
+
+	// the request continues as the impersonator
+	util.EndImpersonation(sess)
+	err := usersession.Renew(sess)
+	if err == nil {
+		err = sess.Save(c.Request(), c.Response())
+	}
+	if err != nil {
+		s.logger.Error("failed to save session", "err", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session")
+	}
+	s.logger.Info("impersonation expired", "impersonatorid", impersonatorID)
+	return nil
+}
+
+// denyImpersonation rejects sensitive requests of impersonation sessions, e.g. changes to the impersonated user's credentials
+func (s *serverCmd) denyImpersonation(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		sess, err := session.Get(util.CookieKeySessionName, c)
+		if err != nil {
+			s.logger.Error("failed to get session", "err", err)
+			return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "failed to get session")
+		}
+		if _, impersonating := util.ImpersonatorID(sess); impersonating {
+			return newAPIError(http.StatusForbidden, ErrCodeImpersonating, "not allowed while impersonating a user")
+		}
+		return next(c)
+	}
+}
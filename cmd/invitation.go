@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/invitation"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/loginhistory"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+type acceptInvitationRequest struct {
+	Token    string `json:"token" form:"token"`
+	Password string `json:"password" form:"password"`
+}
+
+// AcceptInvitation creates the invited user in the inviting account and logs them in,
+// a logged in invitee joins the account with their existing user instead
+func (s *serverCmd) AcceptInvitation(c echo.Context) error {
+	input := &acceptInvitationRequest{}
+	err := c.Bind(input)
+	if err != nil || input.Token == "" {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "token is required")
+	}
+
+	sess, err := session.Get(util.CookieKeySessionName, c)
+	if err != nil {
+		s.logger.Error("failed to get session", "err", err)
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "failed to get session")
+	}
+	if _, loggedIn := sess.Values[util.SessionKeyUserID].(uint); loggedIn {
+		return s.joinInvitation(c, input.Token)
+	}
+	if input.Password == "" {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "password is required")
+	}
+	// the invitee's email becomes the username, the password must not contain it
+	inv, err := s.invitations.Lookup(input.Token)
+	if err != nil {
+		return s.invitationError(err)
+	}
+	err = s.checkPassword(input.Password, inv.Email)
+	if err != nil {
+		return err
+	}
+
+	hashedPassword, err := s.passwordHasher.Hash(input.Password)
+	if err != nil {
+		s.logger.Error("password hash error", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "failed to hash password")
+	}
+
+	u, err := s.invitations.Accept(input.Token, hashedPassword)
+	if errors.Is(err, invitation.ErrUsernameTaken) {
+		return newAPIError(http.StatusConflict, ErrCodeUsernameTaken, "a user with this email already exists, log in to accept the invitation")
+	}
+	if err != nil {
+		return s.invitationError(err)
+	}
+
+	// a new user can't have a second factor yet, enrollment is the last step if the account requires it
+	if u.Account.RequireMfa {
+		err = s.startPendingSession(c, u, nil)
+		if err != nil {
+			s.logger.Error("failed to save session", "err", err)
+			return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "failed to save session")
+		}
+		return newAPIError(http.StatusUnauthorized, ErrCodeMfaEnrollmentRequired, "the account requires two-factor authentication, enroll at /auth/mfa/enroll")
+	}
+
+	err = s.startSession(c, u, loginhistory.MethodInvitation)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, newAuthResponse(u, u.Account))
+}
+
+// joinInvitation adds the logged in user to the inviting account, the session stays in the current account
+func (s *serverCmd) joinInvitation(c echo.Context, token string) error {
+	u, pending, err := s.mfaUser(c)
+	if err != nil {
+		return err
+	}
+	if pending {
+		return newAPIError(http.StatusUnauthorized, ErrCodeNotLoggedIn, "not logged in")
+	}
+
+	// the inviting account's second factor requirement applies before the user becomes a member
+	inv, err := s.invitations.Lookup(token)
+	if err != nil {
+		return s.invitationError(err)
+	}
+	account, err := s.loadAccount("id = ?", inv.AccountID)
+	if err != nil {
+		return err
+	}
+	err = s.requireMfaFor(u, account)
+	if err != nil {
+		return err
+	}
+
+	account, err = s.invitations.Join(token, u)
+	if errors.Is(err, invitation.ErrWrongUser) {
+		return newAPIError(http.StatusForbidden, ErrCodeForbidden, "the invitation is for another user")
+	}
+	if err != nil {
+		return s.invitationError(err)
+	}
+
+	return c.JSON(http.StatusOK, newAuthResponse(u, account))
+}
+
+func (s *serverCmd) invitationError(err error) error {
+	switch {
+	case errors.Is(err, invitation.ErrInvalidInvitation):
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidToken, "invalid invitation")
+	case errors.Is(err, invitation.ErrExpiredInvitation):
+		return newAPIError(http.StatusBadRequest, ErrCodeExpiredToken, "the invitation has expired, ask for a new one")
+	default:
+		s.logger.Error("failed to accept invitation", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+}
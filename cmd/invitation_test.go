@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/invitation"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/password"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/breachedtest"
+)
+
+type fakeInvitations struct {
+	invitation.Service
+	invitation *invitation.Invitation
+	accepted   bool
+	joined     bool
+}
+
+func (f *fakeInvitations) Lookup(token string) (*invitation.Invitation, error) {
+	if token != "valid" {
+		return nil, invitation.ErrInvalidInvitation
+	}
+	return f.invitation, nil
+}
+
+func (f *fakeInvitations) Accept(token string, passwordHash string) (*model.User, error) {
+	f.accepted = true
+	// the password passed, the rest of the flow is covered by the invitation service
+	return nil, invitation.ErrUsernameTaken
+}
+
+func (f *fakeInvitations) Join(token string, user *model.User) (*model.Account, error) {
+	f.joined = true
+	return &model.Account{ID: f.invitation.AccountID}, nil
+}
+
+func TestAcceptInvitationPassword(t *testing.T) {
+	tests := []struct {
+		name         string
+		token        string
+		password     string
+		wantStatus   int
+		wantCode     string
+		wantAccepted bool
+	}{
+		{name: "strong password", token: "valid", password: "correct horse battery staple", wantStatus: http.StatusConflict, wantCode: ErrCodeUsernameTaken, wantAccepted: true},
+		{name: "contains the email", token: "valid", password: "jane.doe@example.com!", wantStatus: http.StatusBadRequest, wantCode: ErrCodeWeakPassword},
+		{name: "contains the local part", token: "valid", password: "jane.doe-2024-secret", wantStatus: http.StatusBadRequest, wantCode: ErrCodeWeakPassword},
+		{name: "too short", token: "valid", password: "short", wantStatus: http.StatusBadRequest, wantCode: ErrCodeWeakPassword},
+		{name: "breached", token: "valid", password: "correct horse battery staple breached", wantStatus: http.StatusBadRequest, wantCode: ErrCodeWeakPassword},
+		{name: "breached list can't be read", token: "valid", password: "correct horse battery staple unreadable", wantStatus: http.StatusInternalServerError, wantCode: ErrCodeInternal},
+		{name: "invalid invitation", token: "forged", password: "correct horse battery staple", wantStatus: http.StatusBadRequest, wantCode: ErrCodeInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hasher, err := password.NewPHCHasher(password.Config{Algorithm: password.AlgorithmBcrypt, BcryptCost: 4})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := breachedtest.Dir(t, "correct horse battery staple breached")
+			breachedtest.Unreadable(t, dir, "correct horse battery staple unreadable")
+			breached, err := password.NewPrefixDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			invitations := &fakeInvitations{invitation: &invitation.Invitation{Email: "jane.doe@example.com"}}
+			s := &serverCmd{
+				logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+				store:          sessions.NewCookieStore(securecookie.GenerateRandomKey(32)),
+				passwordHasher: hasher,
+				passwordPolicy: &password.Policy{MinLength: 12, Breached: breached},
+				invitations:    invitations,
+			}
+			e := echo.New()
+			e.Use(session.Middleware(s.store))
+			e.POST("/auth/invitations/accept", s.AcceptInvitation)
+
+			body, _ := json.Marshal(acceptInvitationRequest{Token: tt.token, Password: tt.password})
+			req := httptest.NewRequest(http.MethodPost, "/auth/invitations/accept", strings.NewReader(string(body)))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			got := &apiError{}
+			err = json.Unmarshal(rec.Body.Bytes(), got)
+			if err != nil || got.Code != tt.wantCode {
+				t.Errorf("got %s, want code %s", rec.Body, tt.wantCode)
+			}
+			if invitations.accepted != tt.wantAccepted {
+				t.Errorf("got accepted %v, want %v", invitations.accepted, tt.wantAccepted)
+			}
+		})
+	}
+}
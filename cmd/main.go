@@ -17,6 +17,8 @@ type kongApp struct {
 	LogLevel int `short:"l" help:"Log level: 0 (debug), 1 (info), 2 (warn), 3 (error)" default:"0"`
 
 	Server serverCmd `cmd:"" help:"Start the app server."`
+	Policy policyCmd `cmd:"" help:"Manage authorization policy versions."`
+	Users  usersCmd  `cmd:"" help:"Maintain users."`
 }
 
 func main() {
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/loginhistory"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/mfa"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/usersession"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+const PendingSessionSeconds = 300 // 5 minutes
+
+type mfaCodeRequest struct {
+	Code string `json:"code" form:"code"`
+}
+
+type mfaConfirmResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// startPendingSession remembers that the password was verified, the user is not logged in until the second factor is verified.
+// The groups of an identity provider login wait for the second factor as well, nil if there are none.
+func (s *serverCmd) startPendingSession(c echo.Context, u *model.User, groups []string) error {
+	sess, _ := s.store.Get(c.Request(), util.CookieKeySessionName) // this func returns an error when a session is created
+	sess.Options = s.cookieOptions(PendingSessionSeconds)
+	clearSession(sess)
+	err := usersession.Renew(sess)
+	if err != nil {
+		return err
+	}
+	sess.Values[util.SessionKeyPendingUserID] = u.ID
+	sess.Values[util.SessionKeyPendingUntil] = time.Now().Add(PendingSessionSeconds * time.Second).Unix()
+	if groups != nil {
+		sess.Values[util.SessionKeyPendingGroups] = groups
+	}
+	return sess.Save(c.Request(), c.Response())
+}
+
+// mfaUser returns the user of a full session, or of a pending session in which case pending is true
+func (s *serverCmd) mfaUser(c echo.Context) (u *model.User, pending bool, err error) {
+	sess, err := session.Get(util.CookieKeySessionName, c)
+	if err != nil {
+		s.logger.Error("failed to get session", "err", err)
+		return nil, false, newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "failed to get session")
+	}
+
+	userID, loggedIn := sess.Values[util.SessionKeyUserID].(uint)
+	if !loggedIn {
+		pendingUntil, _ := sess.Values[util.SessionKeyPendingUntil].(int64)
+		userID, pending = sess.Values[util.SessionKeyPendingUserID].(uint)
+		if !pending || time.Now().Unix() > pendingUntil {
+			return nil, false, newAPIError(http.StatusUnauthorized, ErrCodeNotLoggedIn, "not logged in")
+		}
+	}
+
+	u = &model.User{}
+	err = s.db.Preload("Account").Where("id = ?", userID).First(u).Error
+	if err != nil {
+		s.logger.Error("failed to get user", "err", err)
+		return nil, false, newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	return u, pending, nil
+}
+
+// syncPendingGroups syncs the identity provider groups of a pending login after its second factor was verified,
+// u is the user as loaded by mfaUser, with their home account. Errors are safe to return to the client.
+func (s *serverCmd) syncPendingGroups(c echo.Context, u *model.User) error {
+	sess, err := session.Get(util.CookieKeySessionName, c)
+	if err != nil {
+		s.logger.Error("failed to get session", "err", err)
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "failed to get session")
+	}
+	groups, ok := sess.Values[util.SessionKeyPendingGroups].([]string)
+	if !ok {
+		return nil
+	}
+	// an empty list may come back as nil, it still removes the roles of the user's former groups
+	return s.syncGroups(u, u.Account, append([]string{}, groups...))
+}
+
+// checkMfaThrottle applies the login brute-force protection to one-time codes
+func (s *serverCmd) checkMfaThrottle(c echo.Context, u *model.User) error {
+	wait, err := s.loginGuard.Check(u.Username, c.RealIP())
+	if err != nil {
+		s.logger.Error("failed to check login throttle", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	if wait > 0 {
+		c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(wait.Seconds())+1))
+		return newAPIError(http.StatusTooManyRequests, ErrCodeTooManyAttempts, "too many failed attempts, try again later")
+	}
+	return nil
+}
+
+// requireMfaFor refuses users without a second factor in accounts which require one, errors are safe to return to the client
+func (s *serverCmd) requireMfaFor(u *model.User, account *model.Account) error {
+	if !account.RequireMfa {
+		return nil
+	}
+	mfaEnabled, err := s.mfaService.IsEnabled(u.ID)
+	if err != nil {
+		s.logger.Error("failed to check mfa", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	if !mfaEnabled {
+		return newAPIError(http.StatusForbidden, ErrCodeMfaEnrollmentRequired, "the account requires two-factor authentication, enroll at /auth/mfa/enroll first")
+	}
+	return nil
+}
+
+func (s *serverCmd) MfaEnroll(c echo.Context) error {
+	u, _, err := s.mfaUser(c)
+	if err != nil {
+		return err
+	}
+
+	enrollment, err := s.mfaService.Enroll(u.ID, u.Username)
+	if errors.Is(err, mfa.ErrAlreadyEnabled) {
+		return newAPIError(http.StatusConflict, ErrCodeMfaAlreadyEnabled, "two-factor authentication is already enabled")
+	}
+	if err != nil {
+		s.logger.Error("failed to enroll mfa", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+
+	return c.JSON(http.StatusOK, enrollment)
+}
+
+func (s *serverCmd) MfaConfirm(c echo.Context) error {
+	input := &mfaCodeRequest{}
+	err := c.Bind(input)
+	if err != nil || input.Code == "" {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "code is required")
+	}
+	u, pending, err := s.mfaUser(c)
+	if err != nil {
+		return err
+	}
+	err = s.checkMfaThrottle(c, u)
+	if err != nil {
+		return err
+	}
+
+	recoveryCodes, err := s.mfaService.Confirm(u.ID, input.Code)
+	switch {
+	case errors.Is(err, mfa.ErrInvalidCode):
+		s.recordLoginFailure(u.Username, c.RealIP())
+		if pending {
+			s.recordLogin(c, u, u.Username, loginhistory.MethodMfa, loginhistory.OutcomeFailure, loginhistory.ReasonInvalidCode)
+		}
+		return newAPIError(http.StatusUnauthorized, ErrCodeInvalidCode, "invalid code")
+	case errors.Is(err, mfa.ErrNotEnrolled):
+		return newAPIError(http.StatusBadRequest, ErrCodeMfaNotEnrolled, "enroll before confirming")
+	case errors.Is(err, mfa.ErrAlreadyEnabled):
+		return newAPIError(http.StatusConflict, ErrCodeMfaAlreadyEnabled, "two-factor authentication is already enabled")
+	case err != nil:
+		s.logger.Error("failed to confirm mfa", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+
+	// enrollment was the last step of the login
+	if pending {
+		err = s.syncPendingGroups(c, u)
+		if err != nil {
+			return err
+		}
+		err = s.startSession(c, u, loginhistory.MethodMfa)
+		if err != nil {
+			return err
+		}
+		s.resetLoginThrottle(u)
+	}
+
+	return c.JSON(http.StatusOK, &mfaConfirmResponse{RecoveryCodes: recoveryCodes})
+}
+
+func (s *serverCmd) MfaVerify(c echo.Context) error {
+	input := &mfaCodeRequest{}
+	err := c.Bind(input)
+	if err != nil || input.Code == "" {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "code is required")
+	}
+	u, pending, err := s.mfaUser(c)
+	if err != nil {
+		return err
+	}
+	if !pending {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "already logged in")
+	}
+	err = s.checkMfaThrottle(c, u)
+	if err != nil {
+		return err
+	}
+
+	valid, err := s.mfaService.Verify(u.ID, input.Code)
+	if errors.Is(err, mfa.ErrNotEnrolled) {
+		return newAPIError(http.StatusBadRequest, ErrCodeMfaNotEnrolled, "two-factor authentication is not enrolled")
+	}
+	if err != nil {
+		s.logger.Error("failed to verify mfa", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	if !valid {
+		s.recordLoginFailure(u.Username, c.RealIP())
+		s.recordLogin(c, u, u.Username, loginhistory.MethodMfa, loginhistory.OutcomeFailure, loginhistory.ReasonInvalidCode)
+		return newAPIError(http.StatusUnauthorized, ErrCodeInvalidCode, "invalid code")
+	}
+
+	err = s.syncPendingGroups(c, u)
+	if err != nil {
+		return err
+	}
+	err = s.startSession(c, u, loginhistory.MethodMfa)
+	if err != nil {
+		return err
+	}
+	s.resetLoginThrottle(u)
+
+	return c.JSON(http.StatusOK, newAuthResponse(u, u.Account))
+}
+
+func (s *serverCmd) MfaDisable(c echo.Context) error {
+	input := &mfaCodeRequest{}
+	err := c.Bind(input)
+	if err != nil || input.Code == "" {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "code is required")
+	}
+	u, pending, err := s.mfaUser(c)
+	if err != nil {
+		return err
+	}
+	if pending {
+		return newAPIError(http.StatusUnauthorized, ErrCodeNotLoggedIn, "not logged in")
+	}
+	// the user can switch into any account they are an active member of, none of them may require a second factor
+	memberships, err := s.memberships.Memberships(u.ID)
+	if err != nil {
+		s.logger.Error("failed to get memberships", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	for _, m := range memberships {
+		if m.Account.RequireMfa {
+			return newAPIError(http.StatusForbidden, ErrCodeForbidden, "the account "+m.Account.Name+" requires two-factor authentication")
+		}
+	}
+	err = s.checkMfaThrottle(c, u)
+	if err != nil {
+		return err
+	}
+
+	// a valid code proves that the session isn't used by someone else
+	valid, err := s.mfaService.Verify(u.ID, input.Code)
+	if errors.Is(err, mfa.ErrNotEnrolled) {
+		return newAPIError(http.StatusBadRequest, ErrCodeMfaNotEnrolled, "two-factor authentication is not enrolled")
+	}
+	if err != nil {
+		s.logger.Error("failed to verify mfa", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	if !valid {
+		s.recordLoginFailure(u.Username, c.RealIP())
+		return newAPIError(http.StatusUnauthorized, ErrCodeInvalidCode, "invalid code")
+	}
+
+	err = s.mfaService.Disable(u.ID)
+	if err != nil {
+		s.logger.Error("failed to disable mfa", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	s.logger.Info("disabled mfa", "userid", u.ID)
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/invitation"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/loginguard"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/membership"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+// allowLogins never throttles
+type allowLogins struct {
+	loginguard.Guard
+}
+
+func (allowLogins) Check(username string, ip string) (time.Duration, error) {
+	return 0, nil
+}
+
+// sessionCookies returns the cookies of a session in which the user is logged in to the account
+func sessionCookies(t *testing.T, store sessions.Store, user *model.User, account *model.Account) []*http.Cookie {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	sess, _ := store.Get(httptest.NewRequest(http.MethodGet, "/", nil), util.CookieKeySessionName)
+	sess.Values[util.SessionKeyUserID] = user.ID
+	sess.Values[util.SessionKeyAccountID] = account.Ulid
+	err := sess.Save(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.Result().Cookies()
+}
+
+func TestJoinInvitationRequiresMfa(t *testing.T) {
+	tests := []struct {
+		name       string
+		requireMfa bool
+		mfaEnabled bool
+		wantStatus int
+	}{
+		{name: "account without the requirement", wantStatus: http.StatusOK},
+		{name: "required and enabled", requireMfa: true, mfaEnabled: true, wantStatus: http.StatusOK},
+		{name: "required but not enabled", requireMfa: true, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Open(t)
+			acme := dbtest.Account(t, db, "acme")
+			other := dbtest.Account(t, db, "other")
+			err := db.Model(other).Update("require_mfa", tt.requireMfa).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+			jane := dbtest.User(t, db, acme, "jane@example.com")
+
+			invitations := &fakeInvitations{invitation: &invitation.Invitation{AccountID: other.ID, Email: jane.Username}}
+			s := &serverCmd{
+				db:          db,
+				logger:      dbtest.Logger(),
+				store:       sessions.NewCookieStore(securecookie.GenerateRandomKey(32)),
+				invitations: invitations,
+				mfaService:  &fakeMfa{enabled: tt.mfaEnabled},
+			}
+			e := echo.New()
+			e.Use(session.Middleware(s.store))
+			e.POST("/auth/invitations/accept", s.AcceptInvitation)
+
+			req := httptest.NewRequest(http.MethodPost, "/auth/invitations/accept", strings.NewReader(`{"token": "valid"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			for _, c := range sessionCookies(t, s.store, jane, acme) {
+				req.AddCookie(c)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			if invitations.joined != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("got joined %v, want %v", invitations.joined, tt.wantStatus == http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestMfaDisableRequiredByAccount(t *testing.T) {
+	tests := []struct {
+		name string
+		// requireMfa lists the accounts which require a second factor
+		requireMfa []string
+		// deactivated is true if the directory of the other account deactivated jane there
+		deactivated bool
+		wantStatus  int
+	}{
+		{name: "no account requires mfa", wantStatus: http.StatusNoContent},
+		{name: "home account requires mfa", requireMfa: []string{"acme"}, wantStatus: http.StatusForbidden},
+		{name: "other account requires mfa", requireMfa: []string{"other"}, wantStatus: http.StatusForbidden},
+		{name: "deactivated in the account which requires mfa", requireMfa: []string{"other"}, deactivated: true, wantStatus: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Open(t)
+			acme := dbtest.Account(t, db, "acme")
+			other := dbtest.Account(t, db, "other")
+			for _, name := range tt.requireMfa {
+				err := db.Model(&model.Account{}).Where("name = ?", name).Update("require_mfa", true).Error
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			jane := dbtest.User(t, db, acme, "jane@example.com")
+			dbtest.Member(t, db, jane, other)
+			if tt.deactivated {
+				err := db.Exec("UPDATE account_memberships SET deactivated_at = NOW() WHERE user_id = ? AND account_id = ?", jane.ID, other.ID).Error
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			mfaService := &fakeMfa{enabled: true, valid: true}
+			s := &serverCmd{
+				db:          db,
+				logger:      dbtest.Logger(),
+				store:       sessions.NewCookieStore(securecookie.GenerateRandomKey(32)),
+				memberships: membership.NewDbService(db, dbtest.Logger()),
+				mfaService:  mfaService,
+				loginGuard:  allowLogins{},
+			}
+			e := echo.New()
+			e.Use(session.Middleware(s.store))
+			e.POST("/auth/mfa/disable", s.MfaDisable)
+
+			req := httptest.NewRequest(http.MethodPost, "/auth/mfa/disable", strings.NewReader(`{"code": "123456"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			for _, c := range sessionCookies(t, s.store, jane, acme) {
+				req.AddCookie(c)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", rec.Code, rec.Body, tt.wantStatus)
+			}
+			if mfaService.enabled != (tt.wantStatus != http.StatusNoContent) {
+				t.Errorf("got mfa enabled %v after status %d", mfaService.enabled, rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/identity"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/loginhistory"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+const OidcFlowSeconds = 600 // 10 minutes to complete the login at the identity provider
+
+// Keys of the short-lived session which carries the state of the authorization code flow
+const (
+	sessionKeyOidcState    = "state"
+	sessionKeyOidcNonce    = "nonce"
+	sessionKeyOidcVerifier = "verifier"
+)
+
+const (
+	ErrCodeOidcFailed    = "oidc_failed"
+	ErrCodeUsernameTaken = "username_taken"
+)
+
+type oidcClient struct {
+	verifier     *oidc.IDTokenVerifier
+	config       *oauth2.Config
+	postLoginURL *url.URL
+}
+
+// redirectURL is where the browser goes after the callback, a pending login is continued by the frontend
+// at /auth/mfa and the mfa parameter tells it how
+func (o *oidcClient) redirectURL(mfaCode string) string {
+	if mfaCode == "" {
+		return o.postLoginURL.String()
+	}
+	u := *o.postLoginURL
+	query := u.Query()
+	query.Set("mfa", mfaCode)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (s *serverCmd) setupOidc(ctx context.Context) error {
+	postLoginURL, err := url.Parse(s.OidcPostLoginURL)
+	if err != nil {
+		return errors.Wrap(err, "invalid oidc post login url")
+	}
+	provider, err := oidc.NewProvider(ctx, s.OidcIssuer)
+	if err != nil {
+		return errors.Wrap(err, "failed to discover oidc provider")
+	}
+	s.oidc = &oidcClient{
+		verifier: provider.Verifier(&oidc.Config{ClientID: s.OidcClientID}),
+		config: &oauth2.Config{
+			ClientID:     s.OidcClientID,
+			ClientSecret: s.OidcClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  s.OidcRedirectURL,
+			Scopes:       s.OidcScopes,
+		},
+		postLoginURL: postLoginURL,
+	}
+	return nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to generate random token")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// OidcLogin starts the authorization code flow with PKCE
+func (s *serverCmd) OidcLogin(c echo.Context) error {
+	state, err := randomToken()
+	if err != nil {
+		s.logger.Error("failed to generate state", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		s.logger.Error("failed to generate nonce", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	// the flow state lives in its own cookie so that it doesn't touch the user's session
+	sess, _ := s.store.Get(c.Request(), util.CookieKeyOidcName) // this func returns an error when a session is created
+	sess.Options = s.cookieOptions(OidcFlowSeconds)
+	sess.Values[sessionKeyOidcState] = state
+	sess.Values[sessionKeyOidcNonce] = nonce
+	sess.Values[sessionKeyOidcVerifier] = verifier
+	err = sess.Save(c.Request(), c.Response())
+	if err != nil {
+		s.logger.Error("failed to save session", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "failed to save session")
+	}
+
+	authURL := s.oidc.config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	return c.Redirect(http.StatusFound, authURL)
+}
+
+// OidcCallback finishes the authorization code flow and logs the user in
+func (s *serverCmd) OidcCallback(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	sess, err := s.store.Get(c.Request(), util.CookieKeyOidcName)
+	if err != nil {
+		s.logger.Debug("failed to get oidc session", "err", err)
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "login expired, start again")
+	}
+	state, _ := sess.Values[sessionKeyOidcState].(string)
+	nonce, _ := sess.Values[sessionKeyOidcNonce].(string)
+	verifier, _ := sess.Values[sessionKeyOidcVerifier].(string)
+	if state == "" || c.QueryParam("state") != state {
+		s.logger.Debug("oidc state mismatch")
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "login expired, start again")
+	}
+
+	// the flow state is single use
+	sess.Options = s.cookieOptions(-1)
+	err = sess.Save(c.Request(), c.Response())
+	if err != nil {
+		s.logger.Error("failed to save session", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "failed to save session")
+	}
+
+	if errParam := c.QueryParam("error"); errParam != "" {
+		s.logger.Debug("oidc provider returned an error", "error", errParam, "description", c.QueryParam("error_description"))
+		return newAPIError(http.StatusUnauthorized, ErrCodeOidcFailed, "identity provider returned an error")
+	}
+
+	// exchange the code and verify the id token
+	token, err := s.oidc.config.Exchange(ctx, c.QueryParam("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		s.logger.Debug("failed to exchange oidc code", "err", err)
+		return newAPIError(http.StatusUnauthorized, ErrCodeOidcFailed, "failed to exchange code")
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		s.logger.Debug("no id token in oidc token response")
+		return newAPIError(http.StatusUnauthorized, ErrCodeOidcFailed, "no id token")
+	}
+	idToken, err := s.oidc.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		s.logger.Debug("failed to verify id token", "err", err)
+		return newAPIError(http.StatusUnauthorized, ErrCodeOidcFailed, "invalid id token")
+	}
+	if idToken.Nonce != nonce {
+		s.logger.Debug("oidc nonce mismatch")
+		return newAPIError(http.StatusUnauthorized, ErrCodeOidcFailed, "invalid id token")
+	}
+
+	// map the claims to a user
+	claims := map[string]interface{}{}
+	err = idToken.Claims(&claims)
+	if err != nil {
+		s.logger.Debug("failed to parse id token claims", "err", err)
+		return newAPIError(http.StatusUnauthorized, ErrCodeOidcFailed, "invalid id token")
+	}
+	username, _ := claims[s.OidcUsernameClaim].(string)
+	if username == "" {
+		s.logger.Debug("no username claim in id token", "claim", s.OidcUsernameClaim)
+		return newAPIError(http.StatusUnauthorized, ErrCodeOidcFailed, "no username in id token")
+	}
+	emailVerified, _ := claims["email_verified"].(bool)
+
+	u, err := s.identityProvisioner.Provision(&identity.ExternalUser{
+		Provider: idToken.Issuer,
+		Subject:  idToken.Subject,
+		Username: username,
+		Verified: s.OidcUsernameClaim == "email" && emailVerified,
+	})
+	if errors.Is(err, identity.ErrUsernameTaken) {
+		s.recordLogin(c, nil, username, loginhistory.MethodSso, loginhistory.OutcomeFailure, loginhistory.ReasonUsernameTaken)
+		return newAPIError(http.StatusConflict, ErrCodeUsernameTaken, "a local user with this username already exists")
+	}
+	if err != nil {
+		s.logger.Error("failed to provision oidc user", "err", err)
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	s.logger.Debug("oidc login", "username", u.Username, "subject", idToken.Subject)
+
+	// group membership from the identity provider, a missing claim means no groups
+	groups := []string{}
+	rawGroups, _ := claims[s.OidcGroupsClaim].([]interface{})
+	for _, g := range rawGroups {
+		if group, ok := g.(string); ok {
+			groups = append(groups, group)
+		}
+	}
+
+	// the identity provider's second factor isn't known, so the user's own applies like after a password,
+	// the groups are synced once the login completes so that a deactivated user or a missing second factor grants nothing
+	mfaCode, err := s.startLogin(c, u, loginhistory.MethodSso, groups)
+	if err != nil {
+		return err
+	}
+
+	return c.Redirect(http.StatusFound, s.oidc.redirectURL(mfaCode))
+}
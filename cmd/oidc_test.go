@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/groupsync"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/identity"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/loginhistory"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/membership"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/mfa"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/usersession"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+const testClientID = "test-client"
+
+// fakeOidcProvider is an identity provider with discovery, a token endpoint which checks PKCE, and signed ID tokens.
+// The authorization endpoint is skipped, tests issue codes with authorize.
+type fakeOidcProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]*fakeGrant
+}
+
+type fakeGrant struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newFakeOidcProvider(t *testing.T) *fakeOidcProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeOidcProvider{key: key, grants: map[string]*fakeGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                                p.server.URL,
+			"authorization_endpoint":                p.server.URL + "/authorize",
+			"token_endpoint":                        p.server.URL + "/token",
+			"jwks_uri":                              p.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &p.key.PublicKey, KeyID: "test", Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// authorize issues a code for the PKCE challenge, the ID token gets the claims
+func (p *fakeOidcProvider) authorize(challenge string, claims map[string]interface{}) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	code := base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(16))
+	p.grants[code] = &fakeGrant{challenge: challenge, claims: claims}
+	return code
+}
+
+func (p *fakeOidcProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	grant, ok := p.grants[r.FormValue("code")]
+	delete(p.grants, r.FormValue("code"))
+	p.mu.Unlock()
+
+	if !ok || pkceChallenge(r.FormValue("code_verifier")) != grant.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	claims := map[string]interface{}{
+		"iss": p.server.URL,
+		"aud": testClientID,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+	for k, v := range grant.claims {
+		claims[k] = v
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: p.key, KeyID: "test"}}, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	payload, _ := json.Marshal(claims)
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	idToken, _ := signed.CompactSerialize()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idToken,
+	})
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+type fakeProvisioner struct {
+	user *model.User
+	got  *identity.ExternalUser
+}
+
+func (p *fakeProvisioner) Provision(ext *identity.ExternalUser) (*model.User, error) {
+	p.got = ext
+	return p.user, nil
+}
+
+type fakeSyncer struct {
+	groupsync.Syncer
+	synced  bool
+	groups  []string
+	account *model.Account
+}
+
+func (s *fakeSyncer) Sync(user *model.User, account *model.Account, groups []string) error {
+	s.synced = true
+	s.groups = groups
+	s.account = account
+	return nil
+}
+
+type fakeMfa struct {
+	mfa.Service
+	enabled bool
+	// valid is the result of every verified code
+	valid bool
+}
+
+func (m *fakeMfa) IsEnabled(userID uint) (bool, error) {
+	return m.enabled, nil
+}
+
+func (m *fakeMfa) Verify(userID uint, code string) (bool, error) {
+	return m.valid, nil
+}
+
+func (m *fakeMfa) Disable(userID uint) error {
+	m.enabled = false
+	return nil
+}
+
+type fakeRegistry struct {
+	usersession.Registry
+	created []string
+}
+
+func (r *fakeRegistry) Create(ulid string, userID uint, ttl time.Duration, ip string, userAgent string) (*usersession.Session, error) {
+	r.created = append(r.created, ulid)
+	return &usersession.Session{Ulid: ulid, UserID: userID}, nil
+}
+
+type fakeHistory struct {
+	events []*loginhistory.Event
+}
+
+func (h *fakeHistory) Record(event *loginhistory.Event) error {
+	h.events = append(h.events, event)
+	return nil
+}
+
+func (h *fakeHistory) ForUser(userID uint, limit int) ([]*loginhistory.Event, error) {
+	return h.events, nil
+}
+
+// fakeMemberships has the user's home account as their only membership, unless its directory deactivated them
+type fakeMemberships struct {
+	membership.Service
+	user        *model.User
+	deactivated bool
+}
+
+func (m *fakeMemberships) Memberships(userID uint) ([]*membership.Membership, error) {
+	if m.deactivated {
+		return []*membership.Membership{}, nil
+	}
+	return []*membership.Membership{{UserID: userID, AccountID: m.user.Account.ID, Account: m.user.Account}}, nil
+}
+
+// oidcFixture is the server with the OIDC routes and a browser with a cookie jar
+type oidcFixture struct {
+	s           *serverCmd
+	provider    *fakeOidcProvider
+	app         *httptest.Server
+	browser     *http.Client
+	provisioner *fakeProvisioner
+	syncer      *fakeSyncer
+	registry    *fakeRegistry
+	memberships *fakeMemberships
+}
+
+func newOidcFixture(t *testing.T, mfaEnabled bool, requireMfa bool) *oidcFixture {
+	provider := newFakeOidcProvider(t)
+	user := &model.User{ID: 7, Ulid: "01JAAAAAAAAAAAAAAAAAAAAAAA", Username: "jane@example.com", AccountID: 3,
+		Account: &model.Account{ID: 3, Ulid: "01JBBBBBBBBBBBBBBBBBBBBBBB", Name: "acme", RequireMfa: requireMfa}}
+	f := &oidcFixture{
+		provider:    provider,
+		provisioner: &fakeProvisioner{user: user},
+		syncer:      &fakeSyncer{},
+		registry:    &fakeRegistry{},
+		memberships: &fakeMemberships{user: user},
+	}
+	f.s = &serverCmd{
+		OidcIssuer:        provider.server.URL,
+		OidcClientID:      testClientID,
+		OidcClientSecret:  "secret",
+		OidcRedirectURL:   "http://localhost/auth/oidc/callback",
+		OidcScopes:        []string{"openid", "email"},
+		OidcUsernameClaim: "email",
+		OidcGroupsClaim:   "groups",
+		OidcPostLoginURL:  "/app",
+
+		logger:              slog.New(slog.NewTextHandler(io.Discard, nil)),
+		store:               sessions.NewCookieStore(securecookie.GenerateRandomKey(32)),
+		ulidManager:         util.NewUlidManager(),
+		identityProvisioner: f.provisioner,
+		groupSyncer:         f.syncer,
+		mfaService:          &fakeMfa{enabled: mfaEnabled},
+		sessionRegistry:     f.registry,
+		loginHistory:        &fakeHistory{},
+		memberships:         f.memberships,
+	}
+	err := f.s.setupOidc(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(session.Middleware(f.s.store))
+	e.GET("/auth/oidc/login", f.s.OidcLogin)
+	e.GET("/auth/oidc/callback", f.s.OidcCallback)
+	f.app = httptest.NewServer(e)
+	t.Cleanup(f.app.Close)
+
+	jar, _ := cookiejar.New(nil)
+	f.browser = &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return f
+}
+
+// login starts the flow and returns the parameters the browser takes to the identity provider
+func (f *oidcFixture) login(t *testing.T) url.Values {
+	resp, err := f.browser.Get(f.app.URL + "/auth/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || err != nil {
+		t.Fatalf("expected a redirect to the provider, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	params := location.Query()
+	if params.Get("code_challenge_method") != "S256" || params.Get("nonce") == "" || params.Get("state") == "" {
+		t.Fatalf("expected state, nonce and a PKCE challenge, got %s", location)
+	}
+	return params
+}
+
+func (f *oidcFixture) callback(t *testing.T, params url.Values) *http.Response {
+	resp, err := f.browser.Get(f.app.URL + "/auth/oidc/callback?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// sessionValues returns the values of the browser's session cookie
+func (f *oidcFixture) sessionValues(t *testing.T) map[interface{}]interface{} {
+	appURL, _ := url.Parse(f.app.URL)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range f.browser.Jar.Cookies(appURL) {
+		r.AddCookie(c)
+	}
+	sess, err := f.s.store.Get(r, util.CookieKeySessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess.Values
+}
+
+func TestOidcCallback(t *testing.T) {
+	tests := []struct {
+		name        string
+		mfaEnabled  bool
+		requireMfa  bool
+		deactivated bool
+		// claims of the ID token in addition to iss, aud, iat and exp
+		claims func(authorize url.Values) map[string]interface{}
+		// callback returns the query of the redirect back from the provider
+		callback     func(f *oidcFixture, authorize url.Values, claims map[string]interface{}) url.Values
+		wantStatus   int
+		wantLocation string
+		// wantUser expects a full session, wantPending a pending one waiting for the second factor
+		wantUser     bool
+		wantPending  bool
+		wantVerified bool
+		// wantSynced expects the groups to be synced, only once the login is complete
+		wantSynced bool
+	}{
+		{
+			name:         "logs in",
+			wantStatus:   http.StatusFound,
+			wantLocation: "/app",
+			wantUser:     true,
+			wantVerified: true,
+			wantSynced:   true,
+		},
+		{
+			name: "unverified email",
+			claims: func(authorize url.Values) map[string]interface{} {
+				return map[string]interface{}{"sub": "jane", "email": "jane@example.com", "email_verified": false, "nonce": authorize.Get("nonce")}
+			},
+			wantStatus:   http.StatusFound,
+			wantLocation: "/app",
+			wantUser:     true,
+			wantVerified: false,
+			wantSynced:   true,
+		},
+		{
+			name:        "deactivated user",
+			deactivated: true,
+			wantStatus:  http.StatusForbidden,
+		},
+		{
+			name: "state mismatch",
+			callback: func(f *oidcFixture, authorize url.Values, claims map[string]interface{}) url.Values {
+				code := f.provider.authorize(authorize.Get("code_challenge"), claims)
+				return url.Values{"state": {"forged"}, "code": {code}}
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "nonce mismatch",
+			claims: func(authorize url.Values) map[string]interface{} {
+				return map[string]interface{}{"sub": "jane", "email": "jane@example.com", "email_verified": true, "nonce": "replayed"}
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "PKCE mismatch",
+			callback: func(f *oidcFixture, authorize url.Values, claims map[string]interface{}) url.Values {
+				// a code stolen from another flow was issued for that flow's challenge
+				code := f.provider.authorize(pkceChallenge("another verifier"), claims)
+				return url.Values{"state": {authorize.Get("state")}, "code": {code}}
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "provider error",
+			callback: func(f *oidcFixture, authorize url.Values, claims map[string]interface{}) url.Values {
+				return url.Values{"state": {authorize.Get("state")}, "error": {"access_denied"}}
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:         "user with mfa",
+			mfaEnabled:   true,
+			wantStatus:   http.StatusFound,
+			wantLocation: "/app?mfa=" + ErrCodeMfaRequired,
+			wantPending:  true,
+			wantVerified: true,
+		},
+		{
+			name:         "account requires mfa",
+			requireMfa:   true,
+			wantStatus:   http.StatusFound,
+			wantLocation: "/app?mfa=" + ErrCodeMfaEnrollmentRequired,
+			wantPending:  true,
+			wantVerified: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newOidcFixture(t, tt.mfaEnabled, tt.requireMfa)
+			f.memberships.deactivated = tt.deactivated
+			authorize := f.login(t)
+
+			claims := map[string]interface{}{"sub": "jane", "email": "jane@example.com", "email_verified": true, "groups": []string{"admins"}, "nonce": authorize.Get("nonce")}
+			if tt.claims != nil {
+				claims = tt.claims(authorize)
+			}
+			var params url.Values
+			if tt.callback != nil {
+				params = tt.callback(f, authorize, claims)
+			} else {
+				code := f.provider.authorize(authorize.Get("code_challenge"), claims)
+				params = url.Values{"state": {authorize.Get("state")}, "code": {code}}
+			}
+
+			resp := f.callback(t, params)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if location := resp.Header.Get("Location"); location != tt.wantLocation {
+				t.Errorf("got location %q, want %q", location, tt.wantLocation)
+			}
+
+			values := f.sessionValues(t)
+			_, loggedIn := values[util.SessionKeyUserID]
+			_, pending := values[util.SessionKeyPendingUserID]
+			if loggedIn != tt.wantUser || len(f.registry.created) > 0 != tt.wantUser {
+				t.Errorf("got logged in %v with %d registered sessions, want %v", loggedIn, len(f.registry.created), tt.wantUser)
+			}
+			if pending != tt.wantPending {
+				t.Errorf("got pending %v, want %v", pending, tt.wantPending)
+			}
+			if f.syncer.synced != tt.wantSynced {
+				t.Errorf("got groups synced %v, want %v", f.syncer.synced, tt.wantSynced)
+			}
+			if tt.wantPending && !reflect.DeepEqual(values[util.SessionKeyPendingGroups], []string{"admins"}) {
+				t.Errorf("got pending groups %v, want them kept for the second factor", values[util.SessionKeyPendingGroups])
+			}
+			if !tt.wantUser && !tt.wantPending {
+				if f.provisioner.got != nil && !tt.deactivated {
+					t.Error("expected no user to be provisioned")
+				}
+				return
+			}
+			if f.provisioner.got.Verified != tt.wantVerified {
+				t.Errorf("got verified %v, want %v", f.provisioner.got.Verified, tt.wantVerified)
+			}
+			if f.provisioner.got.Provider != f.provider.server.URL || f.provisioner.got.Subject != "jane" {
+				t.Errorf("unexpected external user %+v", f.provisioner.got)
+			}
+		})
+	}
+}
+
+func TestOidcCallbackSingleUse(t *testing.T) {
+	f := newOidcFixture(t, false, false)
+	authorize := f.login(t)
+	claims := map[string]interface{}{"sub": "jane", "email": "jane@example.com", "email_verified": true, "nonce": authorize.Get("nonce")}
+	code := f.provider.authorize(authorize.Get("code_challenge"), claims)
+	params := url.Values{"state": {authorize.Get("state")}, "code": {code}}
+
+	resp := f.callback(t, params)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	if !f.syncer.synced || len(f.syncer.groups) != 0 {
+		t.Errorf("expected the groups to be synced as none without a groups claim, got %v", f.syncer.groups)
+	}
+	// the flow cookie was deleted, a replayed callback has no state to match
+	resp = f.callback(t, params)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got status %d for a replay, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+// the groups of a login waiting for its second factor are synced by the MFA handlers once the code is verified
+func TestSyncPendingGroups(t *testing.T) {
+	tests := []struct {
+		name       string
+		groups     []string
+		wantSynced bool
+	}{
+		{name: "groups", groups: []string{"admins"}, wantSynced: true},
+		{name: "no groups at the identity provider", groups: []string{}, wantSynced: true},
+		{name: "password login", groups: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &model.User{ID: 7, Username: "jane@example.com", Account: &model.Account{ID: 3, Name: "acme"}}
+			syncer := &fakeSyncer{}
+			s := &serverCmd{
+				logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+				store:       sessions.NewCookieStore(securecookie.GenerateRandomKey(32)),
+				groupSyncer: syncer,
+			}
+			e := echo.New()
+			e.Use(session.Middleware(s.store))
+			e.POST("/login", func(c echo.Context) error {
+				return s.startPendingSession(c, user, tt.groups)
+			})
+			e.POST("/verify", func(c echo.Context) error {
+				return s.syncPendingGroups(c, user)
+			})
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/login", nil))
+			if syncer.synced {
+				t.Fatal("expected no sync before the second factor")
+			}
+			req := httptest.NewRequest(http.MethodPost, "/verify", nil)
+			for _, c := range rec.Result().Cookies() {
+				req.AddCookie(c)
+			}
+			e.ServeHTTP(httptest.NewRecorder(), req)
+
+			if syncer.synced != tt.wantSynced {
+				t.Fatalf("got synced %v, want %v", syncer.synced, tt.wantSynced)
+			}
+			if tt.wantSynced && (!reflect.DeepEqual(syncer.groups, tt.groups) || syncer.account != user.Account) {
+				t.Errorf("got groups %v in %v, want %v in the home account", syncer.groups, syncer.account, tt.groups)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/policy"
+)
+
+type policyCmd struct {
+	Import   policyImportCmd   `cmd:"" help:"Import a casbin policy file as a new policy version."`
+	Versions policyVersionsCmd `cmd:"" help:"List policy versions."`
+	Rollback policyRollbackCmd `cmd:"" help:"Restore an earlier policy version."`
+}
+
+type policyImportCmd struct {
+	dbFlags `embed:""`
+	File    string `arg:"" help:"casbin policy file in csv format" type:"existingfile"`
+	Author  string `help:"author recorded with the new version" env:"USER" default:"unknown"`
+	Comment string `help:"comment recorded with the new version" default:""`
+}
+
+func (c *policyImportCmd) Run(cmdCtx *cmdContext) error {
+	db, err := c.openDb()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(c.File)
+	if err != nil {
+		return errors.Wrap(err, "failed to open policy file")
+	}
+	defer f.Close()
+	rules, err := policy.ParseCSV(f)
+	if err != nil {
+		return err
+	}
+
+	comment := c.Comment
+	if comment == "" {
+		comment = fmt.Sprintf("imported from %s", c.File)
+	}
+	version, err := policy.NewDbManager(db, cmdCtx.Logger).Apply(rules, c.Author, comment)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d rules as version %d\n", len(rules), version.Version)
+	return nil
+}
+
+type policyVersionsCmd struct {
+	dbFlags `embed:""`
+}
+
+func (c *policyVersionsCmd) Run(cmdCtx *cmdContext) error {
+	db, err := c.openDb()
+	if err != nil {
+		return err
+	}
+	versions, err := policy.NewDbManager(db, cmdCtx.Logger).Versions()
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		fmt.Printf("%d\t%s\t%s\t%s\n", v.Version, v.CreatedAt.Format("2006-01-02 15:04:05"), v.Author, v.Comment)
+	}
+	return nil
+}
+
+type policyRollbackCmd struct {
+	dbFlags `embed:""`
+	Version int    `arg:"" help:"version to restore"`
+	Author  string `help:"author recorded with the new version" env:"USER" default:"unknown"`
+	Comment string `help:"comment recorded with the new version" default:""`
+}
+
+func (c *policyRollbackCmd) Run(cmdCtx *cmdContext) error {
+	db, err := c.openDb()
+	if err != nil {
+		return err
+	}
+	version, err := policy.NewDbManager(db, cmdCtx.Logger).Rollback(c.Version, c.Author, c.Comment)
+	if err != nil {
+		return err
+	}
+	// running servers pick up the change on their next policy reload
+	fmt.Printf("restored version %d as version %d\n", c.Version, version.Version)
+	return nil
+}
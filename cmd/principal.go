@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/accesstoken"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/serviceaccount"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+// PrincipalAuth resolves the service account, access token or session of the request into a principal and stores it in the request context,
+// unauthenticated requests are rejected. It must run after BearerAuth.
+func (s *serverCmd) PrincipalAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		principal, err := s.loadPrincipal(c)
+		if err != nil {
+			return err
+		}
+		if principal == nil {
+			return newAPIError(http.StatusUnauthorized, ErrCodeNotLoggedIn, "not logged in")
+		}
+		if principal.Account != nil {
+			principal.Roles = s.authorizationService.Roles(principal.User.Username, principal.Account.Ulid)
+		}
+		c.SetRequest(c.Request().WithContext(util.ContextWithPrincipal(c.Request().Context(), principal)))
+		return next(c)
+	}
+}
+
+// loadPrincipal returns nil for unauthenticated requests, errors are safe to return to the client
+func (s *serverCmd) loadPrincipal(c echo.Context) (*util.Principal, error) {
+	// service accounts act in the account they belong to
+	if sa, ok := c.Get(util.EchoKeyServiceAccount).(*serviceaccount.ServiceAccount); ok {
+		account, err := s.loadAccount("id = ?", sa.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		return &util.Principal{
+			Type:         util.PrincipalTypeServiceAccount,
+			User:         &model.User{Ulid: sa.Ulid, Username: sa.Subject(), AccountID: sa.AccountID},
+			Account:      account,
+			CredentialID: sa.Ulid,
+		}, nil
+	}
+
+	// tokens act in the owner's account
+	if token, ok := c.Get(util.EchoKeyAccessToken).(*accesstoken.Token); ok {
+		user, err := s.loadActiveUser(token.UserID)
+		if err != nil {
+			return nil, err
+		}
+		principal := &util.Principal{
+			Type:         util.PrincipalTypeAccessToken,
+			User:         user,
+			Scope:        token,
+			CredentialID: token.Ulid,
+		}
+		principal.Account, err = s.loadMemberAccount(user, "id = ?", user.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		return principal, nil
+	}
+
+	sess, err := session.Get(util.CookieKeySessionName, c)
+	if err != nil {
+		s.logger.Error("failed to get session", "err", err)
+		return nil, newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "failed to get session")
+	}
+	userID, loggedIn := sess.Values[util.SessionKeyUserID].(uint)
+	if !loggedIn {
+		return nil, nil
+	}
+	user, err := s.loadActiveUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	sessionID, _ := sess.Values[util.SessionKeySessionID].(string)
+	principal := &util.Principal{
+		Type:         util.PrincipalTypeSession,
+		User:         user,
+		CredentialID: sessionID,
+	}
+
+	principal.Account, err = s.loadMemberAccount(user, "ulid = ?", sess.Values[util.SessionKeyAccountID])
+	if err != nil {
+		return nil, err
+	}
+
+	if impersonatorID, impersonating := util.ImpersonatorID(sess); impersonating {
+		principal.Impersonator, err = s.loadUser(impersonatorID)
+		if err != nil {
+			return nil, err
+		}
+		principal.ImpersonationUntil = util.ImpersonationUntil(sess)
+	}
+
+	return principal, nil
+}
+
+// loadUser returns the user with their home account, which the schema exposes as User.account
+func (s *serverCmd) loadUser(userID uint) (*model.User, error) {
+	user := &model.User{}
+	err := s.db.Preload("Account").Where("id = ?", userID).First(user).Error
+	if err != nil {
+		s.logger.Error("failed to get user", "err", err)
+		return nil, newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	return user, nil
+}
+
+// loadActiveUser refuses users deactivated by the directories of all their accounts, their sessions and tokens stop working
+func (s *serverCmd) loadActiveUser(userID uint) (*model.User, error) {
+	user, err := s.loadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	active, err := s.memberships.HasActive(user.ID)
+	if err != nil {
+		s.logger.Error("failed to check memberships", "err", err)
+		return nil, newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	if !active {
+		s.logger.Debug("user is deactivated", "username", user.Username)
+		return nil, newAPIError(http.StatusUnauthorized, ErrCodeUserDeactivated, "the user is deactivated")
+	}
+	return user, nil
+}
+
+// loadMemberAccount returns the account the user acts in, or nil if they were removed from it or its directory deactivated them
+func (s *serverCmd) loadMemberAccount(user *model.User, query string, value interface{}) (*model.Account, error) {
+	account, err := s.loadAccount(query, value)
+	if err != nil {
+		return nil, err
+	}
+	isMember, err := s.memberships.IsMember(user.ID, account.ID)
+	if err != nil {
+		s.logger.Error("failed to check membership", "err", err)
+		return nil, newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	if !isMember {
+		s.logger.Debug("not a member of the account", "username", user.Username, "account", account.Name)
+		return nil, nil
+	}
+	return account, nil
+}
+
+func (s *serverCmd) loadAccount(query string, value interface{}) (*model.Account, error) {
+	account := &model.Account{}
+	err := s.db.Where(query, value).First(account).Error
+	if err != nil {
+		s.logger.Error("failed to get account", "err", err)
+		return nil, newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+	return account, nil
+}
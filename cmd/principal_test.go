@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	graphqlhandler "github.com/99designs/gqlgen/graphql/handler"
+	"github.com/casbin/casbin/v2"
+	stringadapter "github.com/casbin/casbin/v2/persist/string-adapter"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/middleware"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/audit"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/authorization"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/membership"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+func TestImpersonationAccounts(t *testing.T) {
+	tests := []struct {
+		name string
+		// impersonating starts the request in a session in which root already impersonates jane
+		impersonating bool
+		query         string
+		// field is the name of the result under data
+		field string
+	}{
+		{
+			name:          "impersonation query",
+			impersonating: true,
+			query:         "{ impersonation { user { account { ulid } } impersonator { account { ulid } } } }",
+			field:         "impersonation",
+		},
+		{
+			name:  "start impersonation",
+			query: `mutation { startImpersonation(username: \"jane@example.com\") { user { account { ulid } } impersonator { account { ulid } } } }`,
+			field: "startImpersonation",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Open(t)
+			acme := dbtest.Account(t, db, "acme")
+			platform := dbtest.Account(t, db, "platform")
+			jane := dbtest.User(t, db, acme, "jane@example.com")
+			root := dbtest.User(t, db, platform, "root@example.com")
+
+			enforcer, err := casbin.NewSyncedEnforcer("../rbac_with_domains_model.conf", stringadapter.NewAdapter("g2, root@example.com, "+authorization.PlatformAdminRole))
+			if err != nil {
+				t.Fatal(err)
+			}
+			auditor := audit.NewDbAuditor(db, dbtest.Logger())
+			s := &serverCmd{
+				db:                   db,
+				logger:               dbtest.Logger(),
+				store:                sessions.NewCookieStore(securecookie.GenerateRandomKey(32)),
+				memberships:          membership.NewDbService(db, dbtest.Logger()),
+				authorizationService: authorization.NewCasbinAuthorizationService(enforcer, auditor),
+			}
+			resolver := graph.NewResolver(db, s.logger, util.NewUlidManager(), s.authorizationService, auditor, nil, nil, nil, nil, nil, nil, s.memberships, nil, nil, nil, nil, nil, nil, time.Hour)
+			e := echo.New()
+			e.Use(session.Middleware(s.store), middleware.AddEchoContext)
+			e.POST("/query", echo.WrapHandler(graphqlhandler.NewDefaultServer(graph.NewExecutableSchema(graph.Config{Resolvers: resolver}))), s.PrincipalAuth)
+
+			rec := httptest.NewRecorder()
+			sess, _ := s.store.Get(httptest.NewRequest(http.MethodGet, "/", nil), util.CookieKeySessionName)
+			sess.Values[util.SessionKeyUserID] = root.ID
+			sess.Values[util.SessionKeyAccountID] = platform.Ulid
+			if tt.impersonating {
+				util.StartImpersonation(sess, jane.ID, acme.Ulid, time.Now().Add(time.Hour))
+			}
+			err = sess.Save(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(`{"query": "`+tt.query+`"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			for _, c := range rec.Result().Cookies() {
+				req.AddCookie(c)
+			}
+			rec = httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			type account struct {
+				Account struct{ Ulid string }
+			}
+			got := struct {
+				Data   map[string]struct{ User, Impersonator account }
+				Errors []interface{}
+			}{}
+			err = json.Unmarshal(rec.Body.Bytes(), &got)
+			if err != nil || len(got.Errors) > 0 {
+				t.Fatalf("got %d %s", rec.Code, rec.Body)
+			}
+			if got.Data[tt.field].User.Account.Ulid != acme.Ulid {
+				t.Errorf("got %s, want jane's account %s", rec.Body, acme.Ulid)
+			}
+			if got.Data[tt.field].Impersonator.Account.Ulid != platform.Ulid {
+				t.Errorf("got %s, want root's account %s as the impersonator's", rec.Body, platform.Ulid)
+			}
+		})
+	}
+}
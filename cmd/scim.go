@@ -0,0 +1,768 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/audit"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/scim"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+const scimContentType = "application/scim+json"
+
+const (
+	scimSchemaUser                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaGroup                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimSchemaListResponse          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaError                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSchemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+)
+
+// scimType of error responses, RFC 7644 section 3.12
+const (
+	scimErrInvalidFilter = "invalidFilter"
+	scimErrInvalidSyntax = "invalidSyntax"
+	scimErrInvalidValue  = "invalidValue"
+	scimErrInvalidPath   = "invalidPath"
+	scimErrUniqueness    = "uniqueness"
+	scimErrMutability    = "mutability"
+)
+
+const (
+	scimDefaultCount = 100
+	scimMaxCount     = 1000
+)
+
+// Resources and actions of SCIM changes in the audit log
+const (
+	scimAuditResourceUser  = "user"
+	scimAuditResourceGroup = "group"
+
+	scimAuditActionCreate     = "scim.create"
+	scimAuditActionUpdate     = "scim.update"
+	scimAuditActionDeactivate = "scim.deactivate"
+	scimAuditActionDelete     = "scim.delete"
+)
+
+// scimFilter matches the only filters directories need to find existing resources, e.g. userName eq "jane@example.com"
+var scimFilter = regexp.MustCompile(`^\s*(\w+)\s+(?i:eq)\s+"((?:[^"\\]|\\.)*)"\s*$`)
+
+// scimMemberFilter matches the path which removes a single member, e.g. members[value eq "01H..."]
+var scimMemberFilter = regexp.MustCompile(`^(?i:members)\[\s*(?i:value)\s+(?i:eq)\s+"([^"]*)"\s*\]$`)
+
+// scimError is the body of SCIM error responses, echo's error handler serializes it as JSON
+type scimError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+func newScimError(status int, scimType string, detail string) *echo.HTTPError {
+	return echo.NewHTTPError(status, scimError{
+		Schemas:  []string{scimSchemaError},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+}
+
+type scimRef struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type scimUser struct {
+	Schemas    []string  `json:"schemas"`
+	ID         string    `json:"id,omitempty"`
+	ExternalID string    `json:"externalId,omitempty"`
+	UserName   string    `json:"userName"`
+	Active     *bool     `json:"active,omitempty"`
+	Groups     []scimRef `json:"groups,omitempty"`
+	Meta       *scimMeta `json:"meta,omitempty"`
+}
+
+type scimGroup struct {
+	Schemas     []string  `json:"schemas"`
+	ID          string    `json:"id,omitempty"`
+	ExternalID  string    `json:"externalId,omitempty"`
+	DisplayName string    `json:"displayName"`
+	Members     []scimRef `json:"members"`
+	Meta        *scimMeta `json:"meta,omitempty"`
+}
+
+type scimListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int64         `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+type scimPatchRequest struct {
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+type scimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// ScimAuth authenticates a directory with its SCIM token, the token determines the account which is provisioned
+func (s *serverCmd) ScimAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// also for errors, echo only sets the content type if it's missing
+		c.Response().Header().Set(echo.HeaderContentType, scimContentType)
+
+		plaintext, found := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if !found || !strings.HasPrefix(plaintext, scim.TokenPrefix) {
+			return newScimError(http.StatusUnauthorized, "", "expected a SCIM bearer token")
+		}
+		token, err := s.scimService.Authenticate(plaintext)
+		if errors.Is(err, scim.ErrInvalidToken) {
+			s.logger.Debug("invalid scim token", "ip", c.RealIP())
+			return newScimError(http.StatusUnauthorized, "", "invalid or revoked token")
+		}
+		if err != nil {
+			s.logger.Error("failed to authenticate scim token", "err", err)
+			return newScimError(http.StatusInternalServerError, "", "internal error")
+		}
+		account := &model.Account{}
+		err = s.db.Where("id = ?", token.AccountID).First(account).Error
+		if err != nil {
+			s.logger.Error("failed to get account", "err", err)
+			return newScimError(http.StatusInternalServerError, "", "internal error")
+		}
+
+		c.Set(util.EchoKeyScimToken, token)
+		c.Set(util.EchoKeyScimAccount, account)
+		return next(c)
+	}
+}
+
+func scimAccount(c echo.Context) *model.Account {
+	return c.Get(util.EchoKeyScimAccount).(*model.Account)
+}
+
+func (s *serverCmd) ScimServiceProviderConfig(c echo.Context) error {
+	supported := func(ok bool) map[string]interface{} {
+		return map[string]interface{}{"supported": ok}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"schemas":        []string{scimSchemaServiceProviderConfig},
+		"patch":          supported(true),
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxCount},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]interface{}{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "A SCIM token created by an account admin",
+		}},
+	})
+}
+
+func (s *serverCmd) ScimListUsers(c echo.Context) error {
+	offset, count, err := scimPage(c)
+	if err != nil {
+		return err
+	}
+	filter := scim.UserFilter{}
+	if f := c.QueryParam("filter"); f != "" {
+		attribute, value, err := parseScimFilter(f)
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(attribute) {
+		case "username":
+			filter.Username = value
+		case "externalid":
+			filter.ExternalID = value
+		default:
+			return newScimError(http.StatusBadRequest, scimErrInvalidFilter, "users can only be filtered by userName or externalId")
+		}
+	}
+
+	users, total, err := s.scimService.ListUsers(scimAccount(c), filter, offset, count)
+	if err != nil {
+		s.logger.Error("failed to list scim users", "err", err)
+		return newScimError(http.StatusInternalServerError, "", "internal error")
+	}
+	resources := []interface{}{}
+	for _, u := range users {
+		resources = append(resources, toScimUser(c, u))
+	}
+	return c.JSON(http.StatusOK, newScimListResponse(total, offset, resources))
+}
+
+func (s *serverCmd) ScimGetUser(c echo.Context) error {
+	u, err := s.getScimUser(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, toScimUser(c, u))
+}
+
+func (s *serverCmd) ScimCreateUser(c echo.Context) error {
+	input := &scimUser{}
+	err := bindScim(c, input)
+	if err != nil {
+		return err
+	}
+	attrs := &scim.UserAttributes{Username: input.UserName, ExternalID: input.ExternalID, Active: input.Active == nil || *input.Active}
+	if attrs.Username == "" {
+		return newScimError(http.StatusBadRequest, scimErrInvalidValue, "userName is required")
+	}
+
+	u, err := s.scimService.CreateUser(scimAccount(c), attrs)
+	if err != nil {
+		return s.scimServiceError(err, "failed to create scim user")
+	}
+	err = s.auditScim(c, scimAuditResourceUser, scimAuditActionCreate)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderLocation, scimLocation(c, "Users", u.User.Ulid))
+	return c.JSON(http.StatusCreated, toScimUser(c, u))
+}
+
+func (s *serverCmd) ScimReplaceUser(c echo.Context) error {
+	u, err := s.getScimUser(c)
+	if err != nil {
+		return err
+	}
+	input := &scimUser{}
+	err = bindScim(c, input)
+	if err != nil {
+		return err
+	}
+	attrs := &scim.UserAttributes{Username: input.UserName, ExternalID: input.ExternalID, Active: input.Active == nil || *input.Active}
+	if attrs.Username == "" {
+		return newScimError(http.StatusBadRequest, scimErrInvalidValue, "userName is required")
+	}
+	err = s.updateScimUser(c, u, attrs)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, toScimUser(c, u))
+}
+
+func (s *serverCmd) ScimPatchUser(c echo.Context) error {
+	u, err := s.getScimUser(c)
+	if err != nil {
+		return err
+	}
+	input := &scimPatchRequest{}
+	err = bindScim(c, input)
+	if err != nil {
+		return err
+	}
+
+	attrs := &scim.UserAttributes{Username: u.User.Username, ExternalID: u.ExternalID, Active: u.Active()}
+	for _, op := range input.Operations {
+		err = applyScimUserPatch(attrs, op)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.updateScimUser(c, u, attrs)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, toScimUser(c, u))
+}
+
+// ScimDeleteUser deactivates the user, the user and their data are kept
+func (s *serverCmd) ScimDeleteUser(c echo.Context) error {
+	u, err := s.getScimUser(c)
+	if err != nil {
+		return err
+	}
+	attrs := &scim.UserAttributes{Username: u.User.Username, ExternalID: u.ExternalID, Active: false}
+	err = s.updateScimUser(c, u, attrs)
+	if err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *serverCmd) getScimUser(c echo.Context) (*scim.User, error) {
+	u, err := s.scimService.GetUser(scimAccount(c), c.Param("id"))
+	if err != nil {
+		return nil, s.scimServiceError(err, "failed to get scim user")
+	}
+	return u, nil
+}
+
+// updateScimUser writes the attributes and signs out a user who is deactivated in all their accounts,
+// the sessions of a user who keeps other accounts lose access to this one at their next request
+func (s *serverCmd) updateScimUser(c echo.Context, u *scim.User, attrs *scim.UserAttributes) error {
+	wasActive := u.Active()
+	err := s.scimService.UpdateUser(scimAccount(c), u, attrs)
+	if err != nil {
+		return s.scimServiceError(err, "failed to update scim user")
+	}
+
+	action := scimAuditActionUpdate
+	if wasActive && !attrs.Active {
+		action = scimAuditActionDeactivate
+		active, err := s.memberships.HasActive(u.User.ID)
+		if err != nil {
+			s.logger.Error("failed to check memberships", "err", err)
+			return newScimError(http.StatusInternalServerError, "", "internal error")
+		}
+		if !active {
+			err = s.sessionRegistry.RevokeAllForUser(u.User.ID)
+			if err != nil {
+				s.logger.Error("failed to revoke sessions", "err", err)
+				return newScimError(http.StatusInternalServerError, "", "internal error")
+			}
+		}
+	}
+	return s.auditScim(c, scimAuditResourceUser, action)
+}
+
+func applyScimUserPatch(attrs *scim.UserAttributes, op scimPatchOperation) error {
+	switch strings.ToLower(op.Op) {
+	case "add", "replace":
+	case "remove":
+		if strings.EqualFold(op.Path, "externalId") {
+			attrs.ExternalID = ""
+			return nil
+		}
+		return newScimError(http.StatusBadRequest, scimErrInvalidPath, "only externalId can be removed")
+	default:
+		return newScimError(http.StatusBadRequest, scimErrInvalidSyntax, "unknown operation "+op.Op)
+	}
+
+	// without a path the value holds the attributes
+	values := map[string]json.RawMessage{}
+	if op.Path == "" {
+		err := json.Unmarshal(op.Value, &values)
+		if err != nil {
+			return newScimError(http.StatusBadRequest, scimErrInvalidSyntax, "expected an object value")
+		}
+	} else {
+		values[op.Path] = op.Value
+	}
+
+	for path, value := range values {
+		switch strings.ToLower(path) {
+		case "username":
+			err := json.Unmarshal(value, &attrs.Username)
+			if err != nil || attrs.Username == "" {
+				return newScimError(http.StatusBadRequest, scimErrInvalidValue, "userName must be a non-empty string")
+			}
+		case "externalid":
+			err := json.Unmarshal(value, &attrs.ExternalID)
+			if err != nil {
+				return newScimError(http.StatusBadRequest, scimErrInvalidValue, "externalId must be a string")
+			}
+		case "active":
+			active, err := parseScimBool(value)
+			if err != nil {
+				return err
+			}
+			attrs.Active = active
+		default:
+			// names, emails etc. aren't stored
+		}
+	}
+	return nil
+}
+
+// parseScimBool accepts booleans and, as sent by some directories, the strings "true" and "false"
+func parseScimBool(value json.RawMessage) (bool, error) {
+	var b bool
+	err := json.Unmarshal(value, &b)
+	if err == nil {
+		return b, nil
+	}
+	var str string
+	err = json.Unmarshal(value, &str)
+	if err == nil {
+		b, err = strconv.ParseBool(str)
+		if err == nil {
+			return b, nil
+		}
+	}
+	return false, newScimError(http.StatusBadRequest, scimErrInvalidValue, "expected a boolean")
+}
+
+func (s *serverCmd) ScimListGroups(c echo.Context) error {
+	offset, count, err := scimPage(c)
+	if err != nil {
+		return err
+	}
+	filter := scim.GroupFilter{}
+	if f := c.QueryParam("filter"); f != "" {
+		attribute, value, err := parseScimFilter(f)
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(attribute) {
+		case "displayname":
+			filter.DisplayName = value
+		case "externalid":
+			filter.ExternalID = value
+		default:
+			return newScimError(http.StatusBadRequest, scimErrInvalidFilter, "groups can only be filtered by displayName or externalId")
+		}
+	}
+
+	groups, total, err := s.scimService.ListGroups(scimAccount(c), filter, offset, count)
+	if err != nil {
+		s.logger.Error("failed to list scim groups", "err", err)
+		return newScimError(http.StatusInternalServerError, "", "internal error")
+	}
+	resources := []interface{}{}
+	for _, g := range groups {
+		resources = append(resources, toScimGroup(c, g))
+	}
+	return c.JSON(http.StatusOK, newScimListResponse(total, offset, resources))
+}
+
+func (s *serverCmd) ScimGetGroup(c echo.Context) error {
+	g, err := s.getScimGroup(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, toScimGroup(c, g))
+}
+
+func (s *serverCmd) ScimCreateGroup(c echo.Context) error {
+	input := &scimGroup{}
+	err := bindScim(c, input)
+	if err != nil {
+		return err
+	}
+	if input.DisplayName == "" {
+		return newScimError(http.StatusBadRequest, scimErrInvalidValue, "displayName is required")
+	}
+	attrs := &scim.GroupAttributes{DisplayName: input.DisplayName, ExternalID: input.ExternalID, Members: refValues(input.Members)}
+
+	g, err := s.scimService.CreateGroup(scimAccount(c), attrs)
+	if err != nil {
+		return s.scimServiceError(err, "failed to create scim group")
+	}
+	err = s.auditScim(c, scimAuditResourceGroup, scimAuditActionCreate)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderLocation, scimLocation(c, "Groups", g.Ulid))
+	return c.JSON(http.StatusCreated, toScimGroup(c, g))
+}
+
+func (s *serverCmd) ScimReplaceGroup(c echo.Context) error {
+	g, err := s.getScimGroup(c)
+	if err != nil {
+		return err
+	}
+	input := &scimGroup{}
+	err = bindScim(c, input)
+	if err != nil {
+		return err
+	}
+	if input.DisplayName == "" {
+		return newScimError(http.StatusBadRequest, scimErrInvalidValue, "displayName is required")
+	}
+	attrs := &scim.GroupAttributes{DisplayName: input.DisplayName, ExternalID: input.ExternalID, Members: refValues(input.Members)}
+	return s.updateScimGroup(c, g, attrs)
+}
+
+func (s *serverCmd) ScimPatchGroup(c echo.Context) error {
+	g, err := s.getScimGroup(c)
+	if err != nil {
+		return err
+	}
+	input := &scimPatchRequest{}
+	err = bindScim(c, input)
+	if err != nil {
+		return err
+	}
+
+	members := []string{}
+	for _, m := range g.Members {
+		members = append(members, m.Ulid)
+	}
+	attrs := &scim.GroupAttributes{DisplayName: g.DisplayName, ExternalID: g.ExternalID, Members: members}
+	for _, op := range input.Operations {
+		err = applyScimGroupPatch(attrs, op)
+		if err != nil {
+			return err
+		}
+	}
+	return s.updateScimGroup(c, g, attrs)
+}
+
+func (s *serverCmd) ScimDeleteGroup(c echo.Context) error {
+	g, err := s.getScimGroup(c)
+	if err != nil {
+		return err
+	}
+	err = s.scimService.DeleteGroup(scimAccount(c), g)
+	if err != nil {
+		return s.scimServiceError(err, "failed to delete scim group")
+	}
+	err = s.auditScim(c, scimAuditResourceGroup, scimAuditActionDelete)
+	if err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *serverCmd) getScimGroup(c echo.Context) (*scim.Group, error) {
+	g, err := s.scimService.GetGroup(scimAccount(c), c.Param("id"))
+	if err != nil {
+		return nil, s.scimServiceError(err, "failed to get scim group")
+	}
+	return g, nil
+}
+
+func (s *serverCmd) updateScimGroup(c echo.Context, g *scim.Group, attrs *scim.GroupAttributes) error {
+	err := s.scimService.UpdateGroup(scimAccount(c), g, attrs)
+	if err != nil {
+		return s.scimServiceError(err, "failed to update scim group")
+	}
+	err = s.auditScim(c, scimAuditResourceGroup, scimAuditActionUpdate)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, toScimGroup(c, g))
+}
+
+func applyScimGroupPatch(attrs *scim.GroupAttributes, op scimPatchOperation) error {
+	operation := strings.ToLower(op.Op)
+
+	// a single member, e.g. members[value eq "01H..."]
+	if m := scimMemberFilter.FindStringSubmatch(op.Path); m != nil {
+		if operation != "remove" {
+			return newScimError(http.StatusBadRequest, scimErrInvalidPath, "a member filter can only be removed")
+		}
+		attrs.Members = withoutMembers(attrs.Members, []string{m[1]})
+		return nil
+	}
+
+	values := map[string]json.RawMessage{}
+	if op.Path == "" {
+		if operation == "remove" {
+			return newScimError(http.StatusBadRequest, scimErrInvalidPath, "remove requires a path")
+		}
+		err := json.Unmarshal(op.Value, &values)
+		if err != nil {
+			return newScimError(http.StatusBadRequest, scimErrInvalidSyntax, "expected an object value")
+		}
+	} else {
+		values[op.Path] = op.Value
+	}
+
+	for path, value := range values {
+		switch strings.ToLower(path) {
+		case "members":
+			refs := []scimRef{}
+			if len(value) > 0 {
+				err := json.Unmarshal(value, &refs)
+				if err != nil {
+					return newScimError(http.StatusBadRequest, scimErrInvalidValue, "members must be a list of references")
+				}
+			}
+			switch operation {
+			case "add":
+				attrs.Members = append(withoutMembers(attrs.Members, refValues(refs)), refValues(refs)...)
+			case "replace":
+				attrs.Members = refValues(refs)
+			case "remove":
+				// without a value all members are removed
+				if len(refs) == 0 {
+					attrs.Members = []string{}
+				} else {
+					attrs.Members = withoutMembers(attrs.Members, refValues(refs))
+				}
+			default:
+				return newScimError(http.StatusBadRequest, scimErrInvalidSyntax, "unknown operation "+op.Op)
+			}
+		case "displayname":
+			if operation == "remove" {
+				return newScimError(http.StatusBadRequest, scimErrInvalidPath, "displayName can't be removed")
+			}
+			err := json.Unmarshal(value, &attrs.DisplayName)
+			if err != nil || attrs.DisplayName == "" {
+				return newScimError(http.StatusBadRequest, scimErrInvalidValue, "displayName must be a non-empty string")
+			}
+		case "externalid":
+			if operation == "remove" {
+				attrs.ExternalID = ""
+				continue
+			}
+			err := json.Unmarshal(value, &attrs.ExternalID)
+			if err != nil {
+				return newScimError(http.StatusBadRequest, scimErrInvalidValue, "externalId must be a string")
+			}
+		default:
+			return newScimError(http.StatusBadRequest, scimErrInvalidPath, "unsupported path "+path)
+		}
+	}
+	return nil
+}
+
+func withoutMembers(members []string, remove []string) []string {
+	removed := map[string]bool{}
+	for _, r := range remove {
+		removed[r] = true
+	}
+	result := []string{}
+	for _, m := range members {
+		if !removed[m] {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+func refValues(refs []scimRef) []string {
+	values := []string{}
+	for _, r := range refs {
+		values = append(values, r.Value)
+	}
+	return values
+}
+
+// scimServiceError maps errors of the SCIM service to SCIM error responses
+func (s *serverCmd) scimServiceError(err error, msg string) error {
+	switch {
+	case errors.Is(err, scim.ErrNotFound):
+		return newScimError(http.StatusNotFound, "", "resource not found")
+	case errors.Is(err, scim.ErrUsernameTaken):
+		return newScimError(http.StatusConflict, scimErrUniqueness, "userName is already taken")
+	case errors.Is(err, scim.ErrExternalIDTaken):
+		return newScimError(http.StatusConflict, scimErrUniqueness, "externalId is already taken")
+	case errors.Is(err, scim.ErrGroupNameTaken):
+		return newScimError(http.StatusConflict, scimErrUniqueness, "displayName is already taken")
+	case errors.Is(err, scim.ErrUnknownMember):
+		return newScimError(http.StatusBadRequest, scimErrInvalidValue, "members must be users of the account")
+	case errors.Is(err, scim.ErrSharedUser):
+		return newScimError(http.StatusBadRequest, scimErrMutability, "userName can't be changed, the user is a member of other accounts or has roles outside the account")
+	}
+	s.logger.Error(msg, "err", err)
+	return newScimError(http.StatusInternalServerError, "", "internal error")
+}
+
+// auditScim records a change made by the directory, changes which could not be audited fail
+func (s *serverCmd) auditScim(c echo.Context, resource string, action string) error {
+	token := c.Get(util.EchoKeyScimToken).(*scim.Token)
+	err := s.auditor.Record(&audit.Event{
+		Actor:     token.Subject(),
+		ActorType: audit.ActorTypeScim,
+		Domain:    scimAccount(c).Ulid,
+		Resource:  resource,
+		Action:    action,
+	})
+	if err != nil {
+		s.logger.Error("failed to record audit event", "err", err)
+		return newScimError(http.StatusInternalServerError, "", "internal error")
+	}
+	return nil
+}
+
+// bindScim decodes a JSON body, echo's binder doesn't accept the SCIM content type
+func bindScim(c echo.Context, v interface{}) error {
+	err := json.NewDecoder(c.Request().Body).Decode(v)
+	if err != nil {
+		return newScimError(http.StatusBadRequest, scimErrInvalidSyntax, "failed to parse request")
+	}
+	return nil
+}
+
+// scimPage returns the offset and count of a list request, startIndex is 1-based
+func scimPage(c echo.Context) (int, int, error) {
+	startIndex, count := 1, scimDefaultCount
+	var err error
+	if v := c.QueryParam("startIndex"); v != "" {
+		startIndex, err = strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, newScimError(http.StatusBadRequest, scimErrInvalidValue, "startIndex must be a number")
+		}
+	}
+	if v := c.QueryParam("count"); v != "" {
+		count, err = strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, newScimError(http.StatusBadRequest, scimErrInvalidValue, "count must be a number")
+		}
+	}
+	return max(startIndex, 1) - 1, min(max(count, 0), scimMaxCount), nil
+}
+
+func parseScimFilter(filter string) (string, string, error) {
+	m := scimFilter.FindStringSubmatch(filter)
+	if m == nil {
+		return "", "", newScimError(http.StatusBadRequest, scimErrInvalidFilter, `only filters like userName eq "value" are supported`)
+	}
+	value, err := strconv.Unquote(`"` + m[2] + `"`)
+	if err != nil {
+		return "", "", newScimError(http.StatusBadRequest, scimErrInvalidFilter, "invalid filter value")
+	}
+	return m[1], value, nil
+}
+
+func newScimListResponse(total int64, offset int, resources []interface{}) *scimListResponse {
+	return &scimListResponse{
+		Schemas:      []string{scimSchemaListResponse},
+		TotalResults: total,
+		StartIndex:   offset + 1,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}
+}
+
+func scimLocation(c echo.Context, resourceType string, id string) string {
+	return c.Scheme() + "://" + c.Request().Host + "/scim/v2/" + resourceType + "/" + id
+}
+
+func toScimUser(c echo.Context, u *scim.User) *scimUser {
+	active := u.Active()
+	groups := []scimRef{}
+	for _, g := range u.Groups {
+		groups = append(groups, scimRef{Value: g.Ulid, Ref: scimLocation(c, "Groups", g.Ulid), Display: g.DisplayName})
+	}
+	return &scimUser{
+		Schemas:    []string{scimSchemaUser},
+		ID:         u.User.Ulid,
+		ExternalID: u.ExternalID,
+		UserName:   u.User.Username,
+		Active:     &active,
+		Groups:     groups,
+		Meta:       &scimMeta{ResourceType: "User", Location: scimLocation(c, "Users", u.User.Ulid)},
+	}
+}
+
+func toScimGroup(c echo.Context, g *scim.Group) *scimGroup {
+	members := []scimRef{}
+	for _, m := range g.Members {
+		members = append(members, scimRef{Value: m.Ulid, Ref: scimLocation(c, "Users", m.Ulid), Display: m.Username})
+	}
+	return &scimGroup{
+		Schemas:     []string{scimSchemaGroup},
+		ID:          g.Ulid,
+		ExternalID:  g.ExternalID,
+		DisplayName: g.DisplayName,
+		Members:     members,
+		Meta:        &scimMeta{ResourceType: "Group", Location: scimLocation(c, "Groups", g.Ulid)},
+	}
+}
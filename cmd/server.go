@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -21,84 +22,297 @@ import (
 	echomiddleware "github.com/labstack/echo/v4/middleware"
 	"github.com/pkg/errors"
 	slogecho "github.com/samber/slog-echo"
-	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/time/rate"
-
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 
-	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
 	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/middleware"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/accesstoken"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/audit"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/authenticator"
 	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/authorization"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/emailtoken"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/groupsync"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/identity"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/invitation"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/loginguard"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/loginhistory"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/mailer"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/membership"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/mfa"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/password"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/policy"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/scim"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/serviceaccount"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/usersession"
 	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
 
 	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
 )
 
 type serverCmd struct {
 	// cli options
-	HttpAddr                 string `help:"address of the http server which the server should listen on" default:":8080"`
-	DbAddr                   string `help:"address of the database server" default:"127.0.0.1:5432"`
-	DbPassword               string `help:"password for the database server" default:"postgres"`
-	SslMode                  string `help:"ssl mode for the database connection" default:"disable"`
-	CookieStoreSigningKey    string `help:"secret key to use for signing cookies" default:"changemechangemechangemechangeme"`
-	CookieStoreEncryptionKey string `help:"secret key to use for encrypting cookies" default:"changemechangemechangemechangeme"`
+	dbFlags                  `embed:""`
+	HttpAddr                 string        `help:"address of the http server which the server should listen on" default:":8080"`
+	TrustedProxies           []string      `help:"CIDRs of reverse proxies whose X-Forwarded-For header is trusted, client IPs are the connection's remote address when empty"`
+	Dev                      bool          `help:"development mode, allows the default secret keys" env:"DEV_MODE"`
+	CookieStoreSigningKey    string        `help:"secret key to use for signing cookies, at least 32 bytes" env:"COOKIE_STORE_SIGNING_KEY" default:"changemechangemechangemechangeme"`
+	CookieStoreEncryptionKey string        `help:"secret key to use for encrypting cookies, 16, 24 or 32 bytes" env:"COOKIE_STORE_ENCRYPTION_KEY" default:"changemechangemechangemechangeme"`
+	CookieStoreKeys          []string      `help:"cookie key pairs as signing:encryption, newest first, the newest signs and all verify, replaces the single keys when set" env:"COOKIE_STORE_KEYS"`
+	CookieStoreKeysFile      string        `help:"file with one signing:encryption cookie key pair per line, newest first, replaces the other cookie key options when set" env:"COOKIE_STORE_KEYS_FILE"`
+	CookieSecure             bool          `help:"only send cookies over HTTPS, disable for development over plain HTTP" default:"true" negatable:""`
+	SessionStore             string        `help:"where session values are stored: cookie (client-side) or db (postgres)" enum:"cookie,db" default:"cookie"`
+	SessionCleanupInterval   time.Duration `help:"how often expired sessions are deleted from the db session store" default:"10m"`
+	LoginMaxFailuresPerUser  int           `help:"failed logins after which a username is locked out" default:"10"`
+	LoginMaxFailuresPerIP    int           `help:"failed logins after which a client IP is locked out" default:"100"`
+	LoginLockoutDuration     time.Duration `help:"how long a login lockout lasts" default:"15m"`
+	LoginBackoffBase         time.Duration `help:"delay after the first failed login, doubled with every further failure" default:"1s"`
+	LoginBackoffMax          time.Duration `help:"maximum delay between failed logins" default:"1m"`
+	LoginBackend             string        `help:"where /auth/login checks passwords: local (password hashes in the database) or ldap (bind as the user, users with a local password keep it, signup is disabled)" enum:"local,ldap" default:"local"`
+	LdapURL                  string        `help:"LDAP server URL, ldap:// or ldaps://" default:"ldap://localhost:389"`
+	LdapStartTLS             bool          `help:"upgrade ldap:// connections with StartTLS"`
+	LdapBindDN               string        `help:"DN used to search users and groups, users are searched anonymously and groups as the user when empty" default:""`
+	LdapBindPassword         string        `help:"password of the LDAP bind DN" env:"LDAP_BIND_PASSWORD" default:""`
+	LdapUserBaseDN           string        `help:"DN under which LDAP users are searched" default:""`
+	LdapUserFilter           string        `help:"filter which finds the LDAP user, {username} is replaced with the login name" default:"(uid={username})"`
+	LdapUsernameAttribute    string        `help:"LDAP attribute used as the username, e.g. sAMAccountName for Active Directory" default:"uid"`
+	LdapGroupBaseDN          string        `help:"DN under which LDAP groups are searched, groups are not synced to roles when empty" default:""`
+	LdapGroupFilter          string        `help:"filter which finds the user's LDAP groups, {dn} and {username} are replaced" default:"(member={dn})"`
+	LdapGroupNameAttribute   string        `help:"LDAP attribute with the group name, mapped to roles per account" default:"cn"`
+	LdapDefaultAccount       string        `help:"ULID of the account new LDAP users join, every new user gets their own account when empty" default:""`
+	LdapTimeout              time.Duration `help:"timeout of LDAP requests" default:"10s"`
+	PasswordHash             string        `help:"algorithm of new password hashes, weaker hashes are upgraded on login: argon2id or bcrypt" enum:"argon2id,bcrypt" default:"argon2id"`
+	Argon2Memory             uint32        `help:"memory in KiB used by argon2id password hashes" default:"65536"`
+	Argon2Time               uint32        `help:"number of passes of argon2id password hashes" default:"3"`
+	Argon2Threads            uint8         `help:"parallelism of argon2id password hashes" default:"2"`
+	BcryptCost               int           `help:"cost of bcrypt password hashes" default:"12"`
+	PasswordMinLength        int           `help:"minimum length of new passwords" default:"10"`
+	PasswordBreachedDir      string        `help:"directory of breached password SHA-1 prefix files (Pwned Passwords range format), the check is disabled when empty" default:""`
+	ImpersonationTTL         time.Duration `help:"how long a platform admin can impersonate a user before the session reverts to the admin" default:"1h"`
+	MfaIssuer                string        `help:"issuer shown in authenticator apps" default:"echo-gqlgen-casbin-rbac-example"`
+	OidcIssuer               string        `help:"OIDC issuer URL, enables OIDC login when set" default:""`
+	OidcClientID             string        `help:"OIDC client ID" default:""`
+	OidcClientSecret         string        `help:"OIDC client secret" env:"OIDC_CLIENT_SECRET" default:""`
+	OidcRedirectURL          string        `help:"OIDC redirect URL, must point to /auth/oidc/callback" default:"http://localhost:8080/auth/oidc/callback"`
+	OidcScopes               []string      `help:"OIDC scopes to request" default:"openid,profile,email"`
+	OidcUsernameClaim        string        `help:"ID token claim used as the username" default:"email"`
+	OidcGroupsClaim          string        `help:"ID token claim with the user's groups, mapped to roles per account" default:"groups"`
+	OidcDefaultAccount       string        `help:"ULID of the account new OIDC users join, every new user gets their own account when empty" default:""`
+	OidcPostLoginURL         string        `help:"where the browser is redirected after an OIDC login, with mfa=<error code> when a second factor is still required" default:"/"`
+	PublicURL                string        `help:"URL of the frontend, used in links sent by email" default:"http://localhost:8080"`
+	EmailTokenSigningKey     string        `help:"secret key to sign email verification and password reset tokens" env:"EMAIL_TOKEN_SIGNING_KEY" default:"changemechangemechangemechangeme"`
+	EmailVerificationTTL     time.Duration `help:"how long an email verification link is valid" default:"48h"`
+	PasswordResetTTL         time.Duration `help:"how long a password reset link is valid" default:"1h"`
+	PasswordResetCooldown    time.Duration `help:"delay between password reset emails to the same address, doubled with every further request" default:"1m"`
+	PasswordResetMaxPerUser  int           `help:"password reset requests per address within the reset link TTL" default:"5"`
+	PasswordResetMaxPerIP    int           `help:"password reset requests per client IP within the reset link TTL" default:"20"`
+	InvitationTTL            time.Duration `help:"how long an invitation to an account is valid" default:"168h"`
+	Mailer                   string        `help:"how emails are delivered: log, file (for local testing) or smtp" enum:"log,file,smtp" default:"log"`
+	MailerFile               string        `help:"file the file mailer appends emails to" default:"mail.txt"`
+	MailFrom                 string        `help:"sender address of emails" default:"noreply@localhost"`
+	SmtpAddr                 string        `help:"address of the smtp server (host:port)" default:"localhost:587"`
+	SmtpUsername             string        `help:"smtp username, no authentication when empty" default:""`
+	SmtpPassword             string        `help:"smtp password" env:"SMTP_PASSWORD" default:""`
+	PolicySeedFile           string        `help:"casbin policy file used as the first policy version when the database has none" default:"rbac_with_domains_policy.csv"`
+	PolicyReloadInterval     time.Duration `help:"how often the policy is reloaded from the database, picks up changes made by other replicas" default:"30s"`
 
 	// Dependencies
 	logger               *slog.Logger
 	db                   *gorm.DB
-	store                *sessions.CookieStore
+	store                sessions.Store
 	ulidManager          *util.UlidManager
+	auditor              audit.Auditor
+	policyManager        *policy.DbManager
+	sessionRegistry      usersession.Registry
+	loginHistory         loginhistory.History
+	loginGuard           loginguard.Guard
+	resetGuard           loginguard.Guard
+	passwordHasher       password.Hasher
+	passwordPolicy       *password.Policy
+	mfaService           mfa.Service
+	identityProvisioner  identity.Provisioner
+	authenticator        authenticator.Authenticator
+	groupSyncer          groupsync.Syncer
+	scimService          scim.Service
+	oidc                 *oidcClient
+	accessTokens         accesstoken.Service
+	serviceAccounts      serviceaccount.Service
+	mailer               mailer.Mailer
+	emailTokenSigner     *emailtoken.Signer
+	invitations          invitation.Service
+	memberships          membership.Service
 	authorizationService authorization.Authorization
 }
 
-func dsn(dbAddr string, dbPassword string, sslMode string) string {
-	return fmt.Sprintf("postgres://postgres:%s@%s/postgres?sslmode=%s", dbPassword, dbAddr, sslMode)
-}
-
 func (s *serverCmd) Run(cmdCtx *cmdContext) error {
 	s.logger = cmdCtx.Logger.With("component", "serverCmd")
 	s.logger.Info(fmt.Sprintf("starting server on %s", s.HttpAddr))
 
 	var err error
 
+	// Secret keys, checked first so that a misconfigured server fails fast
+	keyPairs, err := s.cookieKeyPairs()
+	if err != nil {
+		return err
+	}
+	ipExtractor, err := s.ipExtractor()
+	if err != nil {
+		return err
+	}
+	if !s.Dev && s.EmailTokenSigningKey == defaultSecretKey {
+		return errors.New("the default email token signing key is only allowed in dev mode")
+	}
+
+	// Password hashing, checked before connecting so that invalid parameters fail fast
+	s.passwordHasher, err = password.NewPHCHasher(password.Config{
+		Algorithm:     s.PasswordHash,
+		Argon2Memory:  s.Argon2Memory,
+		Argon2Time:    s.Argon2Time,
+		Argon2Threads: s.Argon2Threads,
+		BcryptCost:    s.BcryptCost,
+	})
+	if err != nil {
+		return err
+	}
+	s.passwordPolicy = &password.Policy{MinLength: s.PasswordMinLength}
+	if s.PasswordBreachedDir != "" {
+		s.passwordPolicy.Breached, err = password.NewPrefixDir(s.PasswordBreachedDir)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Connect to the database
-	psqlDsn := dsn(s.DbAddr, s.DbPassword, s.SslMode)
-	s.db, err = gorm.Open(postgres.Open(psqlDsn))
+	s.db, err = s.openDb()
+	if err != nil {
+		return err
+	}
+
+	// Session store, cookies are signed and encrypted with the newest key pair.
+	// Sessions saved without their own options, e.g. when switching accounts, keep the attributes of the login's cookie.
+	var dbStore *usersession.DbStore
+	switch s.SessionStore {
+	case "db":
+		dbStore = usersession.NewDbStore(s.db, s.logger, keyPairs...)
+		dbStore.Options = s.cookieOptions(OneWeekSeconds)
+		s.store = dbStore
+	default:
+		cookieStore := sessions.NewCookieStore(keyPairs...)
+		cookieStore.Options = s.cookieOptions(OneWeekSeconds)
+		s.store = cookieStore
+	}
+
+	// Server-side session registry, allows revoking sessions
+	s.sessionRegistry = usersession.NewDbRegistry(s.db, s.logger)
+
+	// Login attempts and the last login of each user
+	s.loginHistory = loginhistory.NewDbHistory(s.db, s.logger)
+
+	// Brute-force protection for logins
+	s.loginGuard = loginguard.NewDbGuard(s.db, s.logger, loginguard.Config{
+		MaxFailuresPerUser: s.LoginMaxFailuresPerUser,
+		MaxFailuresPerIP:   s.LoginMaxFailuresPerIP,
+		LockoutDuration:    s.LoginLockoutDuration,
+		BackoffBase:        s.LoginBackoffBase,
+		BackoffMax:         s.LoginBackoffMax,
+	})
+	// and against flooding mailboxes with password reset emails, every request counts as an attempt
+	s.resetGuard = loginguard.NewDbGuard(s.db, s.logger, loginguard.Config{
+		Scope:              "reset",
+		MaxFailuresPerUser: s.PasswordResetMaxPerUser,
+		MaxFailuresPerIP:   s.PasswordResetMaxPerIP,
+		LockoutDuration:    s.PasswordResetTTL,
+		BackoffBase:        s.PasswordResetCooldown,
+		BackoffMax:         s.PasswordResetTTL,
+	})
+
+	// Two-factor authentication
+	s.mfaService = mfa.NewDbService(s.db, s.logger, s.MfaIssuer)
+
+	// Email verification and password reset
+	err = s.setupMailer()
 	if err != nil {
-		return errors.Wrap(err, "failed to initialize gorm")
+		return err
 	}
+	s.emailTokenSigner = emailtoken.NewSigner([]byte(s.EmailTokenSigningKey))
 
-	// Cookie store
-	s.store = sessions.NewCookieStore([]byte(s.CookieStoreSigningKey), []byte(s.CookieStoreEncryptionKey))
+	// Accounts users can switch between
+	s.memberships = membership.NewDbService(s.db, s.logger)
 
 	// ULID manager
 	s.ulidManager = util.NewUlidManager()
 
+	// Personal access tokens for API clients
+	s.accessTokens = accesstoken.NewDbService(s.db, s.logger, s.ulidManager)
+
+	// Audit log
+	s.auditor = audit.NewDbAuditor(s.db, s.logger)
+
+	// Policy versions, the latest version is the policy used by the enforcer
+	s.policyManager = policy.NewDbManager(s.db, s.logger)
+	err = s.seedPolicy()
+	if err != nil {
+		return err
+	}
+
+	// Users authenticated by external identity providers
+	s.identityProvisioner = identity.NewDbProvisioner(s.db, s.logger, s.ulidManager, s.OidcDefaultAccount)
+	if s.OidcIssuer != "" {
+		err = s.setupOidc(context.Background())
+		if err != nil {
+			return err
+		}
+	}
+
+	// Directory groups to casbin roles
+	s.groupSyncer = groupsync.NewDbSyncer(s.db, s.logger, s.policyManager)
+
+	// Password check of logins, directory users are created on their first login
+	err = s.setupAuthenticator()
+	if err != nil {
+		return err
+	}
+
+	// Users and groups provisioned by directories, groups are mapped to roles like directory groups on SSO login
+	s.scimService = scim.NewDbService(s.db, s.logger, s.ulidManager, s.groupSyncer, s.policyManager)
+
+	// Service accounts for automation, they hold roles in their account's domain
+	s.serviceAccounts = serviceaccount.NewDbService(s.db, s.logger, s.ulidManager, s.policyManager)
+
+	// Invitations into existing accounts
+	s.invitations = invitation.NewDbService(s.db, s.logger, s.ulidManager, s.policyManager, s.mailer,
+		[]byte(s.EmailTokenSigningKey), s.PublicURL+"/accept-invitation", s.InvitationTTL)
+
 	// Authorization service
-	casbinEnforcer, err := casbin.NewEnforcer("rbac_with_domains_model.conf", "rbac_with_domains_policy.csv")
-	// TODO: use gorm for storing policies: https://github.com/casbin/gorm-adapter
+	casbinEnforcer, err := casbin.NewSyncedEnforcer("rbac_with_domains_model.conf", s.policyManager)
 	// TODO: expose casbin policy creation through an API: https://casbin.org/docs/rbac-api/#addrolesforuser
 	// TODO: use a different casbin models (the current one is extremely simple): https://github.com/casbin/casbin/tree/master/examples
-	// TODO: use group membership from SSO: https://github.com/casbin/casbin/issues/929
 	// TODO: test hierarchy of roles within the same account, but different groups: https://github.com/casbin/casbin/issues/493
 	// TODO: leverage Go type system for referencing resources
 	// TODO: check out request parsing in casbin middleware for echo: https://echo.labstack.com/docs/middleware/casbin-auth
 	if err != nil {
 		return errors.Wrap(err, "failed to initialize casbin enforcer")
 	}
-	authorizationService := authorization.NewCasbinAuthorizationService(casbinEnforcer)
+	casbinEnforcer.EnableAutoSave(false)
+	s.policyManager.SetReloader(casbinEnforcer)
+	if s.PolicyReloadInterval > 0 {
+		casbinEnforcer.StartAutoLoadPolicy(s.PolicyReloadInterval)
+		defer casbinEnforcer.StopAutoLoadPolicy()
+	}
+	authorizationService := authorization.NewCasbinAuthorizationService(casbinEnforcer, s.auditor)
 	s.authorizationService = authorizationService
 
 	// graphql
-	graphResolver := graph.NewResolver(s.db, s.logger, s.ulidManager, s.authorizationService)
+	graphResolver := graph.NewResolver(s.db, s.logger, s.ulidManager, s.authorizationService, s.auditor, s.policyManager, s.loginGuard, s.groupSyncer, s.accessTokens, s.serviceAccounts, s.invitations, s.memberships, s.mfaService, s.sessionRegistry, s.loginHistory, s.scimService, s.passwordHasher, s.passwordPolicy, s.ImpersonationTTL)
 	graphqlHandler := graphqlhandler.NewDefaultServer(graph.NewExecutableSchema(graph.Config{Resolvers: graphResolver}))
+	graphqlHandler.AroundRootFields(graphResolver.AuditImpersonation)
 	playgroundHandler := graphqlplayground.Handler("GraphQL playground", "/query")
 
 	// initialize echo
 	e := echo.New()
 	e.HideBanner = true
 	e.HidePort = true
+	e.IPExtractor = ipExtractor
 
 	// echo middlewares
 	slogEchoConfig := slogecho.Config{
@@ -119,6 +333,27 @@ func (s *serverCmd) Run(cmdCtx *cmdContext) error {
 				return echo.NewHTTPError(http.StatusBadRequest, "failed to get session")
 			}
 			s.logger.Debug("checking session", "userid", sess.Values[util.SessionKeyUserID])
+			if _, loggedIn := sess.Values[util.SessionKeyUserID]; loggedIn {
+				active, err := s.isSessionActive(sess)
+				if err != nil {
+					s.logger.Error("failed to check session", "err", err)
+					return echo.NewHTTPError(http.StatusInternalServerError, "failed to check session")
+				}
+				if !active {
+					// revoked, expired or issued before sessions were tracked, treat the request as anonymous
+					s.logger.Debug("session is not active", "session", sess.Values[util.SessionKeySessionID])
+					clearSession(sess)
+				} else {
+					err = s.sessionRegistry.Touch(sess.Values[util.SessionKeySessionID].(string), c.RealIP())
+					if err != nil {
+						s.logger.Error("failed to update session", "err", err)
+					}
+					err = s.checkImpersonation(c, sess)
+					if err != nil {
+						return err
+					}
+				}
+			}
 			return next(c)
 		}
 	})
@@ -134,16 +369,34 @@ func (s *serverCmd) Run(cmdCtx *cmdContext) error {
 	// http routes
 	e.GET("/ping", s.Ping)
 	e.GET("/favicon.ico", echo.NotFoundHandler)
-	e.GET("/login", s.Login)
-	e.POST("/signup", s.Signup)
+	s.authRoutes(e)
 
 	// graphql routes
 	e.GET("/playground", echo.WrapHandler(playgroundHandler))
-	e.POST("/query", echo.WrapHandler(graphqlHandler))
+	e.POST("/query", echo.WrapHandler(graphqlHandler), s.csrfMiddleware(), s.BearerAuth, s.PrincipalAuth)
+
+	// scim routes, a token provisions the users and groups of one account
+	e.GET("/scim/v2/ServiceProviderConfig", s.ScimServiceProviderConfig, s.ScimAuth)
+	e.GET("/scim/v2/Users", s.ScimListUsers, s.ScimAuth)
+	e.POST("/scim/v2/Users", s.ScimCreateUser, s.ScimAuth)
+	e.GET("/scim/v2/Users/:id", s.ScimGetUser, s.ScimAuth)
+	e.PUT("/scim/v2/Users/:id", s.ScimReplaceUser, s.ScimAuth)
+	e.PATCH("/scim/v2/Users/:id", s.ScimPatchUser, s.ScimAuth)
+	e.DELETE("/scim/v2/Users/:id", s.ScimDeleteUser, s.ScimAuth)
+	e.GET("/scim/v2/Groups", s.ScimListGroups, s.ScimAuth)
+	e.POST("/scim/v2/Groups", s.ScimCreateGroup, s.ScimAuth)
+	e.GET("/scim/v2/Groups/:id", s.ScimGetGroup, s.ScimAuth)
+	e.PUT("/scim/v2/Groups/:id", s.ScimReplaceGroup, s.ScimAuth)
+	e.PATCH("/scim/v2/Groups/:id", s.ScimPatchGroup, s.ScimAuth)
+	e.DELETE("/scim/v2/Groups/:id", s.ScimDeleteGroup, s.ScimAuth)
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
+	if dbStore != nil {
+		go dbStore.Cleanup(ctx, s.SessionCleanupInterval)
+	}
+
 	go func() {
 		if err := e.Start(s.HttpAddr); err != nil && err != http.ErrServerClosed {
 			s.logger.Error("shutting down the server", "error", err)
@@ -157,106 +410,134 @@ func (s *serverCmd) Run(cmdCtx *cmdContext) error {
 	return e.Shutdown(ctx)
 }
 
-func (s *serverCmd) Healthz(c echo.Context) error {
-	return c.String(200, "OK")
-}
-
-func (s *serverCmd) Ping(c echo.Context) error {
-	return c.String(200, "pong")
-}
-
-func (s *serverCmd) Signup(c echo.Context) error {
-	// parse input
-	inputUsername := c.FormValue("username")
-	inputPassword := c.FormValue("password")
-	inputAccountName := c.FormValue("accountname")
-	s.logger.Debug("signup request", "username", inputUsername)
-	if inputUsername == "" || inputPassword == "" || inputAccountName == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "username, password and accountname are required")
+func (s *serverCmd) setupAuthenticator() error {
+	local := authenticator.NewLocal(s.db, s.logger, s.passwordHasher)
+	if s.LoginBackend != "ldap" {
+		s.authenticator = local
+		return nil
 	}
 
-	// hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(inputPassword), bcrypt.DefaultCost)
+	// ldap users join their own default account, independent of oidc
+	provisioner := identity.NewDbProvisioner(s.db, s.logger, s.ulidManager, s.LdapDefaultAccount)
+	ldapAuthenticator, err := authenticator.NewLdap(authenticator.LdapConfig{
+		URL:                s.LdapURL,
+		StartTLS:           s.LdapStartTLS,
+		BindDN:             s.LdapBindDN,
+		BindPassword:       s.LdapBindPassword,
+		UserBaseDN:         s.LdapUserBaseDN,
+		UserFilter:         s.LdapUserFilter,
+		UsernameAttribute:  s.LdapUsernameAttribute,
+		GroupBaseDN:        s.LdapGroupBaseDN,
+		GroupFilter:        s.LdapGroupFilter,
+		GroupNameAttribute: s.LdapGroupNameAttribute,
+		Timeout:            s.LdapTimeout,
+	}, s.logger, provisioner, s.groupSyncer)
 	if err != nil {
-		s.logger.Error("bcrypt hash error", "err", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to hash password")
+		return err
 	}
+	// local users, e.g. platform admins, keep their passwords
+	s.authenticator = authenticator.NewLocalFallback(local, ldapAuthenticator, s.logger)
+	return nil
+}
 
-	// create user and account in the database
-	newAccount := &model.Account{
-		Ulid: s.ulidManager.NewULID().String(),
-		Name: inputAccountName,
+// authRoutes registers the login and account routes. Their POSTs are protected against CSRF like /query: the session
+// cookie is sent with cross-site form posts, e.g. a forged login or logout, which can't set the X-CSRF-Token header.
+func (s *serverCmd) authRoutes(e *echo.Echo) {
+	csrf := s.csrfMiddleware()
+	e.GET("/auth/csrf", s.CsrfToken, csrf)
+	e.POST("/auth/login", s.Login, csrf)
+	// with a directory as the login backend new users come from the directory, a signup could claim a directory user's username
+	if s.LoginBackend != "ldap" {
+		e.POST("/auth/signup", s.Signup, csrf)
 	}
-	err = s.db.Create(&newAccount).Error
-	if err != nil {
-		s.logger.Error("failed to create account", "err", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "internal error")
+	e.POST("/auth/email/verify/send", s.SendVerificationEmail, csrf, s.denyImpersonation)
+	e.POST("/auth/email/verify", s.VerifyEmail, csrf)
+	e.POST("/auth/password/forgot", s.ForgotPassword, csrf)
+	e.POST("/auth/password/reset", s.ResetPassword, csrf)
+	e.POST("/auth/invitations/accept", s.AcceptInvitation, csrf, s.denyImpersonation)
+	e.POST("/auth/mfa/enroll", s.MfaEnroll, csrf, s.denyImpersonation)
+	e.POST("/auth/mfa/confirm", s.MfaConfirm, csrf, s.denyImpersonation)
+	e.POST("/auth/mfa/verify", s.MfaVerify, csrf)
+	e.POST("/auth/mfa/disable", s.MfaDisable, csrf, s.denyImpersonation)
+	if s.oidc != nil {
+		e.GET("/auth/oidc/login", s.OidcLogin)
+		e.GET("/auth/oidc/callback", s.OidcCallback)
 	}
-	user := &model.User{
-		Ulid:     s.ulidManager.NewULID().String(),
-		Username: inputUsername,
-		Password: string(hashedPassword),
-		Account:  newAccount,
+	e.POST("/logout", s.Logout, csrf)
+}
+
+// ipExtractor determines the client IP used by the login lockout, the rate limiter and session records.
+// Forwarded headers are only trusted when sent by a configured proxy, otherwise clients could pick any IP.
+func (s *serverCmd) ipExtractor() (echo.IPExtractor, error) {
+	if len(s.TrustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
 	}
-	err = s.db.Create(&user).Error
-	if err != nil {
-		s.logger.Error("failed to create user", "err", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create user")
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, cidr := range s.TrustedProxies {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted proxy %q", cidr)
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
 	}
-	s.logger.Debug("created user", "username", user.Username)
-
-	return nil
+	return echo.ExtractIPFromXFFHeader(options...), nil
 }
 
-const OneHourSeconds = 3600   // 1 hour
-const OneWeekSeconds = 604800 // 1 week
-
-func (s *serverCmd) Login(c echo.Context) error {
-	// parse input
-	inputUsername := c.FormValue("username")
-	inputPassword := c.FormValue("password")
-	s.logger.Debug("login request", "username", inputUsername)
-	if inputUsername == "" || inputPassword == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "username and password are required")
+// seedPolicy imports the policy file as the first version, unless the database already has policy versions.
+// The file may name accounts instead of using their ULIDs, a name shared by several accounts applies to all of them
+// and rules of unknown accounts are left out.
+func (s *serverCmd) seedPolicy() error {
+	versions, err := s.policyManager.Versions()
+	if err != nil {
+		return err
+	}
+	if len(versions) > 0 {
+		return nil
 	}
 
-	// find user in the database
-	u := &model.User{}
-	err := s.db.
-		Preload("Account").
-		Where("username = ?", inputUsername).
-		First(u).Error
+	f, err := os.Open(s.PolicySeedFile)
 	if err != nil {
-		s.logger.Debug("failed to find user", "err", err)
-		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+		return errors.Wrap(err, "failed to open policy seed file")
 	}
-
-	// compare password hashes
-	err = bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(inputPassword))
+	defer f.Close()
+	rules, err := policy.ParseCSV(f)
 	if err != nil {
-		// Unauthorized
-		s.logger.Debug("bcrypt compare error", "err", err)
-		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+		return err
 	}
 
-	// create session
-	session, _ := s.store.Get(c.Request(), util.CookieKeySessionName) // this func returns an error when a session is created
-	session.Options = &sessions.Options{
-		MaxAge: OneWeekSeconds,
+	accounts := []*model.Account{}
+	err = s.db.Find(&accounts).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to list accounts")
 	}
-
-	if u.Account != nil {
-		session.Values[util.SessionKeyAccountID] = u.Account.Ulid
+	ulids := map[string]bool{}
+	byName := map[string][]string{}
+	for _, a := range accounts {
+		ulids[a.Ulid] = true
+		byName[a.Name] = append(byName[a.Name], a.Ulid)
+	}
+	unknown := map[string]bool{}
+	rules = policy.RewriteDomains(rules, func(domain string) []string {
+		if ulids[domain] {
+			return []string{domain}
+		}
+		if len(byName[domain]) == 0 {
+			unknown[domain] = true
+		}
+		return byName[domain]
+	})
+	for domain := range unknown {
+		s.logger.Warn("left out policy seed rules of an unknown account", "domain", domain)
 	}
-	session.Values[util.SessionKeyUserID] = u.ID
 
-	s.logger.Debug("found user", "username", u.ID, "account", u.Account.ID)
+	_, err = s.policyManager.Apply(rules, policy.AuthorSystem, fmt.Sprintf("seeded from %s", s.PolicySeedFile))
+	return err
+}
 
-	err = session.Save(c.Request(), c.Response())
-	if err != nil {
-		s.logger.Error("failed to save session", "err", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session")
-	}
+func (s *serverCmd) Healthz(c echo.Context) error {
+	return c.String(200, "OK")
+}
 
-	return nil
+func (s *serverCmd) Ping(c echo.Context) error {
+	return c.String(200, "pong")
 }
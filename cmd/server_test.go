@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPExtractor(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		remoteAddr     string
+		forwardedFor   string
+		want           string
+	}{
+		{"direct", nil, "203.0.113.7:4711", "", "203.0.113.7"},
+		{"spoofed header without proxies", nil, "203.0.113.7:4711", "198.51.100.1", "203.0.113.7"},
+		{"trusted proxy", []string{"10.0.0.0/8"}, "10.1.2.3:4711", "198.51.100.1", "198.51.100.1"},
+		{"client behind trusted proxy spoofing", []string{"10.0.0.0/8"}, "10.1.2.3:4711", "192.0.2.66, 198.51.100.1", "198.51.100.1"},
+		{"untrusted proxy", []string{"10.0.0.0/8"}, "203.0.113.7:4711", "198.51.100.1", "203.0.113.7"},
+		{"private network is not trusted implicitly", []string{"10.0.0.0/8"}, "192.168.1.1:4711", "198.51.100.1", "192.168.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &serverCmd{TrustedProxies: tt.trustedProxies}
+			extract, err := s.ipExtractor()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/auth/login", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			got := extract(r)
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPExtractorInvalidProxy(t *testing.T) {
+	s := &serverCmd{TrustedProxies: []string{"10.0.0.1"}}
+	_, err := s.ipExtractor()
+	if err == nil {
+		t.Fatal("expected an error for a proxy without a prefix length")
+	}
+}
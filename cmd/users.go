@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type usersCmd struct {
+	Duplicates usersDuplicatesCmd `cmd:"" help:"List usernames which only differ in case, they must be resolved before the unique username migration."`
+}
+
+type usersDuplicatesCmd struct {
+	dbFlags `embed:""`
+}
+
+type duplicateUser struct {
+	ID        uint
+	Ulid      string
+	Username  string
+	AccountID uint
+	CreatedAt time.Time
+}
+
+func (c *usersDuplicatesCmd) Run(cmdCtx *cmdContext) error {
+	db, err := c.openDb()
+	if err != nil {
+		return err
+	}
+	users := []*duplicateUser{}
+	err = db.Raw(`
+		SELECT id, ulid, username, account_id, created_at FROM users
+		WHERE LOWER(username) IN (SELECT LOWER(username) FROM users GROUP BY LOWER(username) HAVING COUNT(*) > 1)
+		ORDER BY LOWER(username), id`).Scan(&users).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to list duplicate usernames")
+	}
+	if len(users) == 0 {
+		fmt.Println("no duplicate usernames")
+		return nil
+	}
+	for _, u := range users {
+		fmt.Printf("%s\t%s\t%d\t%d\t%s\n", u.Username, u.Ulid, u.ID, u.AccountID, u.CreatedAt.Format("2006-01-02 15:04:05"))
+	}
+	fmt.Printf("%d users share a username with another user, rename or delete them before migrating\n", len(users))
+	return nil
+}
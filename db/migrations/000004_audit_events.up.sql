@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS audit_events
+(
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    actor      VARCHAR(255) NOT NULL,
+    actor_type VARCHAR(64)  NOT NULL,
+    domain     VARCHAR(255) NOT NULL,
+    resource   VARCHAR(255) NOT NULL,
+    action     VARCHAR(255) NOT NULL,
+    reason     VARCHAR(255) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor ON audit_events (actor);
+CREATE INDEX IF NOT EXISTS idx_audit_events_domain ON audit_events (domain);
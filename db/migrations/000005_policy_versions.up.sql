@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS policy_versions
+(
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    version    INTEGER      NOT NULL UNIQUE,
+    author     VARCHAR(255) NOT NULL,
+    comment    TEXT         NOT NULL,
+    rules      JSONB        NOT NULL
+);
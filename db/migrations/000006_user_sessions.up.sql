@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS user_sessions
+(
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    ulid       VARCHAR(26) NOT NULL UNIQUE,
+    user_id    BIGINT      NOT NULL,
+    expires_at TIMESTAMP   NOT NULL,
+    revoked_at TIMESTAMP,
+    CONSTRAINT fk_user_sessions_user_id FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_sessions_user_id ON user_sessions (user_id);
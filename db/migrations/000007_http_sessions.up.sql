@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS http_sessions
+(
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    key        VARCHAR(64) NOT NULL UNIQUE,
+    data       BYTEA       NOT NULL,
+    expires_at TIMESTAMP   NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_http_sessions_expires_at ON http_sessions (expires_at);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS login_throttles
+(
+    id              BIGSERIAL PRIMARY KEY,
+    created_at      TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    key             VARCHAR(320) NOT NULL UNIQUE,
+    failures        INTEGER      NOT NULL,
+    last_failure_at TIMESTAMP    NOT NULL,
+    locked_until    TIMESTAMP
+);
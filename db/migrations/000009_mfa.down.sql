@@ -0,0 +1,3 @@
+ALTER TABLE accounts DROP COLUMN IF EXISTS require_mfa;
+DROP TABLE IF EXISTS mfa_recovery_codes;
+DROP TABLE IF EXISTS user_mfa;
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS user_mfa
+(
+    id             BIGSERIAL PRIMARY KEY,
+    created_at     TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    user_id        BIGINT      NOT NULL UNIQUE,
+    secret         VARCHAR(64) NOT NULL,
+    confirmed_at   TIMESTAMP,
+    last_used_step BIGINT      NOT NULL DEFAULT 0,
+    CONSTRAINT fk_user_mfa_user_id FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes
+(
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    user_id    BIGINT      NOT NULL,
+    code_hash  VARCHAR(64) NOT NULL,
+    used_at    TIMESTAMP,
+    CONSTRAINT fk_mfa_recovery_codes_user_id FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_mfa_recovery_codes_user_id ON mfa_recovery_codes (user_id);
+
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS require_mfa BOOLEAN NOT NULL DEFAULT FALSE;
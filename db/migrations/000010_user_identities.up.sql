@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS user_identities
+(
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    provider   VARCHAR(255) NOT NULL,
+    subject    VARCHAR(255) NOT NULL,
+    user_id    BIGINT       NOT NULL,
+    CONSTRAINT uq_user_identities_provider_subject UNIQUE (provider, subject),
+    CONSTRAINT fk_user_identities_user_id FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
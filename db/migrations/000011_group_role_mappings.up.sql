@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS group_role_mappings
+(
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    account_id BIGINT       NOT NULL,
+    group_name VARCHAR(255) NOT NULL,
+    role       VARCHAR(255) NOT NULL,
+    CONSTRAINT uq_group_role_mappings UNIQUE (account_id, group_name, role),
+    CONSTRAINT fk_group_role_mappings_account_id FOREIGN KEY (account_id) REFERENCES accounts (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
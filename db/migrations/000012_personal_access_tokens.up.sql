@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS personal_access_tokens
+(
+    id           BIGSERIAL PRIMARY KEY,
+    created_at   TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    ulid         VARCHAR(26)  NOT NULL UNIQUE,
+    user_id      BIGINT       NOT NULL,
+    name         VARCHAR(255) NOT NULL,
+    token_hash   VARCHAR(64)  NOT NULL UNIQUE,
+    scopes       TEXT         NOT NULL,
+    expires_at   TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at   TIMESTAMP,
+    CONSTRAINT fk_personal_access_tokens_user_id FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_user_id ON personal_access_tokens (user_id);
@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS service_accounts
+(
+    id          BIGSERIAL PRIMARY KEY,
+    created_at  TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    ulid        VARCHAR(26)  NOT NULL UNIQUE,
+    account_id  BIGINT       NOT NULL,
+    name        VARCHAR(255) NOT NULL,
+    description TEXT         NOT NULL DEFAULT '',
+    CONSTRAINT uq_service_accounts_name UNIQUE (account_id, name),
+    CONSTRAINT fk_service_accounts_account_id FOREIGN KEY (account_id) REFERENCES accounts (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS service_account_keys
+(
+    id                 BIGSERIAL PRIMARY KEY,
+    created_at         TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    ulid               VARCHAR(26)  NOT NULL UNIQUE,
+    service_account_id BIGINT       NOT NULL,
+    name               VARCHAR(255) NOT NULL,
+    key_hash           VARCHAR(64)  NOT NULL UNIQUE,
+    expires_at         TIMESTAMP,
+    last_used_at       TIMESTAMP,
+    revoked_at         TIMESTAMP,
+    CONSTRAINT fk_service_account_keys_service_account_id FOREIGN KEY (service_account_id) REFERENCES service_accounts (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
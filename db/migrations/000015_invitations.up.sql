@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS invitations
+(
+    id          BIGSERIAL PRIMARY KEY,
+    created_at  TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    ulid        VARCHAR(26)  NOT NULL UNIQUE,
+    account_id  BIGINT       NOT NULL,
+    email       VARCHAR(255) NOT NULL,
+    role        VARCHAR(255) NOT NULL,
+    invited_by  VARCHAR(255) NOT NULL,
+    expires_at  TIMESTAMP    NOT NULL,
+    accepted_at TIMESTAMP,
+    revoked_at  TIMESTAMP,
+    CONSTRAINT fk_invitations_account_id FOREIGN KEY (account_id) REFERENCES accounts (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_invitations_account_id ON invitations (account_id);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS account_memberships
+(
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    user_id    BIGINT    NOT NULL,
+    account_id BIGINT    NOT NULL,
+    CONSTRAINT uq_account_memberships UNIQUE (user_id, account_id),
+    CONSTRAINT fk_account_memberships_user_id FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT fk_account_memberships_account_id FOREIGN KEY (account_id) REFERENCES accounts (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+-- every user is a member of the account they were created in
+INSERT INTO account_memberships (user_id, account_id)
+SELECT id, account_id FROM users
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,3 @@
+ALTER TABLE user_sessions DROP COLUMN IF EXISTS last_seen_at;
+ALTER TABLE user_sessions DROP COLUMN IF EXISTS user_agent;
+ALTER TABLE user_sessions DROP COLUMN IF EXISTS ip;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS uq_users_username_lower;
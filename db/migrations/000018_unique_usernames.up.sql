@@ -0,0 +1,2 @@
+-- fails if usernames collide case-insensitively, run `users duplicates` to list them and resolve them first
+CREATE UNIQUE INDEX IF NOT EXISTS uq_users_username_lower ON users (LOWER(username));
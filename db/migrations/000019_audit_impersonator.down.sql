@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_audit_events_impersonator;
+ALTER TABLE audit_events DROP COLUMN IF EXISTS impersonator;
@@ -0,0 +1,4 @@
+-- the real user behind an impersonated actor, empty when nobody was impersonated
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS impersonator VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_impersonator ON audit_events (impersonator) WHERE impersonator <> '';
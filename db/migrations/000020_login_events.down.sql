@@ -0,0 +1,4 @@
+ALTER TABLE users DROP COLUMN IF EXISTS last_login_ip;
+ALTER TABLE users DROP COLUMN IF EXISTS last_login_at;
+
+DROP TABLE IF EXISTS login_events;
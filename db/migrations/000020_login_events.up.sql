@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS login_events
+(
+    id         BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    user_id    BIGINT,
+    username   VARCHAR(255) NOT NULL,
+    ip         VARCHAR(64)  NOT NULL,
+    user_agent TEXT         NOT NULL,
+    method     VARCHAR(32)  NOT NULL,
+    outcome    VARCHAR(32)  NOT NULL,
+    reason     VARCHAR(64)  NOT NULL,
+    CONSTRAINT fk_login_events_user_id FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_events_user_id ON login_events (user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_login_events_created_at ON login_events (created_at);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_ip VARCHAR(64);
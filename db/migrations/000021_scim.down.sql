@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS scim_group_members;
+DROP TABLE IF EXISTS scim_groups;
+DROP TABLE IF EXISTS scim_tokens;
+
+ALTER TABLE account_memberships DROP COLUMN IF EXISTS deactivated_at;
@@ -0,0 +1,42 @@
+-- a directory deactivates the user's membership of its account, the user keeps their other accounts
+-- and the membership is kept so that the directory can reactivate it
+ALTER TABLE account_memberships ADD COLUMN IF NOT EXISTS deactivated_at TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS scim_tokens
+(
+    id           BIGSERIAL PRIMARY KEY,
+    created_at   TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    ulid         VARCHAR(26)  NOT NULL UNIQUE,
+    account_id   BIGINT       NOT NULL,
+    name         VARCHAR(255) NOT NULL,
+    token_hash   VARCHAR(64)  NOT NULL UNIQUE,
+    last_used_at TIMESTAMP,
+    revoked_at   TIMESTAMP,
+    CONSTRAINT fk_scim_tokens_account_id FOREIGN KEY (account_id) REFERENCES accounts (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS scim_groups
+(
+    id           BIGSERIAL PRIMARY KEY,
+    created_at   TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at   TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    ulid         VARCHAR(26)  NOT NULL UNIQUE,
+    account_id   BIGINT       NOT NULL,
+    display_name VARCHAR(255) NOT NULL,
+    external_id  VARCHAR(255) NOT NULL DEFAULT '',
+    CONSTRAINT uq_scim_groups_display_name UNIQUE (account_id, display_name),
+    CONSTRAINT fk_scim_groups_account_id FOREIGN KEY (account_id) REFERENCES accounts (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS scim_group_members
+(
+    group_id BIGINT NOT NULL,
+    user_id  BIGINT NOT NULL,
+    PRIMARY KEY (group_id, user_id),
+    CONSTRAINT fk_scim_group_members_group_id FOREIGN KEY (group_id) REFERENCES scim_groups (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT fk_scim_group_members_user_id FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_scim_group_members_user_id ON scim_group_members (user_id);
@@ -0,0 +1 @@
+-- policy versions are immutable, restore the version before the move with the policy rollback command instead
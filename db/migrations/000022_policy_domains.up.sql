@@ -0,0 +1,36 @@
+-- casbin domains used to be account names and are account ULIDs now, the rules of the latest policy version move to
+-- the ULIDs of the accounts with that name. A name shared by several accounts applied to all of them, so do the moved
+-- rules. Domains which are neither are left alone, no version is stored if no rule moves.
+WITH latest AS (
+    SELECT version, rules FROM policy_versions ORDER BY version DESC LIMIT 1
+),
+current_rules AS (
+    SELECT r.item, r.ordinal,
+           CASE
+               WHEN r.item ->> 0 = 'p' AND jsonb_array_length(r.item) = 5 THEN 2
+               WHEN r.item ->> 0 = 'g' AND jsonb_array_length(r.item) = 4 THEN 3
+           END AS domain_index
+    FROM latest, jsonb_array_elements(latest.rules) WITH ORDINALITY AS r (item, ordinal)
+),
+moved AS (
+    SELECT current_rules.ordinal, accounts.id AS account_id,
+           jsonb_set(current_rules.item, ARRAY [current_rules.domain_index::TEXT], to_jsonb(accounts.ulid)) AS item
+    FROM current_rules
+             JOIN accounts ON accounts.name = current_rules.item ->> current_rules.domain_index
+    WHERE NOT EXISTS (SELECT 1 FROM accounts known WHERE known.ulid = current_rules.item ->> current_rules.domain_index)
+),
+rewritten AS (
+    SELECT ordinal, account_id, item FROM moved
+    UNION ALL
+    SELECT ordinal, 0, item FROM current_rules WHERE ordinal NOT IN (SELECT ordinal FROM moved)
+),
+deduplicated AS (
+    SELECT DISTINCT ON (item) item, ordinal, account_id FROM rewritten ORDER BY item, ordinal, account_id
+)
+INSERT INTO policy_versions (version, author, comment, rules)
+SELECT latest.version + 1,
+       'system',
+       'moved domains from account names to ULIDs',
+       (SELECT jsonb_agg(item ORDER BY ordinal, account_id) FROM deduplicated)
+FROM latest
+WHERE EXISTS (SELECT 1 FROM moved);
@@ -0,0 +1,90 @@
+package graph
+
+import (
+	"net/http"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/accesstoken"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/invitation"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/policy"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/scim"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/serviceaccount"
+)
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func toPolicyVersion(v *policy.Version) (*model.PolicyVersion, error) {
+	rules, err := v.DecodeRules()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	lines := []string{}
+	for _, rule := range rules {
+		lines = append(lines, rule.String())
+	}
+	return &model.PolicyVersion{
+		Version:   v.Version,
+		Author:    v.Author,
+		Comment:   v.Comment,
+		CreatedAt: v.CreatedAt,
+		Rules:     lines,
+	}, nil
+}
+
+func toPersonalAccessToken(t *accesstoken.Token) *model.PersonalAccessToken {
+	return &model.PersonalAccessToken{
+		Ulid:       t.Ulid,
+		Name:       t.Name,
+		Scopes:     t.ScopeList(),
+		CreatedAt:  t.CreatedAt,
+		ExpiresAt:  t.ExpiresAt,
+		LastUsedAt: t.LastUsedAt,
+	}
+}
+
+func toServiceAccount(sa *serviceaccount.ServiceAccount, roles []string) *model.ServiceAccount {
+	return &model.ServiceAccount{
+		Ulid:        sa.Ulid,
+		Name:        sa.Name,
+		Description: sa.Description,
+		Roles:       roles,
+		CreatedAt:   sa.CreatedAt,
+	}
+}
+
+func toServiceAccountKey(k *serviceaccount.Key) *model.ServiceAccountKey {
+	return &model.ServiceAccountKey{
+		Ulid:       k.Ulid,
+		Name:       k.Name,
+		CreatedAt:  k.CreatedAt,
+		ExpiresAt:  k.ExpiresAt,
+		LastUsedAt: k.LastUsedAt,
+	}
+}
+
+func toInvitation(inv *invitation.Invitation) *model.Invitation {
+	return &model.Invitation{
+		Ulid:      inv.Ulid,
+		Email:     inv.Email,
+		Role:      inv.Role,
+		InvitedBy: inv.InvitedBy,
+		CreatedAt: inv.CreatedAt,
+		ExpiresAt: inv.ExpiresAt,
+	}
+}
+
+func toScimToken(t *scim.Token) *model.ScimToken {
+	return &model.ScimToken{
+		Ulid:       t.Ulid,
+		Name:       t.Name,
+		CreatedAt:  t.CreatedAt,
+		LastUsedAt: t.LastUsedAt,
+	}
+}
@@ -0,0 +1,82 @@
+package graph
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/99designs/gqlgen/graphql"
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/audit"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+// sessionImpersonation returns both users of an impersonation session, nil if the session isn't impersonating, errors are safe to return to the client
+func (r *Resolver) sessionImpersonation(ctx context.Context) (*model.Impersonation, error) {
+	p, err := r.principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !p.IsImpersonated() {
+		return nil, nil
+	}
+	return &model.Impersonation{User: p.User, Impersonator: p.Impersonator, ExpiresAt: p.ImpersonationUntil}, nil
+}
+
+// requireOwnSession is requireSession for sensitive operations, e.g. changing credentials, which an impersonator must not perform
+func (r *Resolver) requireOwnSession(ctx context.Context) (*util.Principal, error) {
+	p, err := r.requireSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = r.denyImpersonation(p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// denyImpersonation rejects sensitive operations of an impersonator, errors are safe to return to the client
+func (r *Resolver) denyImpersonation(p *util.Principal) error {
+	if p.IsImpersonated() {
+		r.logger.Debug("Sensitive operation while impersonating", "impersonator", p.Impersonator.Username)
+		return echo.NewHTTPError(http.StatusForbidden, "Not allowed while impersonating a user")
+	}
+	return nil
+}
+
+// AuditImpersonation records every root field resolved in an impersonation session under the impersonated user and the impersonator,
+// fields are not resolved if the event can't be recorded
+func (r *Resolver) AuditImpersonation(ctx context.Context, next graphql.RootResolver) graphql.Marshaler {
+	p, ok := util.PrincipalFromContext(ctx)
+	if !ok || !p.IsImpersonated() {
+		return next(ctx)
+	}
+	fc := graphql.GetRootFieldContext(ctx)
+	if strings.HasPrefix(fc.Field.Name, "__") {
+		// introspection
+		return next(ctx)
+	}
+
+	domain := audit.DomainGlobal
+	if p.Account != nil {
+		domain = p.Account.Ulid
+	}
+	err := r.auditor.Record(&audit.Event{
+		Actor:        p.User.Username,
+		ActorType:    audit.ActorTypeUser,
+		Domain:       domain,
+		Resource:     "graphql",
+		Action:       strings.ToLower(fc.Object) + "." + fc.Field.Name,
+		Reason:       audit.ReasonImpersonation,
+		Impersonator: p.Impersonator.Username,
+	})
+	if err != nil {
+		r.logger.Error("Error recording audit event", "error", err)
+		graphql.AddError(ctx, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error"))
+		return graphql.Null
+	}
+	return next(ctx)
+}
@@ -0,0 +1,82 @@
+package graph
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/authorization"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+// allowAll authorizes everything, the impersonation checks come first
+type allowAll struct {
+	authorization.Authorization
+}
+
+func (allowAll) IsAuthorized(username string, domain string, resource string, action string) (bool, error) {
+	return true, nil
+}
+
+func TestImpersonatorCannotAdminister(t *testing.T) {
+	// the resolver has no services, reaching one panics
+	r := &mutationResolver{&Resolver{logger: slog.New(slog.NewTextHandler(io.Discard, nil)), authorizationService: allowAll{}}}
+	tests := []struct {
+		name    string
+		resolve func(ctx context.Context) error
+	}{
+		{"setAccountRequireMfa", func(ctx context.Context) error {
+			_, err := r.SetAccountRequireMfa(ctx, false)
+			return err
+		}},
+		{"addGroupRoleMapping", func(ctx context.Context) error {
+			_, err := r.AddGroupRoleMapping(ctx, "admins", "admin")
+			return err
+		}},
+		{"createPersonalAccessToken", func(ctx context.Context) error {
+			_, err := r.CreatePersonalAccessToken(ctx, model.NewPersonalAccessToken{Name: "ci"})
+			return err
+		}},
+		{"createServiceAccount", func(ctx context.Context) error {
+			_, err := r.CreateServiceAccount(ctx, model.NewServiceAccount{Name: "ci"})
+			return err
+		}},
+		{"updateServiceAccount", func(ctx context.Context) error {
+			_, err := r.UpdateServiceAccount(ctx, "01JAAAAAAAAAAAAAAAAAAAAAAA", model.UpdateServiceAccount{})
+			return err
+		}},
+		{"createServiceAccountKey", func(ctx context.Context) error {
+			_, err := r.CreateServiceAccountKey(ctx, "01JAAAAAAAAAAAAAAAAAAAAAAA", "ci", nil)
+			return err
+		}},
+		{"inviteUser", func(ctx context.Context) error {
+			_, err := r.InviteUser(ctx, "john@example.com", "admin")
+			return err
+		}},
+		{"createScimToken", func(ctx context.Context) error {
+			_, err := r.CreateScimToken(ctx, "idp")
+			return err
+		}},
+	}
+	p := &util.Principal{
+		Type:         util.PrincipalTypeSession,
+		User:         &model.User{ID: 1, Username: "jane@example.com"},
+		Account:      &model.Account{ID: 1, Ulid: "01JBBBBBBBBBBBBBBBBBBBBBBB"},
+		Impersonator: &model.User{ID: 2, Username: "root@example.com"},
+	}
+	ctx := util.ContextWithPrincipal(context.Background(), p)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.resolve(ctx)
+			httpErr, ok := err.(*echo.HTTPError)
+			if !ok || httpErr.Code != http.StatusForbidden {
+				t.Errorf("got %v, want a %d error", err, http.StatusForbidden)
+			}
+		})
+	}
+}
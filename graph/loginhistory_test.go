@@ -0,0 +1,104 @@
+package graph
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+	stringadapter "github.com/casbin/casbin/v2/persist/string-adapter"
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/audit"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/authorization"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/loginhistory"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+type fakeAuditor struct {
+	events []*audit.Event
+}
+
+func (a *fakeAuditor) Record(event *audit.Event) error {
+	a.events = append(a.events, event)
+	return nil
+}
+
+type fakeHistory struct {
+	userID uint
+}
+
+func (h *fakeHistory) Record(event *loginhistory.Event) error {
+	return nil
+}
+
+func (h *fakeHistory) ForUser(userID uint, limit int) ([]*loginhistory.Event, error) {
+	h.userID = userID
+	return []*loginhistory.Event{}, nil
+}
+
+func TestLoginHistoryOfAnotherUser(t *testing.T) {
+	db := dbtest.Open(t)
+	acme := dbtest.Account(t, db, "acme")
+	other := dbtest.Account(t, db, "other")
+	jane := dbtest.User(t, db, acme, "jane@example.com")
+	admin := dbtest.User(t, db, acme, "admin@example.com")
+	root := dbtest.User(t, db, other, "root@example.com")
+	john := dbtest.User(t, db, other, "john@example.com")
+
+	policy := "p, admin, " + acme.Ulid + ", user, read\n" +
+		"g, admin@example.com, admin, " + acme.Ulid + "\n" +
+		"g2, root@example.com, " + authorization.PlatformAdminRole
+	tests := []struct {
+		name       string
+		caller     *model.User
+		wantStatus int
+		// wantAudit is true if the read is audited as a platform admin's
+		wantAudit bool
+	}{
+		{name: "account admin", caller: admin},
+		{name: "platform admin of another account", caller: root, wantAudit: true},
+		{name: "user of another account", caller: john, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enforcer, err := casbin.NewSyncedEnforcer("../rbac_with_domains_model.conf", stringadapter.NewAdapter(policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			auditor := &fakeAuditor{}
+			history := &fakeHistory{}
+			r := &queryResolver{&Resolver{
+				db:                   db,
+				logger:               dbtest.Logger(),
+				authorizationService: authorization.NewCasbinAuthorizationService(enforcer, auditor),
+				auditor:              auditor,
+				loginHistory:         history,
+			}}
+			p := &util.Principal{Type: util.PrincipalTypeSession, User: tt.caller, Account: tt.caller.Account}
+
+			_, err = r.LoginHistory(util.ContextWithPrincipal(context.Background(), p), &jane.Username, nil)
+			if tt.wantStatus != 0 {
+				httpErr, ok := err.(*echo.HTTPError)
+				if !ok || httpErr.Code != tt.wantStatus {
+					t.Fatalf("got %v, want a %d error", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if history.userID != jane.ID {
+				t.Errorf("got the history of user %d, want %d", history.userID, jane.ID)
+			}
+			if len(auditor.events) > 0 != tt.wantAudit {
+				t.Fatalf("got %d audit events, want audit %v", len(auditor.events), tt.wantAudit)
+			}
+			if tt.wantAudit && (auditor.events[0].Domain != acme.Ulid || auditor.events[0].Reason != audit.ReasonPlatformAdmin) {
+				t.Errorf("unexpected audit event %+v", auditor.events[0])
+			}
+		})
+	}
+}
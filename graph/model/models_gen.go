@@ -2,13 +2,69 @@
 
 package model
 
+import (
+	"time"
+)
+
 type Account struct {
-	Ulid string `json:"ulid"`
-	Name string `json:"name"`
+	Ulid       string `json:"ulid"`
+	Name       string `json:"name"`
+	RequireMfa bool   `json:"requireMfa"`
 	// The account's ID
 	ID uint `gorm:"primaryKey"`
 }
 
+type CreatedPersonalAccessToken struct {
+	Token               string               `json:"token"`
+	PersonalAccessToken *PersonalAccessToken `json:"personalAccessToken"`
+}
+
+type CreatedScimToken struct {
+	Token     string     `json:"token"`
+	ScimToken *ScimToken `json:"scimToken"`
+}
+
+type CreatedServiceAccountKey struct {
+	Key               string             `json:"key"`
+	ServiceAccountKey *ServiceAccountKey `json:"serviceAccountKey"`
+}
+
+type GroupRoleMapping struct {
+	Group string `json:"group"`
+	Role  string `json:"role"`
+}
+
+type Impersonation struct {
+	User         *User     `json:"user"`
+	Impersonator *User     `json:"impersonator"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+type Invitation struct {
+	Ulid      string    `json:"ulid"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invitedBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type LoginEvent struct {
+	CreatedAt time.Time `json:"createdAt"`
+	Username  string    `json:"username"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Method    string    `json:"method"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason"`
+}
+
+type Membership struct {
+	Account   *Account  `json:"account"`
+	Current   bool      `json:"current"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
 type Mutation struct {
 }
 
@@ -26,13 +82,75 @@ type NewNamespace struct {
 	Name string `json:"name"`
 }
 
+type NewPersonalAccessToken struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type NewServiceAccount struct {
+	Name        string   `json:"name"`
+	Description *string  `json:"description,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+}
+
 type NewStack struct {
 	Name string `json:"name"`
 }
 
+type PersonalAccessToken struct {
+	Ulid       string     `json:"ulid"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+type PolicyVersion struct {
+	Version   int       `json:"version"`
+	Author    string    `json:"author"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"createdAt"`
+	Rules     []string  `json:"rules"`
+}
+
 type Query struct {
 }
 
+type ScimToken struct {
+	Ulid       string     `json:"ulid"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+type ServiceAccount struct {
+	Ulid        string    `json:"ulid"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Roles       []string  `json:"roles"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type ServiceAccountKey struct {
+	Ulid       string     `json:"ulid"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+type Session struct {
+	ID         string     `json:"id"`
+	Device     string     `json:"device"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"userAgent"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastSeenAt *time.Time `json:"lastSeenAt,omitempty"`
+	Current    bool       `json:"current"`
+}
+
 type Stack struct {
 	Ulid        string   `json:"ulid"`
 	Name        string   `json:"name"`
@@ -44,13 +162,24 @@ type Stack struct {
 	ID uint `gorm:"primaryKey"`
 }
 
+type UpdateServiceAccount struct {
+	Name        *string  `json:"name,omitempty"`
+	Description *string  `json:"description,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+}
+
 type User struct {
-	Ulid     string   `json:"ulid"`
-	Username string   `json:"username"`
-	Password string   `json:"password"`
-	Account  *Account `json:"account"`
+	Ulid        string     `json:"ulid"`
+	Username    string     `json:"username"`
+	Account     *Account   `json:"account"`
+	LastLoginAt *time.Time `json:"lastLoginAt,omitempty"`
+	LastLoginIP *string    `json:"lastLoginIp,omitempty"`
 	// The account's ID
 	AccountID uint `json:"-"`
+	// When the user proved that they own the email address in their username
+	EmailVerifiedAt *time.Time `json:"-"`
 	// The user's ID
 	ID uint `gorm:"primaryKey"`
+	// The user's password hash
+	Password string `json:"-"`
 }
@@ -0,0 +1,77 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/loginguard"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/password"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/breachedtest"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+// allowLogins never throttles
+type allowLogins struct {
+	loginguard.Guard
+}
+
+func (allowLogins) Check(username string, ip string) (time.Duration, error) {
+	return 0, nil
+}
+
+// the new password is checked before it's stored, the resolver has no database
+func TestChangePasswordBreached(t *testing.T) {
+	tests := []struct {
+		name        string
+		newPassword string
+		wantStatus  int
+	}{
+		{name: "breached", newPassword: "correct horse battery staple", wantStatus: http.StatusBadRequest},
+		{name: "breached list can't be read", newPassword: "unreadable horse battery staple", wantStatus: http.StatusInternalServerError},
+	}
+	hasher, err := password.NewPHCHasher(password.Config{Algorithm: password.AlgorithmBcrypt, BcryptCost: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentHash, err := hasher.Hash("current password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := breachedtest.Dir(t, "correct horse battery staple")
+			breachedtest.Unreadable(t, dir, "unreadable horse battery staple")
+			breached, err := password.NewPrefixDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &mutationResolver{&Resolver{
+				logger:         dbtest.Logger(),
+				loginGuard:     allowLogins{},
+				passwordHasher: hasher,
+				passwordPolicy: &password.Policy{MinLength: 12, Breached: breached},
+			}}
+			p := &util.Principal{Type: util.PrincipalTypeSession, User: &model.User{ID: 1, Username: "jane@example.com", Password: currentHash}}
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/query", nil), httptest.NewRecorder())
+			ctx := context.WithValue(util.ContextWithPrincipal(context.Background(), p), util.CtxKeyEchoContext, c)
+
+			_, err = r.ChangePassword(ctx, "current password", tt.newPassword)
+			httpErr, ok := err.(*echo.HTTPError)
+			if !ok || httpErr.Code != tt.wantStatus {
+				t.Fatalf("got %v, want a %d error", err, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusBadRequest && !strings.Contains(fmt.Sprint(httpErr.Message), "breach") {
+				t.Errorf("got %v, want the breached password to be rejected", httpErr.Message)
+			}
+		})
+	}
+}
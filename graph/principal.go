@@ -0,0 +1,143 @@
+package graph
+
+import (
+	"context"
+	"net/http"
+
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/audit"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+// principal returns the caller loaded by the principal middleware, errors are safe to return to the client
+func (r *Resolver) principal(ctx context.Context) (*util.Principal, error) {
+	p, ok := util.PrincipalFromContext(ctx)
+	if !ok {
+		r.logger.Debug("No principal in context")
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	}
+	return p, nil
+}
+
+// requireAccount returns the caller and checks that they act in an account, errors are safe to return to the client
+func (r *Resolver) requireAccount(ctx context.Context) (*util.Principal, error) {
+	p, err := r.principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p.Account == nil {
+		r.logger.Debug("Not a member of the session's account", "username", p.User.Username)
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Not a member of the account")
+	}
+	return p, nil
+}
+
+// checkScope rejects actions outside the scope of the principal, e.g. of its access token, errors are safe to return to the client
+func (r *Resolver) checkScope(p *util.Principal, resource string, action string) error {
+	if p.Scope != nil && !p.Scope.Allows(resource, action) {
+		r.logger.Debug("Not in scope", "credential", p.CredentialID, "resource", resource, "action", action)
+		return echo.NewHTTPError(http.StatusForbidden, "Not authorized")
+	}
+	return nil
+}
+
+// authorize checks the permission of the principal in the account, errors are safe to return to the client
+func (r *Resolver) authorize(p *util.Principal, account *model.Account, resource string, action string) error {
+	err := r.checkScope(p, resource, action)
+	if err != nil {
+		return err
+	}
+	hasAccess, err := r.authorizationService.IsAuthorized(p.User.Username, account.Ulid, resource, action)
+	if err != nil {
+		r.logger.Error("Error checking authorization", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	if !hasAccess {
+		r.logger.Debug("Not authorized", "username", p.User.Username, "account", account.Name, "resource", resource, "action", action)
+		return echo.NewHTTPError(http.StatusForbidden, "Not authorized")
+	}
+
+	// every action of automation is audited
+	if p.Type == util.PrincipalTypeServiceAccount {
+		err = r.auditor.Record(&audit.Event{
+			Actor:     p.User.Username,
+			ActorType: audit.ActorTypeServiceAccount,
+			Domain:    account.Ulid,
+			Resource:  resource,
+			Action:    action,
+		})
+		if err != nil {
+			r.logger.Error("Error recording audit event", "error", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+		}
+	}
+	return nil
+}
+
+// requirePlatformAdmin returns the caller and checks that they are a platform admin, the access is audited
+func (r *Resolver) requirePlatformAdmin(ctx context.Context, resource string, action string) (*util.Principal, error) {
+	p, err := r.principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p.Type == util.PrincipalTypeServiceAccount {
+		r.logger.Debug("Service account used for a platform admin operation")
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Not authorized")
+	}
+	if !r.authorizationService.IsPlatformAdmin(p.User.Username) {
+		r.logger.Debug("Not a platform admin", "username", p.User.Username)
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Not authorized")
+	}
+	err = r.checkScope(p, resource, action)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.auditor.Record(&audit.Event{
+		Actor:     p.User.Username,
+		ActorType: audit.ActorTypeUser,
+		Domain:    audit.DomainGlobal,
+		Resource:  resource,
+		Action:    action,
+		Reason:    audit.ReasonPlatformAdmin,
+	})
+	if err != nil {
+		r.logger.Error("Error recording audit event", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return p, nil
+}
+
+// requireSession returns the caller and rejects requests authenticated with an access token or service account key, errors are safe to return to the client
+func (r *Resolver) requireSession(ctx context.Context) (*util.Principal, error) {
+	p, err := r.principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p.Type != util.PrincipalTypeSession {
+		r.logger.Debug("Bearer credentials used for a session-only operation")
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Not allowed with bearer credentials")
+	}
+	return p, nil
+}
+
+// requireAccountAdmin returns the caller and checks that they may administer their current account, errors are safe to return to the client.
+// Administration creates credentials and grants roles, which an impersonator must not do in the user's name.
+func (r *Resolver) requireAccountAdmin(ctx context.Context) (*util.Principal, error) {
+	p, err := r.requireAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = r.denyImpersonation(p)
+	if err != nil {
+		return nil, err
+	}
+	err = r.authorize(p, p.Account, AuthorizationResourceAccount, AuthorizationActionUpdate)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
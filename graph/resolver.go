@@ -4,10 +4,24 @@ package graph
 
 import (
 	"log/slog"
+	"time"
 
 	"gorm.io/gorm"
 
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/accesstoken"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/audit"
 	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/authorization"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/groupsync"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/invitation"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/loginguard"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/loginhistory"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/membership"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/mfa"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/password"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/policy"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/scim"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/serviceaccount"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/usersession"
 	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
 )
 
@@ -20,14 +34,44 @@ type Resolver struct {
 	logger               *slog.Logger
 	ulidManager          *util.UlidManager
 	authorizationService authorization.Authorization
+	auditor              audit.Auditor
+	policyManager        policy.Manager
+	loginGuard           loginguard.Guard
+	groupSyncer          groupsync.Syncer
+	accessTokens         accesstoken.Service
+	serviceAccounts      serviceaccount.Service
+	invitations          invitation.Service
+	memberships          membership.Service
+	mfaService           mfa.Service
+	sessionRegistry      usersession.Registry
+	loginHistory         loginhistory.History
+	scimService          scim.Service
+	passwordHasher       password.Hasher
+	passwordPolicy       *password.Policy
+	impersonationTTL     time.Duration
 }
 
-func NewResolver(db *gorm.DB, logger *slog.Logger, ulidManager *util.UlidManager, authorizationService authorization.Authorization) *Resolver {
+func NewResolver(db *gorm.DB, logger *slog.Logger, ulidManager *util.UlidManager, authorizationService authorization.Authorization, auditor audit.Auditor, policyManager policy.Manager, loginGuard loginguard.Guard, groupSyncer groupsync.Syncer, accessTokens accesstoken.Service, serviceAccounts serviceaccount.Service, invitations invitation.Service, memberships membership.Service, mfaService mfa.Service, sessionRegistry usersession.Registry, loginHistory loginhistory.History, scimService scim.Service, passwordHasher password.Hasher, passwordPolicy *password.Policy, impersonationTTL time.Duration) *Resolver {
 	logger = logger.With("subcomponent", "graph/Resolver")
 	return &Resolver{
 		db:                   db,
 		logger:               logger,
 		ulidManager:          ulidManager,
 		authorizationService: authorizationService,
+		auditor:              auditor,
+		policyManager:        policyManager,
+		loginGuard:           loginGuard,
+		groupSyncer:          groupSyncer,
+		accessTokens:         accessTokens,
+		serviceAccounts:      serviceAccounts,
+		invitations:          invitations,
+		memberships:          memberships,
+		mfaService:           mfaService,
+		sessionRegistry:      sessionRegistry,
+		loginHistory:         loginHistory,
+		scimService:          scimService,
+		passwordHasher:       passwordHasher,
+		passwordPolicy:       passwordPolicy,
+		impersonationTTL:     impersonationTTL,
 	}
 }
@@ -6,13 +6,24 @@ package graph
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo-contrib/session"
 	echo "github.com/labstack/echo/v4"
 
 	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/accesstoken"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/audit"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/invitation"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/password"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/policy"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/scim"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/serviceaccount"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/usersession"
 	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
 )
 
@@ -27,173 +38,701 @@ func (r *mutationResolver) CreateNamespace(ctx context.Context, input model.NewN
 }
 
 const (
-	AuthorizationResourceStack = "stack"
+	AuthorizationResourceStack   = "stack"
+	AuthorizationResourceAccount = "account"
+	AuthorizationResourceUser    = "user"
+	AuthorizationResourcePolicy  = "policy"
 
-	AuthorizationActionCreate = "create"
-	AuthorizationActionRead   = "read"
+	AuthorizationActionCreate   = "create"
+	AuthorizationActionRead     = "read"
+	AuthorizationActionUpdate   = "update"
+	AuthorizationActionList     = "list"
+	AuthorizationActionRollback = "rollback"
+	AuthorizationActionUnlock   = "unlock"
+
+	AuthorizationActionImpersonate = "impersonate"
 )
 
 // CreateStack is the resolver for the createStack field.
 func (r *mutationResolver) CreateStack(ctx context.Context, input model.NewStack) (*model.Stack, error) {
-	// extract echo context
-	ec, err := util.ExtractEchoContext(ctx)
+	p, err := r.requireAccount(ctx)
 	if err != nil {
-		r.logger.Error("Error getting echo context", "error", err)
+		return nil, err
+	}
+	err = r.authorize(p, p.Account, AuthorizationResourceStack, AuthorizationActionCreate)
+	if err != nil {
+		return nil, err
+	}
+
+	// create stack
+	stack := &model.Stack{
+		Name:    input.Name,
+		Account: p.Account,
+	}
+	err = r.db.Create(stack).Error
+	if err != nil {
+		r.logger.Error("Error creating stack", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
 	}
 
-	// extract account from session
-	sess, err := session.Get(util.CookieKeySessionName, ec)
+	return stack, nil
+}
+
+// RollbackPolicy is the resolver for the rollbackPolicy field.
+func (r *mutationResolver) RollbackPolicy(ctx context.Context, version int, comment *string) (*model.PolicyVersion, error) {
+	p, err := r.requirePlatformAdmin(ctx, AuthorizationResourcePolicy, AuthorizationActionRollback)
 	if err != nil {
-		r.logger.Error("Error getting session", "error", err)
-		return nil, echo.NewHTTPError(http.StatusBadRequest, "Error getting session")
+		return nil, err
 	}
-	userID, userExists := sess.Values[util.SessionKeyUserID]
-	if !userExists {
-		r.logger.Debug("No user ID in session")
-		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+
+	newVersion, err := r.policyManager.Rollback(version, p.User.Username, derefString(comment))
+	if errors.Is(err, policy.ErrUnknownDomain) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "The version has rules for unknown accounts: "+err.Error())
 	}
-	accountID, accountExists := sess.Values[util.SessionKeyAccountID]
-	if !accountExists {
-		r.logger.Debug("No account ID in session")
-		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	if err != nil {
+		r.logger.Error("Error rolling back policy", "error", err, "version", version)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
 	}
 
-	// get user from database
-	user := &model.User{}
-	err = r.db.Where("id = ?", userID).First(user).Error
+	return toPolicyVersion(newVersion)
+}
+
+// UnlockUser is the resolver for the unlockUser field.
+func (r *mutationResolver) UnlockUser(ctx context.Context, username string) (bool, error) {
+	p, err := r.principal(ctx)
 	if err != nil {
-		r.logger.Error("Error getting user", "error", err)
+		return false, err
+	}
+
+	// get the locked out user and their account
+	target := &model.User{}
+	err = r.db.Preload("Account").Where("LOWER(username) = LOWER(?)", username).First(target).Error
+	if err != nil {
+		r.logger.Debug("Error getting user", "error", err)
+		return false, echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+
+	err = r.authorize(p, target.Account, AuthorizationResourceUser, AuthorizationActionUnlock)
+	if err != nil {
+		return false, err
+	}
+
+	err = r.loginGuard.Unlock(target.Username)
+	if err != nil {
+		r.logger.Error("Error unlocking user", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	r.logger.Info("Unlocked user", "username", target.Username, "by", p.User.Username)
+
+	return true, nil
+}
+
+// SetAccountRequireMfa is the resolver for the setAccountRequireMfa field.
+func (r *mutationResolver) SetAccountRequireMfa(ctx context.Context, required bool) (*model.Account, error) {
+	p, err := r.requireAccountAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.db.Model(p.Account).Update("require_mfa", required).Error
+	if err != nil {
+		r.logger.Error("Error updating account", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
 	}
+	r.logger.Info("Updated account mfa requirement", "account", p.Account.Name, "required", required, "by", p.User.Username)
 
-	// get account from database
-	account := &model.Account{}
-	err = r.db.Where("ulid = ?", accountID).First(account).Error
+	return p.Account, nil
+}
+
+// AddGroupRoleMapping is the resolver for the addGroupRoleMapping field.
+func (r *mutationResolver) AddGroupRoleMapping(ctx context.Context, group string, role string) (*model.GroupRoleMapping, error) {
+	p, err := r.requireAccountAdmin(ctx)
 	if err != nil {
-		r.logger.Error("Error getting account", "error", err)
+		return nil, err
+	}
+
+	mapping, err := r.groupSyncer.AddMapping(p.Account.ID, group, role)
+	if err != nil {
+		r.logger.Error("Error adding group role mapping", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
 	}
 
-	// authorization
-	hasAccess, err := r.authorizationService.IsAuthorized(user.Username, account.Name, AuthorizationResourceStack, AuthorizationActionCreate)
+	return &model.GroupRoleMapping{Group: mapping.GroupName, Role: mapping.Role}, nil
+}
+
+// RemoveGroupRoleMapping is the resolver for the removeGroupRoleMapping field.
+func (r *mutationResolver) RemoveGroupRoleMapping(ctx context.Context, group string, role string) (bool, error) {
+	p, err := r.requireAccountAdmin(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	err = r.groupSyncer.RemoveMapping(p.Account.ID, group, role)
+	if err != nil {
+		r.logger.Error("Error removing group role mapping", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return true, nil
+}
+
+// CreatePersonalAccessToken is the resolver for the createPersonalAccessToken field.
+func (r *mutationResolver) CreatePersonalAccessToken(ctx context.Context, input model.NewPersonalAccessToken) (*model.CreatedPersonalAccessToken, error) {
+	p, err := r.requireOwnSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if input.ExpiresAt != nil && input.ExpiresAt.Before(time.Now()) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Expiry is in the past")
+	}
+
+	plaintext, token, err := r.accessTokens.Create(p.User.ID, input.Name, input.Scopes, input.ExpiresAt)
+	if err != nil {
+		r.logger.Debug("Error creating access token", "error", err)
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid token")
+	}
+
+	return &model.CreatedPersonalAccessToken{
+		Token:               plaintext,
+		PersonalAccessToken: toPersonalAccessToken(token),
+	}, nil
+}
+
+// RevokePersonalAccessToken is the resolver for the revokePersonalAccessToken field.
+func (r *mutationResolver) RevokePersonalAccessToken(ctx context.Context, ulid string) (bool, error) {
+	p, err := r.requireOwnSession(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	err = r.accessTokens.Revoke(p.User.ID, ulid)
+	if errors.Is(err, accesstoken.ErrInvalidToken) {
+		return false, echo.NewHTTPError(http.StatusNotFound, "Token not found")
+	}
+	if err != nil {
+		r.logger.Error("Error revoking access token", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return true, nil
+}
+
+// CreateServiceAccount is the resolver for the createServiceAccount field.
+func (r *mutationResolver) CreateServiceAccount(ctx context.Context, input model.NewServiceAccount) (*model.ServiceAccount, error) {
+	p, err := r.requireAccountAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sa, err := r.serviceAccounts.Create(p.Account.ID, input.Name, derefString(input.Description))
 	if err != nil {
-		r.logger.Error("Error checking authorization", "error", err)
+		r.logger.Error("Error creating service account", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
 	}
-	if !hasAccess {
-		r.logger.Debug("Not authorized")
-		return nil, echo.NewHTTPError(http.StatusForbidden, "Not authorized")
+	roles := []string{}
+	if input.Roles != nil {
+		roles = input.Roles
+		err = r.serviceAccounts.SetRoles(sa, p.Account, roles, p.User.Username)
+		if err != nil {
+			r.logger.Error("Error setting service account roles", "error", err)
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+		}
 	}
+	r.logger.Info("Created service account", "serviceaccount", sa.Ulid, "account", p.Account.Name, "by", p.User.Username)
 
-	// create stack
-	stack := &model.Stack{
-		Name:    input.Name,
-		Account: account,
+	return toServiceAccount(sa, roles), nil
+}
+
+// UpdateServiceAccount is the resolver for the updateServiceAccount field.
+func (r *mutationResolver) UpdateServiceAccount(ctx context.Context, ulid string, input model.UpdateServiceAccount) (*model.ServiceAccount, error) {
+	p, err := r.requireAccountAdmin(ctx)
+	if err != nil {
+		return nil, err
 	}
-	err = r.db.Create(stack).Error
+	sa, err := r.getServiceAccount(p.Account, ulid)
 	if err != nil {
-		r.logger.Error("Error creating stack", "error", err)
+		return nil, err
+	}
+
+	name := sa.Name
+	if input.Name != nil {
+		name = *input.Name
+	}
+	description := sa.Description
+	if input.Description != nil {
+		description = *input.Description
+	}
+	err = r.serviceAccounts.Update(sa, name, description)
+	if err != nil {
+		r.logger.Error("Error updating service account", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
 	}
+	if input.Roles != nil {
+		err = r.serviceAccounts.SetRoles(sa, p.Account, input.Roles, p.User.Username)
+		if err != nil {
+			r.logger.Error("Error setting service account roles", "error", err)
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+		}
+	}
 
-	return stack, nil
+	roles, err := r.serviceAccounts.Roles(sa, p.Account)
+	if err != nil {
+		r.logger.Error("Error getting service account roles", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	return toServiceAccount(sa, roles), nil
 }
 
-// Account is the resolver for the account field.
-func (r *queryResolver) Account(ctx context.Context) (*model.Account, error) {
-	// extract echo context
+// DeleteServiceAccount is the resolver for the deleteServiceAccount field.
+func (r *mutationResolver) DeleteServiceAccount(ctx context.Context, ulid string) (bool, error) {
+	p, err := r.requireAccountAdmin(ctx)
+	if err != nil {
+		return false, err
+	}
+	sa, err := r.getServiceAccount(p.Account, ulid)
+	if err != nil {
+		return false, err
+	}
+
+	err = r.serviceAccounts.Delete(sa, p.Account, p.User.Username)
+	if err != nil {
+		r.logger.Error("Error deleting service account", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	r.logger.Info("Deleted service account", "serviceaccount", sa.Ulid, "account", p.Account.Name, "by", p.User.Username)
+
+	return true, nil
+}
+
+// CreateServiceAccountKey is the resolver for the createServiceAccountKey field.
+func (r *mutationResolver) CreateServiceAccountKey(ctx context.Context, serviceAccount string, name string, expiresAt *time.Time) (*model.CreatedServiceAccountKey, error) {
+	p, err := r.requireAccountAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sa, err := r.getServiceAccount(p.Account, serviceAccount)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt != nil && expiresAt.Before(time.Now()) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Expiry is in the past")
+	}
+
+	plaintext, key, err := r.serviceAccounts.CreateKey(sa, name, expiresAt)
+	if err != nil {
+		r.logger.Error("Error creating service account key", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return &model.CreatedServiceAccountKey{
+		Key:               plaintext,
+		ServiceAccountKey: toServiceAccountKey(key),
+	}, nil
+}
+
+// RevokeServiceAccountKey is the resolver for the revokeServiceAccountKey field.
+func (r *mutationResolver) RevokeServiceAccountKey(ctx context.Context, ulid string) (bool, error) {
+	p, err := r.requireAccountAdmin(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	err = r.serviceAccounts.RevokeKey(p.Account.ID, ulid)
+	if errors.Is(err, serviceaccount.ErrInvalidKey) {
+		return false, echo.NewHTTPError(http.StatusNotFound, "Key not found")
+	}
+	if err != nil {
+		r.logger.Error("Error revoking service account key", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return true, nil
+}
+
+// InviteUser is the resolver for the inviteUser field.
+func (r *mutationResolver) InviteUser(ctx context.Context, email string, role string) (*model.Invitation, error) {
+	p, err := r.requireAccountAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	inv, err := r.invitations.Invite(p.Account, email, role, p.User.Username)
+	if errors.Is(err, invitation.ErrInvalidEmail) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid email address")
+	}
+	if err != nil {
+		r.logger.Error("Error inviting user", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return toInvitation(inv), nil
+}
+
+// RevokeInvitation is the resolver for the revokeInvitation field.
+func (r *mutationResolver) RevokeInvitation(ctx context.Context, ulid string) (bool, error) {
+	p, err := r.requireAccountAdmin(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	err = r.invitations.Revoke(p.Account.ID, ulid)
+	if errors.Is(err, invitation.ErrInvalidInvitation) {
+		return false, echo.NewHTTPError(http.StatusNotFound, "Invitation not found")
+	}
+	if err != nil {
+		r.logger.Error("Error revoking invitation", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return true, nil
+}
+
+// SwitchAccount is the resolver for the switchAccount field.
+func (r *mutationResolver) SwitchAccount(ctx context.Context, ulid string) (*model.Account, error) {
+	p, err := r.requireSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := []*model.Account{}
+	err = r.db.Where("ulid = ?", ulid).Limit(1).Find(&accounts).Error
+	if err != nil {
+		r.logger.Error("Error getting account", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	isMember := false
+	if len(accounts) > 0 {
+		isMember, err = r.memberships.IsMember(p.User.ID, accounts[0].ID)
+		if err != nil {
+			r.logger.Error("Error checking membership", "error", err)
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+		}
+	}
+	if !isMember {
+		// unknown accounts and accounts of others look the same
+		r.logger.Debug("Not a member", "username", p.User.Username, "account", ulid)
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Account not found")
+	}
+	// the account's second factor requirement applies to users switching into it, not only to logins
+	if accounts[0].RequireMfa {
+		mfaEnabled, err := r.mfaService.IsEnabled(p.User.ID)
+		if err != nil {
+			r.logger.Error("Error checking mfa", "error", err)
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+		}
+		if !mfaEnabled {
+			r.logger.Debug("Account requires mfa", "username", p.User.Username, "account", accounts[0].Name)
+			return nil, echo.NewHTTPError(http.StatusForbidden, "The account requires two-factor authentication, enable it before switching")
+		}
+	}
+
+	// rewrite the session's account
 	ec, err := util.ExtractEchoContext(ctx)
 	if err != nil {
 		r.logger.Error("Error getting echo context", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
 	}
-
-	// extract user and accouant from session
 	sess, err := session.Get(util.CookieKeySessionName, ec)
 	if err != nil {
 		r.logger.Error("Error getting session", "error", err)
 		return nil, echo.NewHTTPError(http.StatusBadRequest, "Error getting session")
 	}
-	userID, userExists := sess.Values[util.SessionKeyUserID]
-	if !userExists {
-		r.logger.Debug("No user ID in session")
-		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	sess.Values[util.SessionKeyAccountID] = accounts[0].Ulid
+	err = sess.Save(ec.Request(), ec.Response())
+	if err != nil {
+		r.logger.Error("Error saving session", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	r.logger.Debug("Switched account", "username", p.User.Username, "account", accounts[0].Name)
+
+	return accounts[0], nil
+}
+
+// RevokeSession is the resolver for the revokeSession field.
+func (r *mutationResolver) RevokeSession(ctx context.Context, id string) (bool, error) {
+	p, err := r.requireOwnSession(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	err = r.sessionRegistry.RevokeForUser(p.User.ID, id)
+	if errors.Is(err, usersession.ErrNotFound) {
+		return false, echo.NewHTTPError(http.StatusNotFound, "Session not found")
 	}
-	r.logger.Debug("Got user ID from session", "userID", userID)
-	accountID, accountExists := sess.Values[util.SessionKeyAccountID]
-	if !accountExists {
-		r.logger.Debug("No account ID in session")
-		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	if err != nil {
+		r.logger.Error("Error revoking session", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
 	}
+	r.logger.Debug("Revoked session", "username", p.User.Username, "session", id)
 
-	return &model.Account{
-		Ulid: accountID.(string),
-	}, nil
+	return true, nil
 }
 
-// Namespaces is the resolver for the namespaces field.
-func (r *queryResolver) Namespaces(ctx context.Context) ([]*model.Namespace, error) {
-	panic(fmt.Errorf("not implemented: Namespaces - namespaces"))
+// RevokeOtherSessions is the resolver for the revokeOtherSessions field.
+func (r *mutationResolver) RevokeOtherSessions(ctx context.Context) (int, error) {
+	p, err := r.requireOwnSession(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked, err := r.sessionRegistry.RevokeOthersForUser(p.User.ID, p.CredentialID)
+	if err != nil {
+		r.logger.Error("Error revoking sessions", "error", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	r.logger.Debug("Revoked other sessions", "username", p.User.Username, "count", revoked)
+
+	return int(revoked), nil
 }
 
-// Stacks is the resolver for the stacks field.
-func (r *queryResolver) Stacks(ctx context.Context) ([]*model.Stack, error) {
-	// extract echo context
+// ChangePassword is the resolver for the changePassword field.
+func (r *mutationResolver) ChangePassword(ctx context.Context, currentPassword string, newPassword string) (bool, error) {
+	p, err := r.requireOwnSession(ctx)
+	if err != nil {
+		return false, err
+	}
 	ec, err := util.ExtractEchoContext(ctx)
 	if err != nil {
 		r.logger.Error("Error getting echo context", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+
+	// guessing the current password with a stolen session is throttled like logins
+	ip := ec.RealIP()
+	wait, err := r.loginGuard.Check(p.User.Username, ip)
+	if err != nil {
+		r.logger.Error("Error checking login throttle", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	if wait > 0 {
+		return false, echo.NewHTTPError(http.StatusTooManyRequests, "Too many failed attempts, try again later")
+	}
+	match, err := r.passwordHasher.Verify(currentPassword, p.User.Password)
+	if err != nil {
+		r.logger.Error("Error verifying password", "error", err)
+	}
+	if !match {
+		err = r.loginGuard.RecordFailure(p.User.Username, ip)
+		if err != nil {
+			r.logger.Error("Error recording login failure", "error", err)
+		}
+		return false, echo.NewHTTPError(http.StatusBadRequest, "Current password is wrong")
+	}
+
+	err = r.passwordPolicy.Check(newPassword, p.User.Username)
+	var violation *password.Violation
+	if errors.As(err, &violation) {
+		return false, echo.NewHTTPError(http.StatusBadRequest, violation.Reason)
+	}
+	if err != nil {
+		r.logger.Error("Error checking password policy", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+
+	hashedPassword, err := r.passwordHasher.Hash(newPassword)
+	if err != nil {
+		r.logger.Error("Error hashing password", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	// only replaces the verified password, a concurrent change wins
+	result := r.db.Model(p.User).Where("password = ?", p.User.Password).Update("password", hashedPassword)
+	if result.Error != nil {
+		r.logger.Error("Error updating password", "error", result.Error)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	if result.RowsAffected == 0 {
+		return false, echo.NewHTTPError(http.StatusConflict, "The password was changed concurrently")
+	}
+
+	// other sessions may belong to whoever knew the old password
+	_, err = r.sessionRegistry.RevokeOthersForUser(p.User.ID, p.CredentialID)
+	if err != nil {
+		r.logger.Error("Error revoking sessions", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	r.logger.Info("Changed password", "username", p.User.Username)
+
+	return true, nil
+}
+
+// StartImpersonation is the resolver for the startImpersonation field.
+func (r *mutationResolver) StartImpersonation(ctx context.Context, username string) (*model.Impersonation, error) {
+	p, err := r.requireSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	admin := p.User
+	if p.IsImpersonated() {
+		return nil, echo.NewHTTPError(http.StatusConflict, "Already impersonating a user, stop the impersonation first")
+	}
+	_, err = r.requirePlatformAdmin(ctx, AuthorizationResourceUser, AuthorizationActionImpersonate)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []*model.User{}
+	err = r.db.Preload("Account").Where("LOWER(username) = LOWER(?)", username).Limit(1).Find(&users).Error
+	if err != nil {
+		r.logger.Error("Error getting user", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
 	}
+	if len(users) == 0 {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+	target := users[0]
+	if target.ID == admin.ID {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Can't impersonate yourself")
+	}
+	if r.authorizationService.IsPlatformAdmin(target.Username) {
+		// impersonation must not be a way to act with another admin's permissions
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Platform admins can't be impersonated")
+	}
 
-	// extract account from session
+	ec, err := util.ExtractEchoContext(ctx)
+	if err != nil {
+		r.logger.Error("Error getting echo context", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
 	sess, err := session.Get(util.CookieKeySessionName, ec)
 	if err != nil {
 		r.logger.Error("Error getting session", "error", err)
 		return nil, echo.NewHTTPError(http.StatusBadRequest, "Error getting session")
 	}
-	userID, userExists := sess.Values[util.SessionKeyUserID]
-	if !userExists {
-		r.logger.Debug("No user ID in session")
-		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	until := time.Now().Add(r.impersonationTTL)
+	util.StartImpersonation(sess, target.ID, target.Account.Ulid, until)
+	// the session acts as another user, it gets a new ID like on login
+	err = usersession.Renew(sess)
+	if err != nil {
+		r.logger.Error("Error renewing session", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
 	}
-	accountID, accountExists := sess.Values[util.SessionKeyAccountID]
-	if !accountExists {
-		r.logger.Debug("No account ID in session")
-		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Not logged in")
+	err = sess.Save(ec.Request(), ec.Response())
+	if err != nil {
+		r.logger.Error("Error saving session", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
 	}
-
-	// get user from database
-	user := &model.User{}
-	err = r.db.Where("id = ?", userID).First(user).Error
+	err = r.auditor.Record(&audit.Event{
+		Actor:        target.Username,
+		ActorType:    audit.ActorTypeUser,
+		Domain:       target.Account.Ulid,
+		Resource:     AuthorizationResourceUser,
+		Action:       AuthorizationActionImpersonate,
+		Reason:       audit.ReasonImpersonation,
+		Impersonator: admin.Username,
+	})
 	if err != nil {
-		r.logger.Error("Error getting user", "error", err)
+		r.logger.Error("Error recording audit event", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
 	}
+	r.logger.Info("Started impersonation", "username", target.Username, "by", admin.Username, "until", until)
+
+	return &model.Impersonation{User: target, Impersonator: admin, ExpiresAt: until}, nil
+}
+
+// StopImpersonation is the resolver for the stopImpersonation field.
+func (r *mutationResolver) StopImpersonation(ctx context.Context) (bool, error) {
+	p, err := r.principal(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !p.IsImpersonated() {
+		return false, echo.NewHTTPError(http.StatusBadRequest, "Not impersonating a user")
+	}
 
-	// get account from database
-	account := &model.Account{}
-	err = r.db.Where("ulid = ?", accountID).First(account).Error
+	ec, err := util.ExtractEchoContext(ctx)
 	if err != nil {
-		r.logger.Error("Error getting account", "error", err)
-		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+		r.logger.Error("Error getting echo context", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	sess, err := session.Get(util.CookieKeySessionName, ec)
+	if err != nil {
+		r.logger.Error("Error getting session", "error", err)
+		return false, echo.NewHTTPError(http.StatusBadRequest, "Error getting session")
 	}
+	util.EndImpersonation(sess)
+	// the session acts as another user, it gets a new ID like on login
+	err = usersession.Renew(sess)
+	if err != nil {
+		r.logger.Error("Error renewing session", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	err = sess.Save(ec.Request(), ec.Response())
+	if err != nil {
+		r.logger.Error("Error saving session", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	r.logger.Info("Stopped impersonation", "userid", sess.Values[util.SessionKeyUserID])
 
-	// authorization
-	hasAccess, err := r.authorizationService.IsAuthorized(user.Username, account.Name, AuthorizationResourceStack, AuthorizationActionRead)
+	return true, nil
+}
+
+// CreateScimToken is the resolver for the createScimToken field.
+func (r *mutationResolver) CreateScimToken(ctx context.Context, name string) (*model.CreatedScimToken, error) {
+	p, err := r.requireAccountAdmin(ctx)
 	if err != nil {
-		r.logger.Error("Error checking authorization", "error", err)
+		return nil, err
+	}
+
+	plaintext, token, err := r.scimService.CreateToken(p.Account.ID, name)
+	if err != nil {
+		r.logger.Error("Error creating scim token", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
 	}
-	if !hasAccess {
-		r.logger.Debug("Not authorized", "username", user.Username, "account", account.Name, "resource", AuthorizationResourceStack, "action", AuthorizationActionRead)
-		return nil, echo.NewHTTPError(http.StatusForbidden, "Not authorized")
+
+	return &model.CreatedScimToken{
+		Token:     plaintext,
+		ScimToken: toScimToken(token),
+	}, nil
+}
+
+// RevokeScimToken is the resolver for the revokeScimToken field.
+func (r *mutationResolver) RevokeScimToken(ctx context.Context, ulid string) (bool, error) {
+	p, err := r.requireAccountAdmin(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	err = r.scimService.RevokeToken(p.Account.ID, ulid)
+	if errors.Is(err, scim.ErrInvalidToken) {
+		return false, echo.NewHTTPError(http.StatusNotFound, "Token not found")
+	}
+	if err != nil {
+		r.logger.Error("Error revoking scim token", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return true, nil
+}
+
+// Account is the resolver for the account field.
+func (r *queryResolver) Account(ctx context.Context) (*model.Account, error) {
+	p, err := r.requireAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Account, nil
+}
+
+// Namespaces is the resolver for the namespaces field.
+func (r *queryResolver) Namespaces(ctx context.Context) ([]*model.Namespace, error) {
+	panic(fmt.Errorf("not implemented: Namespaces - namespaces"))
+}
+
+// Stacks is the resolver for the stacks field.
+func (r *queryResolver) Stacks(ctx context.Context) ([]*model.Stack, error) {
+	p, err := r.requireAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = r.authorize(p, p.Account, AuthorizationResourceStack, AuthorizationActionRead)
+	if err != nil {
+		return nil, err
 	}
-	r.logger.Debug("Authorized to get stacks")
 
 	// get stack
 	stacks := []*model.Stack{}
-	err = r.db.Where("account_id = ?", account.ID).Find(&stacks).Error
+	err = r.db.Where("account_id = ?", p.Account.ID).Find(&stacks).Error
 	if err != nil {
 		r.logger.Error("Error getting stack", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
@@ -202,6 +741,307 @@ func (r *queryResolver) Stacks(ctx context.Context) ([]*model.Stack, error) {
 	return stacks, nil
 }
 
+// PlatformAccounts is the resolver for the platformAccounts field.
+func (r *queryResolver) PlatformAccounts(ctx context.Context) ([]*model.Account, error) {
+	_, err := r.requirePlatformAdmin(ctx, AuthorizationResourceAccount, AuthorizationActionList)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := []*model.Account{}
+	err = r.db.Order("id").Find(&accounts).Error
+	if err != nil {
+		r.logger.Error("Error getting accounts", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return accounts, nil
+}
+
+// PlatformUsers is the resolver for the platformUsers field.
+func (r *queryResolver) PlatformUsers(ctx context.Context) ([]*model.User, error) {
+	_, err := r.requirePlatformAdmin(ctx, AuthorizationResourceUser, AuthorizationActionList)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []*model.User{}
+	err = r.db.Preload("Account").Order("id").Find(&users).Error
+	if err != nil {
+		r.logger.Error("Error getting users", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return users, nil
+}
+
+// PolicyVersions is the resolver for the policyVersions field.
+func (r *queryResolver) PolicyVersions(ctx context.Context) ([]*model.PolicyVersion, error) {
+	_, err := r.requirePlatformAdmin(ctx, AuthorizationResourcePolicy, AuthorizationActionList)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := r.policyManager.Versions()
+	if err != nil {
+		r.logger.Error("Error getting policy versions", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+
+	policyVersions := []*model.PolicyVersion{}
+	for _, v := range versions {
+		policyVersion, err := toPolicyVersion(v)
+		if err != nil {
+			return nil, err
+		}
+		policyVersions = append(policyVersions, policyVersion)
+	}
+
+	return policyVersions, nil
+}
+
+// GroupRoleMappings is the resolver for the groupRoleMappings field.
+func (r *queryResolver) GroupRoleMappings(ctx context.Context) ([]*model.GroupRoleMapping, error) {
+	p, err := r.requireAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = r.authorize(p, p.Account, AuthorizationResourceAccount, AuthorizationActionRead)
+	if err != nil {
+		return nil, err
+	}
+
+	mappings, err := r.groupSyncer.Mappings(p.Account.ID)
+	if err != nil {
+		r.logger.Error("Error getting group role mappings", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+
+	groupRoleMappings := []*model.GroupRoleMapping{}
+	for _, m := range mappings {
+		groupRoleMappings = append(groupRoleMappings, &model.GroupRoleMapping{Group: m.GroupName, Role: m.Role})
+	}
+
+	return groupRoleMappings, nil
+}
+
+// PersonalAccessTokens is the resolver for the personalAccessTokens field.
+func (r *queryResolver) PersonalAccessTokens(ctx context.Context) ([]*model.PersonalAccessToken, error) {
+	p, err := r.principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := r.accessTokens.List(p.User.ID)
+	if err != nil {
+		r.logger.Error("Error listing access tokens", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	result := []*model.PersonalAccessToken{}
+	for _, t := range tokens {
+		result = append(result, toPersonalAccessToken(t))
+	}
+
+	return result, nil
+}
+
+// ServiceAccounts is the resolver for the serviceAccounts field.
+func (r *queryResolver) ServiceAccounts(ctx context.Context) ([]*model.ServiceAccount, error) {
+	p, err := r.requireAccountAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceAccounts, err := r.serviceAccounts.List(p.Account.ID)
+	if err != nil {
+		r.logger.Error("Error listing service accounts", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	result := []*model.ServiceAccount{}
+	for _, sa := range serviceAccounts {
+		roles, err := r.serviceAccounts.Roles(sa, p.Account)
+		if err != nil {
+			r.logger.Error("Error getting service account roles", "error", err)
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+		}
+		result = append(result, toServiceAccount(sa, roles))
+	}
+
+	return result, nil
+}
+
+// ServiceAccountKeys is the resolver for the serviceAccountKeys field.
+func (r *queryResolver) ServiceAccountKeys(ctx context.Context, serviceAccount string) ([]*model.ServiceAccountKey, error) {
+	p, err := r.requireAccountAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sa, err := r.getServiceAccount(p.Account, serviceAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := r.serviceAccounts.Keys(sa)
+	if err != nil {
+		r.logger.Error("Error listing service account keys", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	result := []*model.ServiceAccountKey{}
+	for _, k := range keys {
+		result = append(result, toServiceAccountKey(k))
+	}
+
+	return result, nil
+}
+
+// Invitations is the resolver for the invitations field.
+func (r *queryResolver) Invitations(ctx context.Context) ([]*model.Invitation, error) {
+	p, err := r.requireAccountAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	invitations, err := r.invitations.Pending(p.Account.ID)
+	if err != nil {
+		r.logger.Error("Error listing invitations", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	result := []*model.Invitation{}
+	for _, inv := range invitations {
+		result = append(result, toInvitation(inv))
+	}
+
+	return result, nil
+}
+
+// Memberships is the resolver for the memberships field.
+func (r *queryResolver) Memberships(ctx context.Context) ([]*model.Membership, error) {
+	p, err := r.principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	memberships, err := r.memberships.Memberships(p.User.ID)
+	if err != nil {
+		r.logger.Error("Error listing memberships", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	result := []*model.Membership{}
+	for _, m := range memberships {
+		result = append(result, &model.Membership{
+			Account:   m.Account,
+			Current:   p.Account != nil && m.AccountID == p.Account.ID,
+			CreatedAt: m.CreatedAt,
+		})
+	}
+
+	return result, nil
+}
+
+// Sessions is the resolver for the sessions field.
+func (r *queryResolver) Sessions(ctx context.Context) ([]*model.Session, error) {
+	p, err := r.requireSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := r.sessionRegistry.ListForUser(p.User.ID)
+	if err != nil {
+		r.logger.Error("Error listing sessions", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	result := []*model.Session{}
+	for _, s := range sessions {
+		result = append(result, &model.Session{
+			ID:         s.Ulid,
+			Device:     usersession.Device(s.UserAgent),
+			IP:         s.IP,
+			UserAgent:  s.UserAgent,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			Current:    s.Ulid == p.CredentialID,
+		})
+	}
+
+	return result, nil
+}
+
+// Impersonation is the resolver for the impersonation field.
+func (r *queryResolver) Impersonation(ctx context.Context) (*model.Impersonation, error) {
+	return r.sessionImpersonation(ctx)
+}
+
+// LoginHistory is the resolver for the loginHistory field.
+func (r *queryResolver) LoginHistory(ctx context.Context, username *string, limit *int) ([]*model.LoginEvent, error) {
+	p, err := r.principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p.Type == util.PrincipalTypeServiceAccount {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Service accounts have no login history")
+	}
+
+	// own history unless another user is asked for
+	target := p.User
+	if username != nil && !strings.EqualFold(*username, p.User.Username) {
+		target = &model.User{}
+		err = r.db.Preload("Account").Where("LOWER(username) = LOWER(?)", *username).First(target).Error
+		if err != nil {
+			r.logger.Debug("Error getting user", "error", err)
+			return nil, echo.NewHTTPError(http.StatusNotFound, "User not found")
+		}
+		// platform admins are authorized in every account, their reads of other accounts are audited
+		err = r.authorize(p, target.Account, AuthorizationResourceUser, AuthorizationActionRead)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	n := 0
+	if limit != nil {
+		n = *limit
+	}
+	events, err := r.loginHistory.ForUser(target.ID, n)
+	if err != nil {
+		r.logger.Error("Error listing login history", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	result := []*model.LoginEvent{}
+	for _, e := range events {
+		result = append(result, &model.LoginEvent{
+			CreatedAt: e.CreatedAt,
+			Username:  e.Username,
+			IP:        e.IP,
+			UserAgent: e.UserAgent,
+			Method:    e.Method,
+			Outcome:   e.Outcome,
+			Reason:    e.Reason,
+		})
+	}
+
+	return result, nil
+}
+
+// ScimTokens is the resolver for the scimTokens field.
+func (r *queryResolver) ScimTokens(ctx context.Context) ([]*model.ScimToken, error) {
+	p, err := r.requireAccountAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := r.scimService.Tokens(p.Account.ID)
+	if err != nil {
+		r.logger.Error("Error listing scim tokens", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	result := []*model.ScimToken{}
+	for _, t := range tokens {
+		result = append(result, toScimToken(t))
+	}
+
+	return result, nil
+}
+
 // Mutation returns MutationResolver implementation.
 func (r *Resolver) Mutation() MutationResolver { return &mutationResolver{r} }
 
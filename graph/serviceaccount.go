@@ -0,0 +1,24 @@
+package graph
+
+import (
+	"net/http"
+
+	echo "github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/serviceaccount"
+)
+
+// getServiceAccount loads a service account of the account, errors are safe to return to the client
+func (r *Resolver) getServiceAccount(account *model.Account, ulid string) (*serviceaccount.ServiceAccount, error) {
+	sa, err := r.serviceAccounts.Get(account.ID, ulid)
+	if errors.Is(err, serviceaccount.ErrNotFound) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Service account not found")
+	}
+	if err != nil {
+		r.logger.Error("Error getting service account", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal server error")
+	}
+	return sa, nil
+}
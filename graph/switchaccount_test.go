@@ -0,0 +1,86 @@
+package graph
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	echo "github.com/labstack/echo/v4"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/membership"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/mfa"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+type fakeMfa struct {
+	mfa.Service
+	enabled bool
+}
+
+func (m *fakeMfa) IsEnabled(userID uint) (bool, error) {
+	return m.enabled, nil
+}
+
+func TestSwitchAccountRequiresMfa(t *testing.T) {
+	tests := []struct {
+		name       string
+		requireMfa bool
+		mfaEnabled bool
+		wantStatus int
+	}{
+		{name: "account without the requirement"},
+		{name: "required and enabled", requireMfa: true, mfaEnabled: true},
+		{name: "required but not enabled", requireMfa: true, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Open(t)
+			acme := dbtest.Account(t, db, "acme")
+			other := dbtest.Account(t, db, "other")
+			err := db.Model(other).Update("require_mfa", tt.requireMfa).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+			jane := dbtest.User(t, db, acme, "jane@example.com")
+			dbtest.Member(t, db, jane, other)
+
+			r := &mutationResolver{&Resolver{
+				db:          db,
+				logger:      dbtest.Logger(),
+				memberships: membership.NewDbService(db, dbtest.Logger()),
+				mfaService:  &fakeMfa{enabled: tt.mfaEnabled},
+			}}
+			p := &util.Principal{Type: util.PrincipalTypeSession, User: jane, Account: acme}
+
+			// the resolver rewrites the session of the request's echo context
+			store := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/query", nil), httptest.NewRecorder())
+			var account *model.Account
+			err = session.Middleware(store)(func(c echo.Context) error {
+				ctx := context.WithValue(util.ContextWithPrincipal(context.Background(), p), util.CtxKeyEchoContext, c)
+				account, err = r.SwitchAccount(ctx, other.Ulid)
+				return err
+			})(c)
+
+			if tt.wantStatus != 0 {
+				httpErr, ok := err.(*echo.HTTPError)
+				if !ok || httpErr.Code != tt.wantStatus {
+					t.Fatalf("got %v, want a %d error", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if account.Ulid != other.Ulid {
+				t.Errorf("switched to %s, want %s", account.Ulid, other.Ulid)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package accesstoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+// TokenPrefix makes tokens recognizable, e.g. by secret scanners
+const TokenPrefix = "pat_"
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Token is a personal access token, only a hash of the secret is stored
+type Token struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	Ulid       string
+	UserID     uint
+	Name       string
+	TokenHash  string
+	Scopes     string // comma separated "resource:action", empty means all permissions of the owner
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (Token) TableName() string {
+	return "personal_access_tokens"
+}
+
+func (t *Token) ScopeList() []string {
+	if t.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(t.Scopes, ",")
+}
+
+// Allows returns true if the token's scopes include the action on the resource
+func (t *Token) Allows(resource string, action string) bool {
+	if t.Scopes == "" {
+		return true
+	}
+	for _, scope := range t.ScopeList() {
+		if scope == resource+":"+action || scope == resource+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+type Service interface {
+	// Creates a token, the plain text token is only returned here
+	Create(userID uint, name string, scopes []string, expiresAt *time.Time) (string, *Token, error)
+	// Returns the tokens of the user which are not revoked
+	List(userID uint) ([]*Token, error)
+	// Revokes a token of the user
+	Revoke(userID uint, ulid string) error
+	// Returns the token if it's valid, not expired and not revoked.
+	// LastUsedAt of the returned token is the use before this one.
+	Authenticate(plaintext string) (*Token, error)
+}
+
+var _ Service = &DbService{}
+
+type DbService struct {
+	db          *gorm.DB
+	logger      *slog.Logger
+	ulidManager *util.UlidManager
+}
+
+func NewDbService(db *gorm.DB, logger *slog.Logger, ulidManager *util.UlidManager) *DbService {
+	return &DbService{db: db, logger: logger.With("subcomponent", "accesstoken/DbService"), ulidManager: ulidManager}
+}
+
+func (s *DbService) Create(userID uint, name string, scopes []string, expiresAt *time.Time) (string, *Token, error) {
+	for _, scope := range scopes {
+		if !strings.Contains(scope, ":") || strings.Contains(scope, ",") {
+			return "", nil, errors.Errorf("invalid scope %q, expected resource:action", scope)
+		}
+	}
+
+	plaintext, err := Generate(TokenPrefix)
+	if err != nil {
+		return "", nil, err
+	}
+	token := &Token{
+		Ulid:      s.ulidManager.NewULID().String(),
+		UserID:    userID,
+		Name:      name,
+		TokenHash: Hash(plaintext),
+		Scopes:    strings.Join(scopes, ","),
+		ExpiresAt: expiresAt,
+	}
+	err = s.db.Create(token).Error
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to create token")
+	}
+	s.logger.Info("created access token", "userid", userID, "token", token.Ulid)
+	return plaintext, token, nil
+}
+
+func (s *DbService) List(userID uint) ([]*Token, error) {
+	tokens := []*Token{}
+	err := s.db.Where("user_id = ? AND revoked_at IS NULL", userID).Order("id").Find(&tokens).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list tokens")
+	}
+	return tokens, nil
+}
+
+func (s *DbService) Revoke(userID uint, ulid string) error {
+	result := s.db.Model(&Token{}).
+		Where("user_id = ? AND ulid = ? AND revoked_at IS NULL", userID, ulid).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "failed to revoke token")
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidToken
+	}
+	s.logger.Info("revoked access token", "userid", userID, "token", ulid)
+	return nil
+}
+
+func (s *DbService) Authenticate(plaintext string) (*Token, error) {
+	if !strings.HasPrefix(plaintext, TokenPrefix) {
+		return nil, ErrInvalidToken
+	}
+	tokens := []*Token{}
+	err := s.db.
+		Where("token_hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", Hash(plaintext), time.Now()).
+		Limit(1).
+		Find(&tokens).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get token")
+	}
+	if len(tokens) == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	err = s.db.Model(&Token{}).Where("id = ?", tokens[0].ID).Update("last_used_at", time.Now()).Error
+	if err != nil {
+		s.logger.Error("failed to update token last use", "err", err)
+	}
+	return tokens[0], nil
+}
+
+// Generate returns a random secret with the prefix
+func Generate(prefix string) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to generate token")
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Hash uses a plain hash, tokens are random so a slow hash is not needed
+func Hash(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
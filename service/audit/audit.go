@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	ActorTypeUser           = "user"
+	ActorTypeServiceAccount = "service_account"
+	// ActorTypeScim is a directory which provisions users and groups through SCIM
+	ActorTypeScim = "scim"
+
+	// ReasonPlatformAdmin marks actions a platform admin performed outside of the accounts they belong to
+	ReasonPlatformAdmin = "platform_admin"
+	// ReasonImpersonation marks actions taken in an impersonation session, the actor is the impersonated user
+	ReasonImpersonation = "impersonation"
+
+	// DomainGlobal is used for actions which are not scoped to a single account
+	DomainGlobal = "*"
+)
+
+type Event struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	Actor     string
+	ActorType string
+	Domain    string
+	Resource  string
+	Action    string
+	Reason    string
+	// Username of the platform admin who impersonated the actor, if any
+	Impersonator string
+}
+
+func (Event) TableName() string {
+	return "audit_events"
+}
+
+type Auditor interface {
+	// Records an audit event, the event is persisted before the call returns
+	Record(event *Event) error
+}
+
+var _ Auditor = &DbAuditor{}
+
+type DbAuditor struct {
+	db     *gorm.DB
+	logger *slog.Logger
+}
+
+func NewDbAuditor(db *gorm.DB, logger *slog.Logger) *DbAuditor {
+	return &DbAuditor{db: db, logger: logger.With("subcomponent", "audit/DbAuditor")}
+}
+
+func (a *DbAuditor) Record(event *Event) error {
+	a.logger.Info("audit event",
+		"actor", event.Actor,
+		"actorType", event.ActorType,
+		"domain", event.Domain,
+		"resource", event.Resource,
+		"action", event.Action,
+		"reason", event.Reason,
+		"impersonator", event.Impersonator,
+	)
+	return a.db.Create(event).Error
+}
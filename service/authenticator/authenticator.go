@@ -0,0 +1,23 @@
+package authenticator
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/identity"
+)
+
+var (
+	// ErrUnknownUser and ErrWrongPassword are reported to clients alike, they only differ in the login history
+	ErrUnknownUser   = errors.New("unknown user")
+	ErrWrongPassword = errors.New("wrong password")
+	// ErrUsernameTaken is returned when a directory user would take over the username of a local user
+	ErrUsernameTaken = identity.ErrUsernameTaken
+)
+
+// Authenticator checks the username and password of a login
+type Authenticator interface {
+	// Returns the user if the password is correct, with the user's account preloaded.
+	// Users of an external directory are created on their first login.
+	Authenticate(username string, password string) (*model.User, error)
+}
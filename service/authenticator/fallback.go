@@ -0,0 +1,34 @@
+package authenticator
+
+import (
+	"log/slog"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+)
+
+var _ Authenticator = &LocalFallback{}
+
+// LocalFallback checks users with a local password against their hash and everyone else against the directory,
+// so that local users such as platform admins keep logging in when a directory is the login backend
+type LocalFallback struct {
+	local     *Local
+	directory Authenticator
+	logger    *slog.Logger
+}
+
+func NewLocalFallback(local *Local, directory Authenticator, logger *slog.Logger) *LocalFallback {
+	return &LocalFallback{local: local, directory: directory, logger: logger.With("subcomponent", "authenticator/LocalFallback")}
+}
+
+func (a *LocalFallback) Authenticate(username string, password string) (*model.User, error) {
+	u, err := a.local.find(username)
+	if err != nil {
+		return nil, err
+	}
+	// the password of a local user never reaches the directory
+	if u != nil && u.Password != "" {
+		a.logger.Debug("local login", "username", u.Username)
+		return a.local.verify(u, password)
+	}
+	return a.directory.Authenticate(username, password)
+}
@@ -0,0 +1,214 @@
+package authenticator
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/errors"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/groupsync"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/identity"
+)
+
+// LdapConfig describes how users and their groups are found in the directory.
+// In filters {username} is replaced with the login name and {dn} with the user's DN, both escaped.
+type LdapConfig struct {
+	// URL of the server, ldap:// or ldaps://
+	URL string
+	// StartTLS upgrades an ldap:// connection before any credentials are sent
+	StartTLS bool
+	// BindDN and BindPassword are used to search, without them users are searched anonymously and groups as the user
+	BindDN       string
+	BindPassword string
+
+	UserBaseDN string
+	UserFilter string
+	// UsernameAttribute holds the username of provisioned users, e.g. uid or sAMAccountName
+	UsernameAttribute string
+
+	// GroupBaseDN enables group sync, the user's groups are mapped to roles like directory groups on SSO login
+	GroupBaseDN        string
+	GroupFilter        string
+	GroupNameAttribute string
+
+	Timeout time.Duration
+}
+
+var _ Authenticator = &Ldap{}
+
+// Ldap checks passwords by binding as the user, users are provisioned on their first login
+type Ldap struct {
+	config      LdapConfig
+	tlsConfig   *tls.Config
+	logger      *slog.Logger
+	provisioner identity.Provisioner
+	groupSyncer groupsync.Syncer
+}
+
+func NewLdap(config LdapConfig, logger *slog.Logger, provisioner identity.Provisioner, groupSyncer groupsync.Syncer) (*Ldap, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+		return nil, errors.Errorf("invalid ldap url %q", config.URL)
+	}
+	if config.UserBaseDN == "" {
+		return nil, errors.New("the ldap user base DN is required")
+	}
+	if !strings.Contains(config.UserFilter, "{username}") {
+		return nil, errors.New("the ldap user filter must contain {username}")
+	}
+	if config.UsernameAttribute == "" {
+		return nil, errors.New("the ldap username attribute is required")
+	}
+	if config.GroupBaseDN != "" && config.GroupNameAttribute == "" {
+		return nil, errors.New("the ldap group name attribute is required for group sync")
+	}
+
+	return &Ldap{
+		config:      config,
+		tlsConfig:   &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12},
+		logger:      logger.With("subcomponent", "authenticator/Ldap"),
+		provisioner: provisioner,
+		groupSyncer: groupSyncer,
+	}, nil
+}
+
+func (a *Ldap) Authenticate(username string, password string) (*model.User, error) {
+	// a bind with an empty password is an anonymous bind which most servers accept
+	if password == "" {
+		return nil, ErrWrongPassword
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := a.findUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrWrongPassword
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to bind as user")
+	}
+
+	directoryUsername := entry.GetAttributeValue(a.config.UsernameAttribute)
+	if directoryUsername == "" {
+		return nil, errors.Errorf("ldap entry %q has no %s attribute", entry.DN, a.config.UsernameAttribute)
+	}
+	// the directory doesn't vouch for the username of a local user, so local users are not taken over
+	user, err := a.provisioner.Provision(&identity.ExternalUser{
+		Provider: a.config.URL,
+		Subject:  strings.ToLower(directoryUsername),
+		Username: directoryUsername,
+		Verified: false,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if a.config.GroupBaseDN != "" {
+		groups, err := a.findGroups(conn, entry.DN, directoryUsername)
+		if err != nil {
+			return nil, err
+		}
+		err = a.groupSyncer.Sync(user, user.Account, groups)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	a.logger.Debug("ldap login", "username", user.Username, "dn", entry.DN)
+	return user, nil
+}
+
+func (a *Ldap) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.config.URL, ldap.DialWithTLSConfig(a.tlsConfig))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to ldap server")
+	}
+	conn.SetTimeout(a.config.Timeout)
+	if a.config.StartTLS {
+		err = conn.StartTLS(a.tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "failed to start tls")
+		}
+	}
+	return conn, nil
+}
+
+// bindSearch binds with the search credentials, without them the connection keeps its current bind
+func (a *Ldap) bindSearch(conn *ldap.Conn) error {
+	if a.config.BindDN == "" {
+		return nil
+	}
+	err := conn.Bind(a.config.BindDN, a.config.BindPassword)
+	if err != nil {
+		return errors.Wrap(err, "failed to bind for search")
+	}
+	return nil
+}
+
+func (a *Ldap) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	err := a.bindSearch(conn)
+	if err != nil {
+		return nil, err
+	}
+	filter := strings.ReplaceAll(a.config.UserFilter, "{username}", ldap.EscapeFilter(username))
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(a.config.Timeout.Seconds()), false,
+		filter, []string{a.config.UsernameAttribute}, nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, errors.Errorf("more than one ldap entry matches %s", filter)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to search user")
+	}
+	switch len(result.Entries) {
+	case 0:
+		return nil, ErrUnknownUser
+	case 1:
+		return result.Entries[0], nil
+	default:
+		return nil, errors.Errorf("more than one ldap entry matches %s", filter)
+	}
+}
+
+func (a *Ldap) findGroups(conn *ldap.Conn, dn string, username string) ([]string, error) {
+	// the user may not be allowed to search groups, without search credentials the user's bind is used
+	err := a.bindSearch(conn)
+	if err != nil {
+		return nil, err
+	}
+	filter := strings.NewReplacer(
+		"{dn}", ldap.EscapeFilter(dn),
+		"{username}", ldap.EscapeFilter(username),
+	).Replace(a.config.GroupFilter)
+	result, err := conn.SearchWithPaging(ldap.NewSearchRequest(
+		a.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, int(a.config.Timeout.Seconds()), false,
+		filter, []string{a.config.GroupNameAttribute}, nil,
+	), 500)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to search groups")
+	}
+	groups := []string{}
+	for _, entry := range result.Entries {
+		if name := entry.GetAttributeValue(a.config.GroupNameAttribute); name != "" {
+			groups = append(groups, name)
+		}
+	}
+	return groups, nil
+}
@@ -0,0 +1,329 @@
+package authenticator
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jimlambrt/gldap"
+	"github.com/pkg/errors"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/groupsync"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/identity"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+const (
+	testSearchDN       = "cn=search,dc=example,dc=org"
+	testSearchPassword = "search-secret"
+)
+
+// directoryEntry is a user or group of the fake directory, users have a password
+type directoryEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// fakeDirectory is an in-process LDAP server which supports simple binds and searches with one equality filter,
+// the attribute and value of each search are recorded as the server decoded them
+type fakeDirectory struct {
+	server  *gldap.Server
+	url     string
+	entries []*directoryEntry
+
+	mu       sync.Mutex
+	binds    []string
+	searches [][2]string
+}
+
+func newFakeDirectory(t *testing.T, entries ...*directoryEntry) *fakeDirectory {
+	d := &fakeDirectory{entries: append(entries, &directoryEntry{dn: testSearchDN, password: testSearchPassword})}
+	server, err := gldap.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux, err := gldap.NewMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mux.Bind(d.bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mux.Search(d.search)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Router(mux)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	go server.Run(addr)
+	for start := time.Now(); !server.Ready(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the ldap server didn't start")
+		}
+	}
+	t.Cleanup(func() {
+		server.Stop()
+	})
+	d.server = server
+	d.url = "ldap://" + addr
+	return d
+}
+
+func (d *fakeDirectory) bind(w *gldap.ResponseWriter, r *gldap.Request) {
+	resp := r.NewBindResponse(gldap.WithResponseCode(gldap.ResultInvalidCredentials))
+	defer w.Write(resp)
+	m, err := r.GetSimpleBindMessage()
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	d.binds = append(d.binds, m.UserName)
+	d.mu.Unlock()
+	for _, e := range d.entries {
+		if e.dn == m.UserName && e.password != "" && string(m.Password) == e.password {
+			resp.SetResultCode(gldap.ResultSuccess)
+		}
+	}
+}
+
+func (d *fakeDirectory) search(w *gldap.ResponseWriter, r *gldap.Request) {
+	done := r.NewSearchDoneResponse(gldap.WithResponseCode(gldap.ResultSuccess))
+	defer w.Write(done)
+	m, err := r.GetSearchMessage()
+	if err != nil {
+		done.SetResultCode(gldap.ResultProtocolError)
+		return
+	}
+	filter, err := ldap.CompileFilter(m.Filter)
+	if err != nil || filter.Tag != ldap.FilterEqualityMatch {
+		// an unescaped value turns into a substring, presence or nested filter
+		d.record(m.Filter, "")
+		return
+	}
+	attribute := filter.Children[0].Data.String()
+	value := filter.Children[1].Data.String()
+	d.record(attribute, value)
+	for _, e := range d.entries {
+		for _, v := range e.attributes[attribute] {
+			if v == value {
+				w.Write(r.NewSearchResponseEntry(e.dn, gldap.WithAttributes(e.attributes)))
+			}
+		}
+	}
+}
+
+func (d *fakeDirectory) record(attribute string, value string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.searches = append(d.searches, [2]string{attribute, value})
+}
+
+type fakeProvisioner struct {
+	got *identity.ExternalUser
+	err error
+}
+
+func (p *fakeProvisioner) Provision(ext *identity.ExternalUser) (*model.User, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	p.got = ext
+	return &model.User{ID: 7, Username: ext.Username, Account: &model.Account{ID: 3}}, nil
+}
+
+type fakeSyncer struct {
+	groupsync.Syncer
+	groups []string
+}
+
+func (s *fakeSyncer) Sync(user *model.User, account *model.Account, groups []string) error {
+	s.groups = groups
+	return nil
+}
+
+func newTestLdap(t *testing.T, directory *fakeDirectory, bindDN string, provisioner identity.Provisioner, syncer groupsync.Syncer) *Ldap {
+	config := LdapConfig{
+		URL:                directory.url,
+		UserBaseDN:         "ou=people,dc=example,dc=org",
+		UserFilter:         "(uid={username})",
+		UsernameAttribute:  "uid",
+		GroupBaseDN:        "ou=groups,dc=example,dc=org",
+		GroupFilter:        "(member={dn})",
+		GroupNameAttribute: "cn",
+		Timeout:            5 * time.Second,
+	}
+	if bindDN != "" {
+		config.BindDN = bindDN
+		config.BindPassword = testSearchPassword
+	}
+	a, err := NewLdap(config, dbtest.Logger(), provisioner, syncer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestLdapAuthenticate(t *testing.T) {
+	// the DN and the username need escaping in filters
+	janeDN := "cn=Doe\\, Jane (ops),ou=people,dc=example,dc=org"
+	entries := []*directoryEntry{
+		{dn: janeDN, password: "jane-secret", attributes: map[string][]string{"uid": {"jane"}}},
+		{dn: "uid=star*,ou=people,dc=example,dc=org", password: "star-secret", attributes: map[string][]string{"uid": {"star*"}}},
+		{dn: "cn=admins,ou=groups,dc=example,dc=org", attributes: map[string][]string{"cn": {"admins"}, "member": {janeDN}}},
+		{dn: "cn=ops,ou=groups,dc=example,dc=org", attributes: map[string][]string{"cn": {"ops"}, "member": {janeDN}}},
+	}
+	tests := []struct {
+		name     string
+		username string
+		password string
+		// bindDN searches with the service account instead of anonymously
+		bindDN string
+		// wantErr is nil for a successful login which provisions wantUsername with wantGroups
+		wantErr      error
+		wantUsername string
+		wantGroups   []string
+		// wantSearch is the attribute and value of the user search as the server decoded them,
+		// wantMemberDN the value of the group search
+		wantSearch   [2]string
+		wantMemberDN string
+	}{
+		{
+			name:         "bind as the user",
+			username:     "jane",
+			password:     "jane-secret",
+			wantUsername: "jane",
+			wantGroups:   []string{"admins", "ops"},
+			wantSearch:   [2]string{"uid", "jane"},
+			wantMemberDN: janeDN,
+		},
+		{
+			name:         "search with the service account",
+			username:     "jane",
+			password:     "jane-secret",
+			bindDN:       testSearchDN,
+			wantUsername: "jane",
+			wantGroups:   []string{"admins", "ops"},
+			wantSearch:   [2]string{"uid", "jane"},
+			wantMemberDN: janeDN,
+		},
+		{
+			name:       "wrong password",
+			username:   "jane",
+			password:   "guess",
+			wantErr:    ErrWrongPassword,
+			wantSearch: [2]string{"uid", "jane"},
+		},
+		{
+			name:     "empty password is not an anonymous bind",
+			username: "jane",
+			wantErr:  ErrWrongPassword,
+		},
+		{
+			name:       "unknown user",
+			username:   "john",
+			password:   "john-secret",
+			wantErr:    ErrUnknownUser,
+			wantSearch: [2]string{"uid", "john"},
+		},
+		{
+			name:       "wildcard is a literal",
+			username:   "*",
+			password:   "jane-secret",
+			wantErr:    ErrUnknownUser,
+			wantSearch: [2]string{"uid", "*"},
+		},
+		{
+			name:       "filter injection",
+			username:   "jane)(uid=*",
+			password:   "jane-secret",
+			wantErr:    ErrUnknownUser,
+			wantSearch: [2]string{"uid", "jane)(uid=*"},
+		},
+		{
+			name:         "username with special characters",
+			username:     "star*",
+			password:     "star-secret",
+			wantUsername: "star*",
+			wantGroups:   []string{},
+			wantSearch:   [2]string{"uid", "star*"},
+			wantMemberDN: "uid=star*,ou=people,dc=example,dc=org",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			directory := newFakeDirectory(t, entries...)
+			provisioner := &fakeProvisioner{}
+			syncer := &fakeSyncer{}
+			a := newTestLdap(t, directory, tt.bindDN, provisioner, syncer)
+
+			user, err := a.Authenticate(tt.username, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			var wantSearches [][2]string
+			if tt.wantSearch != [2]string{} {
+				wantSearches = append(wantSearches, tt.wantSearch)
+			}
+			if tt.wantErr == nil {
+				wantSearches = append(wantSearches, [2]string{"member", tt.wantMemberDN})
+			}
+			if !reflect.DeepEqual(directory.searches, wantSearches) {
+				t.Errorf("got searches %q, want %q", directory.searches, wantSearches)
+			}
+			if tt.wantErr != nil {
+				if provisioner.got != nil {
+					t.Errorf("provisioned %+v after a failed login", provisioner.got)
+				}
+				return
+			}
+			if user.Username != tt.wantUsername || provisioner.got.Provider != directory.url || provisioner.got.Verified {
+				t.Errorf("provisioned %+v, want the unverified user %s", provisioner.got, tt.wantUsername)
+			}
+			if !reflect.DeepEqual(syncer.groups, tt.wantGroups) {
+				t.Errorf("got groups %v, want %v", syncer.groups, tt.wantGroups)
+			}
+			if tt.bindDN != "" && (len(directory.binds) == 0 || directory.binds[0] != tt.bindDN) {
+				t.Errorf("got binds %q, want a search bind first", directory.binds)
+			}
+		})
+	}
+}
+
+func TestLdapSearchBindFails(t *testing.T) {
+	directory := newFakeDirectory(t)
+	a := newTestLdap(t, directory, testSearchDN, &fakeProvisioner{}, &fakeSyncer{})
+	a.config.BindPassword = "wrong"
+
+	// a misconfigured service account is a server error, not a wrong password of the user
+	_, err := a.Authenticate("jane", "jane-secret")
+	if err == nil || errors.Is(err, ErrWrongPassword) || errors.Is(err, ErrUnknownUser) {
+		t.Errorf("got %v, want a bind error", err)
+	}
+}
+
+func TestLdapDoesNotTakeOverLocalUsers(t *testing.T) {
+	directory := newFakeDirectory(t, &directoryEntry{
+		dn: "uid=jane,ou=people,dc=example,dc=org", password: "jane-secret", attributes: map[string][]string{"uid": {"jane"}},
+	})
+	a := newTestLdap(t, directory, "", &fakeProvisioner{err: identity.ErrUsernameTaken}, &fakeSyncer{})
+
+	_, err := a.Authenticate("jane", "jane-secret")
+	if !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("got %v, want %v", err, ErrUsernameTaken)
+	}
+}
@@ -0,0 +1,87 @@
+package authenticator
+
+import (
+	"log/slog"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/password"
+)
+
+var _ Authenticator = &Local{}
+
+// Local checks passwords against the hashes in the users table
+type Local struct {
+	db     *gorm.DB
+	logger *slog.Logger
+	hasher password.Hasher
+}
+
+func NewLocal(db *gorm.DB, logger *slog.Logger, hasher password.Hasher) *Local {
+	return &Local{db: db, logger: logger.With("subcomponent", "authenticator/Local"), hasher: hasher}
+}
+
+func (a *Local) Authenticate(username string, plaintext string) (*model.User, error) {
+	u, err := a.find(username)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, ErrUnknownUser
+	}
+	return a.verify(u, plaintext)
+}
+
+// find returns the user with the username and their account, or nil
+func (a *Local) find(username string) (*model.User, error) {
+	users := []*model.User{}
+	err := a.db.
+		Preload("Account").
+		Where("LOWER(username) = LOWER(?)", username).
+		Limit(1).
+		Find(&users).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get user")
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	return users[0], nil
+}
+
+func (a *Local) verify(u *model.User, plaintext string) (*model.User, error) {
+	// users without a local password can't log in with one
+	match, err := a.hasher.Verify(plaintext, u.Password)
+	if err != nil {
+		a.logger.Error("password verify error", "err", err, "username", u.Username)
+	}
+	if !match {
+		return nil, ErrWrongPassword
+	}
+	a.rehash(u, plaintext)
+	return u, nil
+}
+
+// rehash upgrades the user's password hash to the current algorithm and parameters,
+// a failure only delays the upgrade to the next login
+func (a *Local) rehash(u *model.User, plaintext string) {
+	if !a.hasher.NeedsRehash(u.Password) {
+		return
+	}
+	hashedPassword, err := a.hasher.Hash(plaintext)
+	if err != nil {
+		a.logger.Error("password hash error", "err", err)
+		return
+	}
+	// only replaces the hash which was verified, a concurrent password change wins
+	result := a.db.Model(u).Where("password = ?", u.Password).Update("password", hashedPassword)
+	if result.Error != nil {
+		a.logger.Error("failed to rehash password", "err", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		a.logger.Info("rehashed password", "username", u.Username)
+	}
+}
@@ -0,0 +1,149 @@
+package authenticator
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/password"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+// fakeAuthenticator stands in for a directory and records the logins it was asked to check
+type fakeAuthenticator struct {
+	asked []string
+}
+
+func (a *fakeAuthenticator) Authenticate(username string, password string) (*model.User, error) {
+	a.asked = append(a.asked, username)
+	if password != "directory-secret" {
+		return nil, ErrWrongPassword
+	}
+	return &model.User{Username: username}, nil
+}
+
+// newTestLocal returns the authenticator and a database with a local user jane@example.com and an external user john@example.com
+func newTestLocal(t *testing.T) (*Local, *gorm.DB) {
+	db := dbtest.Open(t)
+	hasher, err := password.NewPHCHasher(password.Config{Algorithm: password.AlgorithmBcrypt, BcryptCost: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme := dbtest.Account(t, db, "acme")
+	jane := dbtest.User(t, db, acme, "jane@example.com")
+	hash, err := hasher.Hash("local-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Model(jane).Update("password", hash).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbtest.User(t, db, acme, "john@example.com")
+	return NewLocal(db, dbtest.Logger(), hasher), db
+}
+
+func TestLocalAuthenticate(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  error
+	}{
+		{name: "correct password", username: "jane@example.com", password: "local-secret"},
+		{name: "username is case insensitive", username: "Jane@Example.com", password: "local-secret"},
+		{name: "wrong password", username: "jane@example.com", password: "guess", wantErr: ErrWrongPassword},
+		{name: "user without a local password", username: "john@example.com", password: "", wantErr: ErrWrongPassword},
+		{name: "unknown user", username: "nobody@example.com", password: "local-secret", wantErr: ErrUnknownUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestLocal(t)
+			user, err := a.Authenticate(tt.username, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && (user.Username != "jane@example.com" || user.Account == nil) {
+				t.Errorf("got %+v, want jane with her account", user)
+			}
+		})
+	}
+}
+
+func TestLocalFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  error
+		// wantDirectory is true if the directory checks the password
+		wantDirectory bool
+	}{
+		{name: "local user", username: "jane@example.com", password: "local-secret"},
+		{name: "local user with the wrong password", username: "jane@example.com", password: "directory-secret", wantErr: ErrWrongPassword},
+		{name: "user without a local password", username: "john@example.com", password: "directory-secret", wantDirectory: true},
+		{name: "unknown user", username: "nobody@example.com", password: "directory-secret", wantDirectory: true},
+		{name: "wrong directory password", username: "nobody@example.com", password: "local-secret", wantErr: ErrWrongPassword, wantDirectory: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, _ := newTestLocal(t)
+			directory := &fakeAuthenticator{}
+			a := NewLocalFallback(local, directory, dbtest.Logger())
+
+			_, err := a.Authenticate(tt.username, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if (len(directory.asked) > 0) != tt.wantDirectory {
+				t.Errorf("got directory logins %v, want directory %v", directory.asked, tt.wantDirectory)
+			}
+		})
+	}
+}
+
+func TestLocalRehash(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		// wantRehash is true if the bcrypt hash is replaced by an argon2id hash
+		wantRehash bool
+	}{
+		{name: "correct password", password: "local-secret", wantRehash: true},
+		{name: "wrong password", password: "guess"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// jane's hash is bcrypt, the hasher creates argon2id hashes now
+			_, db := newTestLocal(t)
+			argon2, err := password.NewPHCHasher(password.Config{Algorithm: password.AlgorithmArgon2id, Argon2Memory: 64, Argon2Time: 1, Argon2Threads: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := NewLocal(db, dbtest.Logger(), argon2)
+
+			_, err = a.Authenticate("jane@example.com", tt.password)
+			if (err == nil) != tt.wantRehash {
+				t.Fatalf("got %v", err)
+			}
+			u := &model.User{}
+			err = db.Where("username = ?", "jane@example.com").First(u).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(u.Password, "$argon2id$") != tt.wantRehash {
+				t.Errorf("got hash %s, want rehash %v", u.Password, tt.wantRehash)
+			}
+			// the new hash still verifies
+			if tt.wantRehash {
+				_, err = a.Authenticate("jane@example.com", tt.password)
+				if err != nil {
+					t.Errorf("failed to log in with the rehashed password: %v", err)
+				}
+			}
+		})
+	}
+}
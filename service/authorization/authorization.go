@@ -1,22 +1,64 @@
 package authorization
 
-import "github.com/casbin/casbin/v2"
+import (
+	"github.com/casbin/casbin/v2"
+	"github.com/pkg/errors"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/audit"
+)
+
+// PlatformAdminRole is a global role (g2 in the casbin model) which is granted access in every domain
+const PlatformAdminRole = "platform_admin"
 
 type Authorization interface {
 	// Returns true if the user has the permission
 	IsAuthorized(username string, domain string, resource string, action string) (bool, error)
+	// Returns true if the user holds the platform admin role
+	IsPlatformAdmin(username string) bool
+	// Returns the roles of the user in the domain
+	Roles(username string, domain string) []string
 }
 
 var _ Authorization = &CasbinAuthorizationService{}
 
 type CasbinAuthorizationService struct {
-	enforcer *casbin.Enforcer
+	enforcer *casbin.SyncedEnforcer
+	auditor  audit.Auditor
 }
 
-func NewCasbinAuthorizationService(casbinEnforcer *casbin.Enforcer) *CasbinAuthorizationService {
-	return &CasbinAuthorizationService{enforcer: casbinEnforcer}
+func NewCasbinAuthorizationService(casbinEnforcer *casbin.SyncedEnforcer, auditor audit.Auditor) *CasbinAuthorizationService {
+	return &CasbinAuthorizationService{enforcer: casbinEnforcer, auditor: auditor}
 }
 
 func (a *CasbinAuthorizationService) IsAuthorized(username string, domain string, resource string, action string) (bool, error) {
-	return a.enforcer.Enforce(username, domain, resource, action)
+	allowed, err := a.enforcer.Enforce(username, domain, resource, action)
+	if err != nil || !allowed {
+		return allowed, err
+	}
+
+	// platform admins are allowed everywhere, audit every access to an account they are not a member of
+	if a.IsPlatformAdmin(username) && len(a.enforcer.GetRolesForUserInDomain(username, domain)) == 0 {
+		err = a.auditor.Record(&audit.Event{
+			Actor:     username,
+			ActorType: audit.ActorTypeUser,
+			Domain:    domain,
+			Resource:  resource,
+			Action:    action,
+			Reason:    audit.ReasonPlatformAdmin,
+		})
+		if err != nil {
+			// refuse cross-account access which could not be audited
+			return false, errors.Wrap(err, "failed to record audit event")
+		}
+	}
+
+	return true, nil
+}
+
+func (a *CasbinAuthorizationService) IsPlatformAdmin(username string) bool {
+	return a.enforcer.HasNamedGroupingPolicy("g2", username, PlatformAdminRole)
+}
+
+func (a *CasbinAuthorizationService) Roles(username string, domain string) []string {
+	return a.enforcer.GetRolesForUserInDomain(username, domain)
 }
@@ -0,0 +1,118 @@
+package authorization
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/casbin/casbin/v2"
+	stringadapter "github.com/casbin/casbin/v2/persist/string-adapter"
+	"github.com/pkg/errors"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/audit"
+)
+
+// two accounts with the same name, only their ULIDs tell them apart
+const (
+	acme      = "01JAAAAAAAAAAAAAAAAAAAAAAA"
+	otherAcme = "01JBBBBBBBBBBBBBBBBBBBBBBB"
+)
+
+var testPolicy = strings.Join([]string{
+	"p, admin, " + acme + ", stack, read",
+	"p, admin, " + acme + ", stack, create",
+	"p, admin, " + otherAcme + ", stack, read",
+	"g, jane, admin, " + acme,
+	"g, john, admin, " + otherAcme,
+	"g, root, admin, " + otherAcme,
+	"g2, root, " + PlatformAdminRole,
+}, "\n")
+
+type fakeAuditor struct {
+	events []*audit.Event
+	err    error
+}
+
+func (a *fakeAuditor) Record(event *audit.Event) error {
+	if a.err != nil {
+		return a.err
+	}
+	a.events = append(a.events, event)
+	return nil
+}
+
+func newTestService(t *testing.T, auditor audit.Auditor) *CasbinAuthorizationService {
+	enforcer, err := casbin.NewSyncedEnforcer("../../rbac_with_domains_model.conf", stringadapter.NewAdapter(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewCasbinAuthorizationService(enforcer, auditor)
+}
+
+func TestIsAuthorized(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		domain   string
+		action   string
+		auditErr error
+		want     bool
+		wantErr  bool
+		// wantAudit is true if the access is recorded as a platform admin's
+		wantAudit bool
+	}{
+		{name: "role in the domain", username: "jane", domain: acme, action: "read", want: true},
+		{name: "action not granted", username: "jane", domain: acme, action: "delete"},
+		{name: "role in another domain", username: "john", domain: acme, action: "read"},
+		{name: "account with the same name", username: "jane", domain: otherAcme, action: "read"},
+		{name: "platform admin in a foreign domain", username: "root", domain: acme, action: "create", want: true, wantAudit: true},
+		{name: "platform admin with a role in the domain", username: "root", domain: otherAcme, action: "read", want: true},
+		{name: "audit failure", username: "root", domain: acme, action: "read", auditErr: errors.New("db down"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auditor := &fakeAuditor{err: tt.auditErr}
+			a := newTestService(t, auditor)
+
+			got, err := a.IsAuthorized(tt.username, tt.domain, "stack", tt.action)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if len(auditor.events) > 0 != tt.wantAudit {
+				t.Fatalf("got %d audit events, want audit %v", len(auditor.events), tt.wantAudit)
+			}
+			if tt.wantAudit {
+				event := auditor.events[0]
+				if event.Actor != tt.username || event.Domain != tt.domain || event.Reason != audit.ReasonPlatformAdmin {
+					t.Errorf("unexpected audit event %+v", event)
+				}
+			}
+		})
+	}
+}
+
+func TestRoles(t *testing.T) {
+	a := newTestService(t, &fakeAuditor{})
+	tests := []struct {
+		username      string
+		domain        string
+		want          []string
+		platformAdmin bool
+	}{
+		{username: "jane", domain: acme, want: []string{"admin"}},
+		{username: "jane", domain: otherAcme, want: []string{}},
+		{username: "root", domain: acme, want: []string{}, platformAdmin: true},
+		{username: "root", domain: otherAcme, want: []string{"admin"}, platformAdmin: true},
+	}
+	for _, tt := range tests {
+		got := a.Roles(tt.username, tt.domain)
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Roles(%s, %s) = %v, want %v", tt.username, tt.domain, got, tt.want)
+		}
+		if a.IsPlatformAdmin(tt.username) != tt.platformAdmin {
+			t.Errorf("IsPlatformAdmin(%s) = %v, want %v", tt.username, !tt.platformAdmin, tt.platformAdmin)
+		}
+	}
+}
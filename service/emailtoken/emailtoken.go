@@ -0,0 +1,126 @@
+package emailtoken
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+)
+
+// Purpose binds a token to one flow, a verification token can't be used to reset a password
+type Purpose string
+
+const (
+	PurposeVerifyEmail   Purpose = "verify_email"
+	PurposeResetPassword Purpose = "reset_password"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("expired token")
+)
+
+// Signer issues and verifies stateless tokens which are sent by email
+//
+// A token is single use because it's bound to a fingerprint of the state it changes:
+// the password hash for resets, the username and verification time for email verification.
+type Signer struct {
+	key []byte
+}
+
+func NewSigner(key []byte) *Signer {
+	return &Signer{key: key}
+}
+
+// Issue returns a token for the user which expires after ttl
+func (s *Signer) Issue(purpose Purpose, user *model.User, ttl time.Duration) string {
+	payload := fmt.Sprintf("%s|%d|%d|%s", purpose, user.ID, time.Now().Add(ttl).Unix(), fingerprint(purpose, user))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(s.sign(payload))
+}
+
+// UserID returns the user the token was issued for, the token must be verified with Verify once the user is loaded
+func (s *Signer) UserID(purpose Purpose, token string) (uint, error) {
+	fields, err := s.parse(purpose, token)
+	if err != nil {
+		return 0, err
+	}
+	userID, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+	return uint(userID), nil
+}
+
+// Verify checks that the token was issued for the user in their current state and hasn't expired
+func (s *Signer) Verify(purpose Purpose, token string, user *model.User) error {
+	fields, err := s.parse(purpose, token)
+	if err != nil {
+		return err
+	}
+	if fields[1] != strconv.FormatUint(uint64(user.ID), 10) {
+		return ErrInvalidToken
+	}
+	if !hmac.Equal([]byte(fields[3]), []byte(fingerprint(purpose, user))) {
+		// already used, or the user changed since the token was issued
+		return ErrInvalidToken
+	}
+	expiresAt, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if time.Now().Unix() > expiresAt {
+		return ErrExpiredToken
+	}
+	return nil
+}
+
+// parse checks the signature and the purpose and returns the fields of the payload
+func (s *Signer) parse(purpose Purpose, token string) ([]string, error) {
+	encodedPayload, encodedSignature, found := strings.Cut(token, ".")
+	if !found {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !hmac.Equal(signature, s.sign(string(payload))) {
+		return nil, ErrInvalidToken
+	}
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 4 || fields[0] != string(purpose) {
+		return nil, ErrInvalidToken
+	}
+	return fields, nil
+}
+
+func (s *Signer) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func fingerprint(purpose Purpose, user *model.User) string {
+	state := user.Password
+	if purpose == PurposeVerifyEmail {
+		verifiedAt := ""
+		if user.EmailVerifiedAt != nil {
+			verifiedAt = user.EmailVerifiedAt.String()
+		}
+		state = user.Username + "|" + verifiedAt
+	}
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:16])
+}
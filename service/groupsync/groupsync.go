@@ -0,0 +1,141 @@
+package groupsync
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/policy"
+)
+
+// AuthorGroupSync is the author of policy versions created by the sync
+const AuthorGroupSync = "group-sync"
+
+// Mapping grants a casbin role in the account's domain to members of a directory group
+type Mapping struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	AccountID uint
+	GroupName string
+	Role      string
+}
+
+func (Mapping) TableName() string {
+	return "group_role_mappings"
+}
+
+type Syncer interface {
+	// Returns the mappings of the account
+	Mappings(accountID uint) ([]*Mapping, error)
+	// Adds a mapping to the account
+	AddMapping(accountID uint, group string, role string) (*Mapping, error)
+	// Removes a mapping from the account
+	RemoveMapping(accountID uint, group string, role string) error
+	// Grants the user the roles mapped from their groups and revokes mapped roles of groups they left,
+	// roles which don't appear in any mapping of the account are left alone
+	Sync(user *model.User, account *model.Account, groups []string) error
+}
+
+var _ Syncer = &DbSyncer{}
+
+type DbSyncer struct {
+	db            *gorm.DB
+	logger        *slog.Logger
+	policyManager policy.Manager
+}
+
+func NewDbSyncer(db *gorm.DB, logger *slog.Logger, policyManager policy.Manager) *DbSyncer {
+	return &DbSyncer{db: db, logger: logger.With("subcomponent", "groupsync/DbSyncer"), policyManager: policyManager}
+}
+
+func (s *DbSyncer) Mappings(accountID uint) ([]*Mapping, error) {
+	mappings := []*Mapping{}
+	err := s.db.Where("account_id = ?", accountID).Order("group_name, role").Find(&mappings).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get group role mappings")
+	}
+	return mappings, nil
+}
+
+func (s *DbSyncer) AddMapping(accountID uint, group string, role string) (*Mapping, error) {
+	mapping := &Mapping{AccountID: accountID, GroupName: group, Role: role}
+	err := s.db.Create(mapping).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create group role mapping")
+	}
+	return mapping, nil
+}
+
+func (s *DbSyncer) RemoveMapping(accountID uint, group string, role string) error {
+	err := s.db.Where("account_id = ? AND group_name = ? AND role = ?", accountID, group, role).Delete(&Mapping{}).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to delete group role mapping")
+	}
+	return nil
+}
+
+func (s *DbSyncer) Sync(user *model.User, account *model.Account, groups []string) error {
+	mappings, err := s.Mappings(account.ID)
+	if err != nil {
+		return err
+	}
+	if len(mappings) == 0 {
+		return nil
+	}
+
+	// roles managed by the sync and the subset the user should have
+	memberOf := map[string]bool{}
+	for _, group := range groups {
+		memberOf[group] = true
+	}
+	managed := map[string]bool{}
+	desired := map[string]bool{}
+	for _, m := range mappings {
+		managed[m.Role] = true
+		if memberOf[m.GroupName] {
+			desired[m.Role] = true
+		}
+	}
+
+	comment := fmt.Sprintf("synced directory groups of %s in %s", user.Username, account.Name)
+	_, err = s.policyManager.Update(AuthorGroupSync, comment, func(rules []policy.Rule) ([]policy.Rule, error) {
+		return SetRoles(rules, user.Username, account.Ulid, managed, desired), nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to sync roles")
+	}
+	s.logger.Debug("synced roles", "username", user.Username, "account", account.Name, "groups", groups)
+	return nil
+}
+
+// SetRoles returns the rules with the subject's "g" rules in the domain changed so that of the managed roles it holds exactly the desired ones
+func SetRoles(rules []policy.Rule, subject string, domain string, managed map[string]bool, desired map[string]bool) []policy.Rule {
+	result := []policy.Rule{}
+	has := map[string]bool{}
+	for _, rule := range rules {
+		if len(rule) == 4 && rule[0] == "g" && rule[1] == subject && rule[3] == domain && managed[rule[2]] {
+			if !desired[rule[2]] || has[rule[2]] {
+				continue
+			}
+			has[rule[2]] = true
+		}
+		result = append(result, rule)
+	}
+	missing := []string{}
+	for role := range desired {
+		if !has[role] {
+			missing = append(missing, role)
+		}
+	}
+	sort.Strings(missing)
+	for _, role := range missing {
+		result = append(result, policy.Rule{"g", subject, role, domain})
+	}
+	return result
+}
@@ -0,0 +1,152 @@
+package identity
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/membership"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/serviceaccount"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+var ErrUsernameTaken = errors.New("username is taken by a local user")
+
+// Identity links a user to an account at an external identity provider
+type Identity struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	Provider string
+	Subject  string
+	UserID   uint
+}
+
+func (Identity) TableName() string {
+	return "user_identities"
+}
+
+// ExternalUser is a user authenticated by an external identity provider
+type ExternalUser struct {
+	// Provider identifies the identity provider, e.g. the OIDC issuer URL
+	Provider string
+	// Subject is the stable ID of the user at the provider
+	Subject string
+	// Username is used when the user is created
+	Username string
+	// Verified is true if the provider verified that the username belongs to the user, only then an existing local user is linked
+	Verified bool
+}
+
+type Provisioner interface {
+	// Returns the user linked to the external user, creating the user on first login
+	Provision(ext *ExternalUser) (*model.User, error)
+}
+
+var _ Provisioner = &DbProvisioner{}
+
+type DbProvisioner struct {
+	db             *gorm.DB
+	logger         *slog.Logger
+	ulidManager    *util.UlidManager
+	defaultAccount string
+}
+
+// NewDbProvisioner creates a provisioner, new users join the account with the defaultAccount ULID, or get their own account if it's empty
+func NewDbProvisioner(db *gorm.DB, logger *slog.Logger, ulidManager *util.UlidManager, defaultAccount string) *DbProvisioner {
+	return &DbProvisioner{
+		db:             db,
+		logger:         logger.With("subcomponent", "identity/DbProvisioner"),
+		ulidManager:    ulidManager,
+		defaultAccount: defaultAccount,
+	}
+}
+
+func (p *DbProvisioner) Provision(ext *ExternalUser) (*model.User, error) {
+	// casbin subjects of service accounts must not be claimed by users
+	if serviceaccount.IsSubject(ext.Username) {
+		return nil, ErrUsernameTaken
+	}
+
+	user := &model.User{}
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		// returning user
+		identities := []*Identity{}
+		err := tx.Where("provider = ? AND subject = ?", ext.Provider, ext.Subject).Limit(1).Find(&identities).Error
+		if err != nil {
+			return errors.Wrap(err, "failed to get identity")
+		}
+		if len(identities) > 0 {
+			return tx.Preload("Account").Where("id = ?", identities[0].UserID).First(user).Error
+		}
+
+		// existing local user, only linked if the provider vouches for the username
+		users := []*model.User{}
+		err = tx.Preload("Account").Where("LOWER(username) = LOWER(?)", ext.Username).Limit(1).Find(&users).Error
+		if err != nil {
+			return errors.Wrap(err, "failed to get user")
+		}
+		if len(users) > 0 {
+			if !ext.Verified {
+				return ErrUsernameTaken
+			}
+			*user = *users[0]
+		} else {
+			err = p.createUser(tx, ext, user)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.Create(&Identity{Provider: ext.Provider, Subject: ext.Subject, UserID: user.ID}).Error
+		if err != nil {
+			return errors.Wrap(err, "failed to create identity")
+		}
+		p.logger.Info("linked external identity", "provider", ext.Provider, "subject", ext.Subject, "username", user.Username)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (p *DbProvisioner) createUser(tx *gorm.DB, ext *ExternalUser, user *model.User) error {
+	account := &model.Account{}
+	if p.defaultAccount != "" {
+		err := tx.Where("ulid = ?", p.defaultAccount).First(account).Error
+		if err != nil {
+			return errors.Wrap(err, "failed to get default account")
+		}
+	} else {
+		account.Ulid = p.ulidManager.NewULID().String()
+		account.Name = ext.Username
+		err := tx.Create(account).Error
+		if err != nil {
+			return errors.Wrap(err, "failed to create account")
+		}
+	}
+
+	// external users have no local password, an empty hash never matches
+	*user = model.User{
+		Ulid:     p.ulidManager.NewULID().String(),
+		Username: ext.Username,
+		Account:  account,
+	}
+	err := tx.Create(user).Error
+	if util.IsUniqueViolation(err, util.ConstraintUniqueUsername) {
+		return ErrUsernameTaken
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to create user")
+	}
+	err = membership.Add(tx, user.ID, account.ID)
+	if err != nil {
+		return err
+	}
+	p.logger.Info("provisioned user", "provider", ext.Provider, "username", user.Username, "account", account.Name)
+	return nil
+}
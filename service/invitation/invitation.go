@@ -0,0 +1,302 @@
+package invitation
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/groupsync"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/mailer"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/membership"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/policy"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+var (
+	ErrInvalidEmail      = errors.New("invalid email address")
+	ErrInvalidInvitation = errors.New("invalid invitation")
+	ErrExpiredInvitation = errors.New("expired invitation")
+	ErrUsernameTaken     = errors.New("a user with this email already exists")
+	ErrWrongUser         = errors.New("the invitation is for another user")
+)
+
+// Invitation lets the invitee create a user in the account, or join it with their existing user, they get the role when they accept
+type Invitation struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	Ulid       string
+	AccountID  uint
+	Email      string
+	Role       string
+	InvitedBy  string
+	ExpiresAt  time.Time
+	AcceptedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (Invitation) TableName() string {
+	return "invitations"
+}
+
+type Service interface {
+	// Creates an invitation and emails the link to the invitee
+	Invite(account *model.Account, email string, role string, invitedBy string) (*Invitation, error)
+	// Returns the invitations of the account which were neither accepted nor revoked, including expired ones
+	Pending(accountID uint) ([]*Invitation, error)
+	// Revokes a pending invitation of the account
+	Revoke(accountID uint, ulid string) error
+	// Returns the pending invitation of the token without accepting it
+	Lookup(token string) (*Invitation, error)
+	// Creates the invited user with the password hash and grants them the role
+	Accept(token string, passwordHash string) (*model.User, error)
+	// Adds an existing user to the inviting account and grants them the role, the user must be the invitee
+	Join(token string, user *model.User) (*model.Account, error)
+}
+
+var _ Service = &DbService{}
+
+type DbService struct {
+	db            *gorm.DB
+	logger        *slog.Logger
+	ulidManager   *util.UlidManager
+	policyManager policy.Manager
+	mailer        mailer.Mailer
+	key           []byte
+	acceptURL     string
+	ttl           time.Duration
+}
+
+// NewDbService creates the service, invitations are signed with key and valid for ttl, the token is appended to acceptURL
+func NewDbService(db *gorm.DB, logger *slog.Logger, ulidManager *util.UlidManager, policyManager policy.Manager, mailer mailer.Mailer, key []byte, acceptURL string, ttl time.Duration) *DbService {
+	return &DbService{
+		db:            db,
+		logger:        logger.With("subcomponent", "invitation/DbService"),
+		ulidManager:   ulidManager,
+		policyManager: policyManager,
+		mailer:        mailer,
+		key:           key,
+		acceptURL:     acceptURL,
+		ttl:           ttl,
+	}
+}
+
+func (s *DbService) Invite(account *model.Account, email string, role string, invitedBy string) (*Invitation, error) {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return nil, ErrInvalidEmail
+	}
+
+	inv := &Invitation{
+		Ulid:      s.ulidManager.NewULID().String(),
+		AccountID: account.ID,
+		Email:     email,
+		Role:      role,
+		InvitedBy: invitedBy,
+		ExpiresAt: time.Now().Add(s.ttl),
+	}
+	err = s.db.Create(inv).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create invitation")
+	}
+	// the email is sent once the invitation can be accepted, it's deleted again if the email can't be sent
+	err = s.mailer.Send(&mailer.Message{
+		To:      email,
+		Subject: fmt.Sprintf("You are invited to %s", account.Name),
+		Body: fmt.Sprintf("%s invited you to join %s. Open the link below to create your user, it expires in %s.\n\n%s\n",
+			invitedBy, account.Name, s.ttl, s.acceptURL+"?token="+s.token(inv)),
+	})
+	if err != nil {
+		deleteErr := s.db.Delete(inv).Error
+		if deleteErr != nil {
+			s.logger.Error("failed to delete unsent invitation", "invitation", inv.Ulid, "err", deleteErr)
+		}
+		return nil, errors.Wrap(err, "failed to send invitation")
+	}
+	s.logger.Info("invited user", "invitation", inv.Ulid, "account", account.Name, "role", role, "by", invitedBy)
+	return inv, nil
+}
+
+func (s *DbService) Pending(accountID uint) ([]*Invitation, error) {
+	invitations := []*Invitation{}
+	err := s.db.Where("account_id = ? AND accepted_at IS NULL AND revoked_at IS NULL", accountID).Order("id").Find(&invitations).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list invitations")
+	}
+	return invitations, nil
+}
+
+func (s *DbService) Revoke(accountID uint, ulid string) error {
+	result := s.db.Model(&Invitation{}).
+		Where("account_id = ? AND ulid = ? AND accepted_at IS NULL AND revoked_at IS NULL", accountID, ulid).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "failed to revoke invitation")
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidInvitation
+	}
+	s.logger.Info("revoked invitation", "invitation", ulid)
+	return nil
+}
+
+func (s *DbService) Lookup(token string) (*Invitation, error) {
+	return s.pending(s.db, token)
+}
+
+func (s *DbService) Accept(token string, passwordHash string) (*model.User, error) {
+	found, err := s.Lookup(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// the user, the membership and the role are committed together with the new policy version
+	user := &model.User{}
+	inv := &Invitation{}
+	_, err = s.policyManager.UpdateTx(found.InvitedBy, acceptedComment(found), func(tx *gorm.DB, rules []policy.Rule) ([]policy.Rule, error) {
+		var account *model.Account
+		var err error
+		inv, account, err = s.claim(tx, token)
+		if err != nil {
+			return nil, err
+		}
+		var existing int64
+		err = tx.Model(&model.User{}).Where("LOWER(username) = LOWER(?)", inv.Email).Count(&existing).Error
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get user")
+		}
+		if existing > 0 {
+			return nil, ErrUsernameTaken
+		}
+
+		// the invitation was delivered by email, so the invitee owns the address
+		now := time.Now()
+		*user = model.User{
+			Ulid:            s.ulidManager.NewULID().String(),
+			Username:        inv.Email,
+			Password:        passwordHash,
+			Account:         account,
+			EmailVerifiedAt: &now,
+		}
+		err = tx.Create(user).Error
+		if util.IsUniqueViolation(err, util.ConstraintUniqueUsername) {
+			return nil, ErrUsernameTaken
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create user")
+		}
+		err = membership.Add(tx, user.ID, account.ID)
+		if err != nil {
+			return nil, err
+		}
+		return grantRole(rules, inv, user.Username, account), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("accepted invitation", "invitation", inv.Ulid, "username", user.Username, "role", inv.Role)
+	return user, nil
+}
+
+func (s *DbService) Join(token string, user *model.User) (*model.Account, error) {
+	found, err := s.Lookup(token)
+	if err != nil {
+		return nil, err
+	}
+
+	inv := &Invitation{}
+	account := &model.Account{}
+	_, err = s.policyManager.UpdateTx(found.InvitedBy, acceptedComment(found), func(tx *gorm.DB, rules []policy.Rule) ([]policy.Rule, error) {
+		var err error
+		inv, account, err = s.claim(tx, token)
+		if err != nil {
+			return nil, err
+		}
+		// usernames are unique regardless of case, so are email addresses
+		if !strings.EqualFold(inv.Email, user.Username) {
+			// the link was forwarded or the invitee is logged in as someone else
+			return nil, ErrWrongUser
+		}
+		err = membership.Add(tx, user.ID, account.ID)
+		if err != nil {
+			return nil, err
+		}
+		return grantRole(rules, inv, user.Username, account), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("accepted invitation", "invitation", inv.Ulid, "username", user.Username, "role", inv.Role)
+	return account, nil
+}
+
+// pending checks the token and returns the invitation if it can still be accepted
+func (s *DbService) pending(db *gorm.DB, token string) (*Invitation, error) {
+	ulid, signature, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(s.sign(ulid))) {
+		return nil, ErrInvalidInvitation
+	}
+
+	invitations := []*Invitation{}
+	err := db.Where("ulid = ?", ulid).Limit(1).Find(&invitations).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get invitation")
+	}
+	if len(invitations) == 0 || invitations[0].AcceptedAt != nil || invitations[0].RevokedAt != nil {
+		return nil, ErrInvalidInvitation
+	}
+	if time.Now().After(invitations[0].ExpiresAt) {
+		return nil, ErrExpiredInvitation
+	}
+	return invitations[0], nil
+}
+
+// claim marks the pending invitation as accepted, the row lock makes the invitation single use
+func (s *DbService) claim(tx *gorm.DB, token string) (*Invitation, *model.Account, error) {
+	inv, err := s.pending(tx.Clauses(clause.Locking{Strength: "UPDATE"}), token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	account := &model.Account{}
+	err = tx.Where("id = ?", inv.AccountID).First(account).Error
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get account")
+	}
+	err = tx.Model(inv).Update("accepted_at", time.Now()).Error
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to update invitation")
+	}
+	return inv, account, nil
+}
+
+// grantRole returns the rules with the invited role, a user who already has it doesn't get it twice
+func grantRole(rules []policy.Rule, inv *Invitation, username string, account *model.Account) []policy.Rule {
+	role := map[string]bool{inv.Role: true}
+	return groupsync.SetRoles(rules, username, account.Ulid, role, role)
+}
+
+func acceptedComment(inv *Invitation) string {
+	return fmt.Sprintf("accepted invitation %s", inv.Ulid)
+}
+
+// token is the invitation's ULID with a signature, the row holds the state so the token can be revoked
+func (s *DbService) token(inv *Invitation) string {
+	return inv.Ulid + "." + s.sign(inv.Ulid)
+}
+
+func (s *DbService) sign(ulid string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte("invitation|" + ulid))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,256 @@
+package invitation
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/mailer"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/policy"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+type fakeMailer struct {
+	sent []*mailer.Message
+	err  error
+}
+
+func (m *fakeMailer) Send(msg *mailer.Message) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func newTestService(t *testing.T) (*DbService, *gorm.DB, *fakeMailer) {
+	db := dbtest.Open(t)
+	m := &fakeMailer{}
+	s := NewDbService(db, dbtest.Logger(), util.NewUlidManager(), policy.NewDbManager(db, dbtest.Logger()), m, []byte("test-key"), "http://localhost/accept", time.Hour)
+	return s, db, m
+}
+
+func hasRole(t *testing.T, s *DbService, username string, role string, account *model.Account) bool {
+	rules, err := s.policyManager.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, rule := range rules {
+		if strings.Join(rule, ",") == strings.Join([]string{"g", username, role, account.Ulid}, ",") {
+			count++
+		}
+	}
+	if count > 1 {
+		t.Errorf("%s has the role %s %d times", username, role, count)
+	}
+	return count > 0
+}
+
+func isPending(t *testing.T, db *gorm.DB, inv *Invitation) bool {
+	reloaded := &Invitation{}
+	err := db.Where("id = ?", inv.ID).First(reloaded).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reloaded.AcceptedAt == nil
+}
+
+func TestLookupInvalidToken(t *testing.T) {
+	// the signature is checked before the database is asked
+	s := &DbService{key: []byte("test-key")}
+	inv := &Invitation{Ulid: "01JAAAAAAAAAAAAAAAAAAAAAAA"}
+	other := &DbService{key: []byte("other-key")}
+	for _, token := range []string{"", inv.Ulid, inv.Ulid + ".", other.token(inv), inv.Ulid + "." + strings.Repeat("0", 64)} {
+		_, err := s.Lookup(token)
+		if !errors.Is(err, ErrInvalidInvitation) {
+			t.Errorf("Lookup(%q) = %v, want %v", token, err, ErrInvalidInvitation)
+		}
+	}
+}
+
+func TestInvite(t *testing.T) {
+	tests := []struct {
+		name      string
+		email     string
+		mailerErr error
+		wantErr   error
+	}{
+		{name: "sends the link", email: "jane@example.com"},
+		{name: "invalid email", email: "Jane <jane@example.com>", wantErr: ErrInvalidEmail},
+		{name: "email not sent", email: "jane@example.com", mailerErr: errors.New("smtp down")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db, m := newTestService(t)
+			m.err = tt.mailerErr
+			account := dbtest.Account(t, db, "acme")
+
+			inv, err := s.Invite(account, tt.email, "viewer", "admin@example.com")
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if tt.mailerErr != nil && err == nil {
+				t.Fatal("expected an error when the email can't be sent")
+			}
+
+			pending, err2 := s.Pending(account.ID)
+			if err2 != nil {
+				t.Fatal(err2)
+			}
+			if err != nil {
+				if len(pending) != 0 {
+					t.Errorf("expected no invitation to be stored, got %d", len(pending))
+				}
+				return
+			}
+			if len(pending) != 1 || len(m.sent) != 1 || !strings.Contains(m.sent[0].Body, s.token(inv)) {
+				t.Errorf("expected a pending invitation and an email with its link, got %d invitations and %d emails", len(pending), len(m.sent))
+			}
+		})
+	}
+}
+
+func TestAccept(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare changes the invitation or the database before the invitation is accepted
+		prepare func(t *testing.T, db *gorm.DB, inv *Invitation)
+		token   func(s *DbService, inv *Invitation) string
+		wantErr error
+	}{
+		{name: "creates the user"},
+		{
+			name: "expired",
+			prepare: func(t *testing.T, db *gorm.DB, inv *Invitation) {
+				db.Model(inv).Update("expires_at", time.Now().Add(-time.Minute))
+			},
+			wantErr: ErrExpiredInvitation,
+		},
+		{
+			name: "revoked",
+			prepare: func(t *testing.T, db *gorm.DB, inv *Invitation) {
+				db.Model(inv).Update("revoked_at", time.Now())
+			},
+			wantErr: ErrInvalidInvitation,
+		},
+		{
+			name: "tampered token",
+			token: func(s *DbService, inv *Invitation) string {
+				return inv.Ulid + ".0000"
+			},
+			wantErr: ErrInvalidInvitation,
+		},
+		{
+			name: "username taken",
+			prepare: func(t *testing.T, db *gorm.DB, inv *Invitation) {
+				dbtest.User(t, db, dbtest.Account(t, db, "other"), "JANE@example.com")
+			},
+			wantErr: ErrUsernameTaken,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db, _ := newTestService(t)
+			account := dbtest.Account(t, db, "acme")
+			inv, err := s.Invite(account, "jane@example.com", "viewer", "admin@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.prepare != nil {
+				tt.prepare(t, db, inv)
+			}
+			token := s.token(inv)
+			if tt.token != nil {
+				token = tt.token(s, inv)
+			}
+
+			user, err := s.Accept(token, "hash")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				// nothing of the failed acceptance is kept
+				if tt.wantErr == ErrUsernameTaken && !isPending(t, db, inv) {
+					t.Error("expected the invitation to stay pending")
+				}
+				if hasRole(t, s, "jane@example.com", "viewer", account) {
+					t.Error("expected no role to be granted")
+				}
+				return
+			}
+
+			if user.Username != "jane@example.com" || user.Account.ID != account.ID || user.EmailVerifiedAt == nil {
+				t.Errorf("unexpected user %+v", user)
+			}
+			if !hasRole(t, s, user.Username, "viewer", account) {
+				t.Error("expected the invited role to be granted")
+			}
+			if isPending(t, db, inv) {
+				t.Error("expected the invitation to be accepted")
+			}
+			// the invitation is single use
+			_, err = s.Accept(token, "hash")
+			if !errors.Is(err, ErrInvalidInvitation) {
+				t.Errorf("got %v for a reused invitation, want %v", err, ErrInvalidInvitation)
+			}
+		})
+	}
+}
+
+func TestJoin(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		// hasRole is true if the user already has the invited role in the account
+		hasRole bool
+		wantErr error
+	}{
+		{name: "joins the account", username: "jane@example.com"},
+		{name: "email differs in case", username: "Jane@Example.com"},
+		{name: "already has the role", username: "jane@example.com", hasRole: true},
+		{name: "another user", username: "john@example.com", wantErr: ErrWrongUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db, _ := newTestService(t)
+			account := dbtest.Account(t, db, "acme")
+			user := dbtest.User(t, db, dbtest.Account(t, db, "home"), tt.username)
+			if tt.hasRole {
+				_, err := s.policyManager.Apply([]policy.Rule{{"g", user.Username, "viewer", account.Ulid}}, "test", "")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			inv, err := s.Invite(account, "jane@example.com", "viewer", "admin@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			joined, err := s.Join(s.token(inv), user)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			var members int64
+			err = db.Table("account_memberships").Where("user_id = ? AND account_id = ?", user.ID, account.ID).Count(&members).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != nil {
+				if members != 0 || hasRole(t, s, user.Username, "viewer", account) || !isPending(t, db, inv) {
+					t.Error("expected the failed join to be rolled back")
+				}
+				return
+			}
+			if joined.ID != account.ID || members != 1 || !hasRole(t, s, user.Username, "viewer", account) {
+				t.Errorf("expected %s to be a member with the invited role", user.Username)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package loginguard
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// Throttle tracks failed logins for a single key, e.g. a username or a client IP
+type Throttle struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+func (Throttle) TableName() string {
+	return "login_throttles"
+}
+
+func UsernameKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+type Config struct {
+	// Prefix of the keys, guards of other attempts than logins share the table with their own scope, e.g. "reset"
+	Scope string
+	// Failures after which a username is locked out
+	MaxFailuresPerUser int
+	// Failures after which an IP is locked out, usually higher than per user because of NAT
+	MaxFailuresPerIP int
+	// How long a lockout lasts, failures older than this are forgotten
+	LockoutDuration time.Duration
+	// Delay after the first failure, doubled with every further failure
+	BackoffBase time.Duration
+	// Upper bound of the delay between attempts
+	BackoffMax time.Duration
+}
+
+type Guard interface {
+	// Returns how long the caller has to wait before the next attempt, zero if the attempt is allowed
+	Check(username string, ip string) (time.Duration, error)
+	// Records a failed attempt for the username and the IP
+	RecordFailure(username string, ip string) error
+	// Forgets failed attempts of the username after a successful login
+	RecordSuccess(username string) error
+	// Lifts the lockout of the username
+	Unlock(username string) error
+}
+
+var _ Guard = &DbGuard{}
+
+// DbGuard keeps the counters in the database so that lockouts survive restarts and are shared across replicas
+type DbGuard struct {
+	db     *gorm.DB
+	logger *slog.Logger
+	config Config
+}
+
+func NewDbGuard(db *gorm.DB, logger *slog.Logger, config Config) *DbGuard {
+	return &DbGuard{db: db, logger: logger.With("subcomponent", "loginguard/DbGuard"), config: config}
+}
+
+func (g *DbGuard) Check(username string, ip string) (time.Duration, error) {
+	throttles := []*Throttle{}
+	err := g.db.Where("key IN ?", []string{g.key(UsernameKey(username)), g.key(IPKey(ip))}).Find(&throttles).Error
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get login throttles")
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	for _, t := range throttles {
+		if t.LastFailureAt.Add(g.config.LockoutDuration).Before(now) {
+			// failures are old enough to be forgotten
+			continue
+		}
+		next := t.LastFailureAt.Add(g.backoff(t.Failures))
+		if t.LockedUntil != nil && t.LockedUntil.After(next) {
+			next = *t.LockedUntil
+		}
+		if next.Sub(now) > wait {
+			wait = next.Sub(now)
+		}
+	}
+	return wait, nil
+}
+
+func (g *DbGuard) RecordFailure(username string, ip string) error {
+	err := g.recordFailure(g.key(UsernameKey(username)), g.config.MaxFailuresPerUser)
+	if err != nil {
+		return err
+	}
+	return g.recordFailure(g.key(IPKey(ip)), g.config.MaxFailuresPerIP)
+}
+
+func (g *DbGuard) recordFailure(key string, maxFailures int) error {
+	now := time.Now()
+	var failures int
+	err := g.db.Raw(`
+		INSERT INTO login_throttles (key, failures, last_failure_at) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_throttles.last_failure_at < ? THEN 1 ELSE login_throttles.failures + 1 END,
+			last_failure_at = EXCLUDED.last_failure_at
+		RETURNING failures`,
+		key, now, now.Add(-g.config.LockoutDuration),
+	).Scan(&failures).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to record login failure")
+	}
+
+	if failures >= maxFailures {
+		err = g.db.Model(&Throttle{}).Where("key = ?", key).Update("locked_until", now.Add(g.config.LockoutDuration)).Error
+		if err != nil {
+			return errors.Wrap(err, "failed to lock out")
+		}
+		g.logger.Warn("locked out after failed attempts", "key", key, "failures", failures)
+	}
+	return nil
+}
+
+func (g *DbGuard) RecordSuccess(username string) error {
+	return g.Unlock(username)
+}
+
+func (g *DbGuard) Unlock(username string) error {
+	err := g.db.Where("key = ?", g.key(UsernameKey(username))).Delete(&Throttle{}).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to unlock")
+	}
+	return nil
+}
+
+// key prefixes the key with the scope of the guard, logins have none
+func (g *DbGuard) key(key string) string {
+	if g.config.Scope == "" {
+		return key
+	}
+	return g.config.Scope + ":" + key
+}
+
+// backoff grows exponentially with the number of failures
+func (g *DbGuard) backoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	backoff := g.config.BackoffBase
+	for i := 1; i < failures && backoff < g.config.BackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > g.config.BackoffMax {
+		backoff = g.config.BackoffMax
+	}
+	return backoff
+}
@@ -0,0 +1,103 @@
+package loginguard
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+func TestBackoff(t *testing.T) {
+	g := &DbGuard{config: Config{BackoffBase: time.Second, BackoffMax: 10 * time.Second}}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		got := g.backoff(tt.failures)
+		if got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	if UsernameKey("Jane@Example.com") != UsernameKey("jane@example.com") {
+		t.Error("username keys must be case-insensitive")
+	}
+	if UsernameKey("203.0.113.7") == IPKey("203.0.113.7") {
+		t.Error("username and IP keys must not collide")
+	}
+	login := &DbGuard{}
+	reset := &DbGuard{config: Config{Scope: "reset"}}
+	if login.key(UsernameKey("jane@example.com")) == reset.key(UsernameKey("jane@example.com")) {
+		t.Error("keys of guards with different scopes must not collide")
+	}
+}
+
+func TestDbGuard(t *testing.T) {
+	tests := []struct {
+		name string
+		// failed logins of jane, each from its own IP
+		userFailures int
+		// failed logins from the IP, each for its own username
+		ipFailures int
+		success    bool
+		wantWait   time.Duration
+	}{
+		{name: "no failures"},
+		{name: "backoff after a failure", userFailures: 1, wantWait: time.Minute},
+		{name: "locked out username", userFailures: 3, wantWait: time.Hour},
+		{name: "success resets the username", userFailures: 3, success: true},
+		{name: "locked out IP", ipFailures: 5, wantWait: time.Hour},
+		{name: "success doesn't reset the IP", ipFailures: 5, success: true, wantWait: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Open(t)
+			// the backoff is long enough to tell it apart from the lockout
+			g := NewDbGuard(db, dbtest.Logger(), Config{
+				MaxFailuresPerUser: 3,
+				MaxFailuresPerIP:   5,
+				LockoutDuration:    time.Hour,
+				BackoffBase:        time.Minute,
+				BackoffMax:         time.Minute,
+			})
+			for i := 0; i < tt.userFailures; i++ {
+				err := g.RecordFailure("jane@example.com", fmt.Sprintf("198.51.100.%d", i))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < tt.ipFailures; i++ {
+				err := g.RecordFailure(fmt.Sprintf("user%d@example.com", i), "203.0.113.7")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.success {
+				err := g.RecordSuccess("Jane@example.com")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			wait, err := g.Check("JANE@example.com", "203.0.113.7")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the wait shrinks while the test runs
+			if wait > tt.wantWait || wait < tt.wantWait-time.Minute/2 {
+				t.Errorf("got wait %s, want about %s", wait, tt.wantWait)
+			}
+		})
+	}
+}
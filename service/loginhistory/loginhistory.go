@@ -0,0 +1,119 @@
+package loginhistory
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+)
+
+// How the user tried to log in
+const (
+	MethodPassword   = "password"
+	MethodMfa        = "mfa"
+	MethodSso        = "sso"
+	MethodInvitation = "invitation"
+	MethodToken      = "token"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	// The password was right, the login continues with the second factor
+	OutcomeMfaRequired = "mfa_required"
+)
+
+// Why a login failed
+const (
+	ReasonUnknownUser   = "unknown_user"
+	ReasonWrongPassword = "wrong_password"
+	ReasonInvalidCode   = "invalid_code"
+	ReasonInvalidToken  = "invalid_token"
+	ReasonThrottled     = "throttled"
+	ReasonUsernameTaken = "username_taken"
+	ReasonDeactivated   = "deactivated"
+)
+
+// How many login attempts ForUser returns
+const (
+	DefaultLimit = 50
+	MaxLimit     = 500
+)
+
+// Event is a login attempt, the user is unknown if the attempt failed before the user was found
+type Event struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	UserID    *uint
+	Username  string
+	IP        string
+	UserAgent string
+	Method    string
+	Outcome   string
+	Reason    string
+}
+
+func (Event) TableName() string {
+	return "login_events"
+}
+
+type History interface {
+	// Records a login attempt, successful logins also become the user's last login, except token use
+	Record(event *Event) error
+	// Returns the latest login attempts of the user, newest first.
+	// A limit outside 1..MaxLimit is replaced by DefaultLimit or MaxLimit.
+	ForUser(userID uint, limit int) ([]*Event, error)
+}
+
+var _ History = &DbHistory{}
+
+type DbHistory struct {
+	db     *gorm.DB
+	logger *slog.Logger
+}
+
+func NewDbHistory(db *gorm.DB, logger *slog.Logger) *DbHistory {
+	return &DbHistory{db: db, logger: logger.With("subcomponent", "loginhistory/DbHistory")}
+}
+
+func (h *DbHistory) Record(event *Event) error {
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(event).Error
+		if err != nil {
+			return errors.Wrap(err, "failed to record login")
+		}
+		if event.Outcome != OutcomeSuccess || event.UserID == nil || event.Method == MethodToken {
+			return nil
+		}
+		err = tx.Model(&model.User{}).Where("id = ?", *event.UserID).Updates(map[string]interface{}{
+			"last_login_at": event.CreatedAt,
+			"last_login_ip": event.IP,
+		}).Error
+		if err != nil {
+			return errors.Wrap(err, "failed to update last login")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	h.logger.Debug("recorded login", "username", event.Username, "method", event.Method, "outcome", event.Outcome, "reason", event.Reason)
+	return nil
+}
+
+func (h *DbHistory) ForUser(userID uint, limit int) ([]*Event, error) {
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	limit = min(limit, MaxLimit)
+	events := []*Event{}
+	err := h.db.Where("user_id = ?", userID).Order("id DESC").Limit(limit).Find(&events).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list logins")
+	}
+	return events, nil
+}
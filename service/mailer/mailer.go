@@ -0,0 +1,116 @@
+package mailer
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	// Sends the message, returns once the message was handed over
+	Send(msg *Message) error
+}
+
+var _ Mailer = &SmtpMailer{}
+var _ Mailer = &FileMailer{}
+var _ Mailer = &LogMailer{}
+
+// format renders the message with headers, ready to be sent or stored
+func format(from string, msg *Message) []byte {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "From: %s\r\n", from)
+	fmt.Fprintf(b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
+
+// SmtpMailer sends messages through an SMTP server, STARTTLS is used when the server supports it
+type SmtpMailer struct {
+	addr   string
+	auth   smtp.Auth
+	from   string
+	logger *slog.Logger
+}
+
+// NewSmtpMailer creates a mailer for the server at addr (host:port), no authentication is used if username is empty
+func NewSmtpMailer(logger *slog.Logger, addr string, username string, password string, from string) (*SmtpMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid smtp address")
+	}
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &SmtpMailer{addr: addr, auth: auth, from: from, logger: logger.With("subcomponent", "mailer/SmtpMailer")}, nil
+}
+
+func (m *SmtpMailer) Send(msg *Message) error {
+	err := smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, format(m.from, msg))
+	if err != nil {
+		return errors.Wrap(err, "failed to send email")
+	}
+	m.logger.Debug("sent email", "to", msg.To, "subject", msg.Subject)
+	return nil
+}
+
+// FileMailer appends messages to a file, for local testing
+type FileMailer struct {
+	path string
+	from string
+	mu   sync.Mutex
+}
+
+func NewFileMailer(path string, from string) *FileMailer {
+	return &FileMailer{path: path, from: from}
+}
+
+func (m *FileMailer) Send(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open mail file")
+	}
+	defer f.Close()
+	_, err = f.Write(append(format(m.from, msg), []byte("\r\n")...))
+	if err != nil {
+		return errors.Wrap(err, "failed to write mail file")
+	}
+	return nil
+}
+
+// LogMailer logs messages instead of sending them, for local testing, the body contains secrets so it must not be used in production
+type LogMailer struct {
+	logger *slog.Logger
+}
+
+func NewLogMailer(logger *slog.Logger) *LogMailer {
+	return &LogMailer{logger: logger.With("subcomponent", "mailer/LogMailer")}
+}
+
+func (m *LogMailer) Send(msg *Message) error {
+	m.logger.Info("email", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
@@ -0,0 +1,106 @@
+package membership
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+)
+
+// Membership links a user to an account they can switch to, the user's own AccountID is their home account which they log in to
+type Membership struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	UserID    uint
+	AccountID uint
+	Account   *model.Account
+	// When the account's directory deactivated the user, the membership is kept so that the directory can reactivate it
+	DeactivatedAt *time.Time
+}
+
+func (Membership) TableName() string {
+	return "account_memberships"
+}
+
+type Service interface {
+	// Returns the active memberships of the user with their accounts
+	Memberships(userID uint) ([]*Membership, error)
+	// Returns true if the user is an active member of the account
+	IsMember(userID uint, accountID uint) (bool, error)
+	// Returns true if the user is an active member of any account, users deactivated everywhere can't log in
+	HasActive(userID uint) (bool, error)
+	// Adds the user to the account, adding an existing member is not an error
+	Add(userID uint, accountID uint) error
+}
+
+var _ Service = &DbService{}
+
+type DbService struct {
+	db     *gorm.DB
+	logger *slog.Logger
+}
+
+func NewDbService(db *gorm.DB, logger *slog.Logger) *DbService {
+	return &DbService{db: db, logger: logger.With("subcomponent", "membership/DbService")}
+}
+
+func (s *DbService) Memberships(userID uint) ([]*Membership, error) {
+	memberships := []*Membership{}
+	err := s.db.Preload("Account").Where("user_id = ? AND deactivated_at IS NULL", userID).Order("id").Find(&memberships).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list memberships")
+	}
+	return memberships, nil
+}
+
+func (s *DbService) IsMember(userID uint, accountID uint) (bool, error) {
+	var count int64
+	err := s.db.Model(&Membership{}).Where("user_id = ? AND account_id = ? AND deactivated_at IS NULL", userID, accountID).Count(&count).Error
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get membership")
+	}
+	return count > 0, nil
+}
+
+func (s *DbService) HasActive(userID uint) (bool, error) {
+	var count int64
+	err := s.db.Model(&Membership{}).Where("user_id = ? AND deactivated_at IS NULL", userID).Count(&count).Error
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get memberships")
+	}
+	return count > 0, nil
+}
+
+func (s *DbService) Add(userID uint, accountID uint) error {
+	err := Add(s.db, userID, accountID)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("added membership", "userid", userID, "accountid", accountID)
+	return nil
+}
+
+// Add adds the user to the account in the transaction, for services which create users
+func Add(tx *gorm.DB, userID uint, accountID uint) error {
+	err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Membership{UserID: userID, AccountID: accountID}).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to create membership")
+	}
+	return nil
+}
+
+// SetDeactivatedAt deactivates the user's membership of the account in the transaction, nil reactivates it
+func SetDeactivatedAt(tx *gorm.DB, userID uint, accountID uint, deactivatedAt *time.Time) error {
+	err := tx.Model(&Membership{}).
+		Where("user_id = ? AND account_id = ?", userID, accountID).
+		Update("deactivated_at", deactivatedAt).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to update membership")
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package mfa
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const recoveryCodeCount = 10
+
+var ErrNotEnrolled = errors.New("two-factor authentication is not enrolled")
+var ErrAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+var ErrInvalidCode = errors.New("invalid code")
+
+// UserMfa is the TOTP secret of a user, it's only used for logins once confirmed
+type UserMfa struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	UserID       uint
+	Secret       string
+	ConfirmedAt  *time.Time
+	LastUsedStep int64
+}
+
+func (UserMfa) TableName() string {
+	return "user_mfa"
+}
+
+// RecoveryCode is a single-use code which replaces a TOTP code when the authenticator is lost
+type RecoveryCode struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	UserID   uint
+	CodeHash string
+	UsedAt   *time.Time
+}
+
+func (RecoveryCode) TableName() string {
+	return "mfa_recovery_codes"
+}
+
+type Enrollment struct {
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauthUri"`
+}
+
+type Service interface {
+	// Returns true if the user has confirmed a TOTP secret
+	IsEnabled(userID uint) (bool, error)
+	// Creates a new unconfirmed secret, replacing an earlier unconfirmed one
+	Enroll(userID uint, accountName string) (*Enrollment, error)
+	// Enables MFA if the code matches the unconfirmed secret, returns the recovery codes in plain text
+	Confirm(userID uint, code string) ([]string, error)
+	// Returns true if the code is a valid TOTP code or an unused recovery code, recovery codes are consumed
+	Verify(userID uint, code string) (bool, error)
+	// Removes the secret and recovery codes
+	Disable(userID uint) error
+}
+
+var _ Service = &DbService{}
+
+type DbService struct {
+	db     *gorm.DB
+	logger *slog.Logger
+	issuer string
+}
+
+func NewDbService(db *gorm.DB, logger *slog.Logger, issuer string) *DbService {
+	return &DbService{db: db, logger: logger.With("subcomponent", "mfa/DbService"), issuer: issuer}
+}
+
+func (s *DbService) IsEnabled(userID uint) (bool, error) {
+	var count int64
+	err := s.db.Model(&UserMfa{}).Where("user_id = ? AND confirmed_at IS NOT NULL", userID).Count(&count).Error
+	if err != nil {
+		return false, errors.Wrap(err, "failed to check mfa")
+	}
+	return count > 0, nil
+}
+
+func (s *DbService) Enroll(userID uint, accountName string) (*Enrollment, error) {
+	enabled, err := s.IsEnabled(userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrAlreadyEnabled
+	}
+
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ?", userID).Delete(&UserMfa{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&UserMfa{UserID: userID, Secret: secret}).Error
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to store mfa secret")
+	}
+
+	return &Enrollment{
+		Secret:     secret,
+		OtpauthURI: otpauthURI(s.issuer, accountName, secret),
+	}, nil
+}
+
+func (s *DbService) Confirm(userID uint, code string) ([]string, error) {
+	userMfa, err := s.get(userID)
+	if err != nil {
+		return nil, err
+	}
+	if userMfa.ConfirmedAt != nil {
+		return nil, ErrAlreadyEnabled
+	}
+	step, err := validateTOTP(userMfa.Secret, code, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if step == 0 {
+		return nil, ErrInvalidCode
+	}
+
+	codes := []string{}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Model(userMfa).Updates(map[string]interface{}{"confirmed_at": now, "last_used_step": step}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+		if err != nil {
+			return err
+		}
+		for i := 0; i < recoveryCodeCount; i++ {
+			code, err := generateRecoveryCode()
+			if err != nil {
+				return err
+			}
+			err = tx.Create(&RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(code)}).Error
+			if err != nil {
+				return err
+			}
+			codes = append(codes, code)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to confirm mfa")
+	}
+	s.logger.Info("enabled mfa", "userid", userID)
+	return codes, nil
+}
+
+func (s *DbService) Verify(userID uint, code string) (bool, error) {
+	userMfa, err := s.get(userID)
+	if err != nil {
+		return false, err
+	}
+	if userMfa.ConfirmedAt == nil {
+		return false, ErrNotEnrolled
+	}
+
+	step, err := validateTOTP(userMfa.Secret, code, time.Now())
+	if err != nil {
+		return false, err
+	}
+	if step != 0 {
+		// every code can only be used once
+		result := s.db.Model(&UserMfa{}).
+			Where("id = ? AND last_used_step < ?", userMfa.ID, step).
+			Update("last_used_step", step)
+		if result.Error != nil {
+			return false, errors.Wrap(result.Error, "failed to update mfa")
+		}
+		return result.RowsAffected == 1, nil
+	}
+
+	// fall back to recovery codes
+	result := s.db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, errors.Wrap(result.Error, "failed to use recovery code")
+	}
+	if result.RowsAffected > 0 {
+		s.logger.Info("used mfa recovery code", "userid", userID)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *DbService) Disable(userID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+		if err != nil {
+			return errors.Wrap(err, "failed to delete recovery codes")
+		}
+		err = tx.Where("user_id = ?", userID).Delete(&UserMfa{}).Error
+		if err != nil {
+			return errors.Wrap(err, "failed to delete mfa secret")
+		}
+		return nil
+	})
+}
+
+func (s *DbService) get(userID uint) (*UserMfa, error) {
+	userMfas := []*UserMfa{}
+	err := s.db.Where("user_id = ?", userID).Limit(1).Find(&userMfas).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get mfa")
+	}
+	if len(userMfas) == 0 {
+		return nil, ErrNotEnrolled
+	}
+	return userMfas[0], nil
+}
+
+// generateRecoveryCode returns a code like "abcde-fghij", 50 bits of entropy
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to generate recovery code")
+	}
+	code := strings.ToLower(secretEncoding.EncodeToString(b))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// hashRecoveryCode uses a plain hash, recovery codes are random so a slow hash is not needed
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
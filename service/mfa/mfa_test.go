@@ -0,0 +1,98 @@
+package mfa
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+func currentCode(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+	code, err := totpCode(secret, totpStep(time.Now())+offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestDbService(t *testing.T) {
+	db := dbtest.Open(t)
+	user := dbtest.User(t, db, dbtest.Account(t, db, "acme"), "jane@example.com")
+	s := NewDbService(db, dbtest.Logger(), "Example")
+
+	_, err := s.Verify(user.ID, "123456")
+	if !errors.Is(err, ErrNotEnrolled) {
+		t.Fatalf("expected ErrNotEnrolled before enrolling, got %v", err)
+	}
+
+	// a second enrollment replaces the unconfirmed secret
+	_, err = s.Enroll(user.ID, user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrollment, err := s.Enroll(user.ID, user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Verify(user.ID, currentCode(t, enrollment.Secret, 0))
+	if !errors.Is(err, ErrNotEnrolled) {
+		t.Fatalf("expected ErrNotEnrolled before confirming, got %v", err)
+	}
+	_, err = s.Confirm(user.ID, "000000")
+	if !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("expected ErrInvalidCode, got %v", err)
+	}
+
+	// the confirming code is used up, the next step's code is still valid
+	recoveryCodes, err := s.Confirm(user.ID, currentCode(t, enrollment.Secret, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %d", recoveryCodeCount, len(recoveryCodes))
+	}
+	enabled, err := s.IsEnabled(user.ID)
+	if err != nil || !enabled {
+		t.Fatalf("expected mfa to be enabled, got %v, %v", enabled, err)
+	}
+	_, err = s.Enroll(user.ID, user.Username)
+	if !errors.Is(err, ErrAlreadyEnabled) {
+		t.Fatalf("expected ErrAlreadyEnabled, got %v", err)
+	}
+
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{"replayed confirmation code", currentCode(t, enrollment.Secret, -1), false},
+		{"current code", currentCode(t, enrollment.Secret, 0), true},
+		{"replayed current code", currentCode(t, enrollment.Secret, 0), false},
+		{"older code after a newer one", currentCode(t, enrollment.Secret, -1), false},
+		{"wrong code", "000000", false},
+		{"recovery code", recoveryCodes[0], true},
+		{"used recovery code", recoveryCodes[0], false},
+		{"another recovery code typed differently", " " + recoveryCodes[1][:5] + recoveryCodes[1][6:] + " ", true},
+	}
+	for _, tt := range tests {
+		valid, err := s.Verify(user.ID, tt.code)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if valid != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, valid, tt.want)
+		}
+	}
+
+	err = s.Disable(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enabled, err = s.IsEnabled(user.ID)
+	if err != nil || enabled {
+		t.Fatalf("expected mfa to be disabled, got %v, %v", enabled, err)
+	}
+}
@@ -0,0 +1,96 @@
+package mfa
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 key of the RFC 6238 test vectors, "12345678901234567890" in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTotpCode(t *testing.T) {
+	// RFC 6238 appendix B, the last 6 of the 8 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, totpStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := totpStep(now)
+	code := func(step int64) string {
+		c, err := totpCode(rfc6238Secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+	}{
+		{"current step", code(step), step},
+		{"previous step", code(step - 1), step - 1},
+		{"next step", code(step + 1), step + 1},
+		{"outside the skew", code(step - 2), 0},
+		{"surrounding whitespace", " " + code(step) + "\n", step},
+		{"too short", code(step)[:5], 0},
+		{"wrong code", "000000", 0},
+		{"empty", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateTOTP(rfc6238Secret, tt.code, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.wantStep {
+				t.Errorf("got step %d, want %d", got, tt.wantStep)
+			}
+		})
+	}
+}
+
+func TestOtpauthURI(t *testing.T) {
+	uri := otpauthURI("Example", "jane@example.com", rfc6238Secret)
+	for _, want := range []string{"otpauth://totp/Example:jane@example.com?", "secret=" + rfc6238Secret, "issuer=Example", "digits=6", "period=30"} {
+		if !strings.Contains(uri, want) {
+			t.Errorf("%s doesn't contain %s", uri, want)
+		}
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+	code, err := generateRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 11 || code[5] != '-' {
+		t.Fatalf("unexpected format %q", code)
+	}
+	// codes are typed by hand, the hash ignores case, dashes and surrounding whitespace
+	for _, typed := range []string{strings.ToUpper(code), strings.ReplaceAll(code, "-", ""), " " + code + " "} {
+		if hashRecoveryCode(typed) != hashRecoveryCode(code) {
+			t.Errorf("%q doesn't match %q", typed, code)
+		}
+	}
+}
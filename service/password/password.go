@@ -0,0 +1,167 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+var ErrUnknownAlgorithm = errors.New("unknown password hash algorithm")
+
+// Config selects the algorithm new hashes are created with, hashes of the other algorithm are still verified
+type Config struct {
+	// argon2id or bcrypt
+	Algorithm string
+	// Memory in KiB used by argon2id
+	Argon2Memory uint32
+	// Number of passes over the memory
+	Argon2Time uint32
+	// Degree of parallelism
+	Argon2Threads uint8
+	// Cost of bcrypt hashes
+	BcryptCost int
+}
+
+type Hasher interface {
+	// Returns a self-describing hash of the password, argon2id hashes use the PHC string format
+	Hash(password string) (string, error)
+	// Returns true if the password matches the hash, an empty hash never matches
+	Verify(password string, hash string) (bool, error)
+	// Returns true if the hash wasn't created with the current algorithm and parameters
+	NeedsRehash(hash string) bool
+}
+
+var _ Hasher = &PHCHasher{}
+
+type PHCHasher struct {
+	config Config
+}
+
+func NewPHCHasher(config Config) (*PHCHasher, error) {
+	switch config.Algorithm {
+	case AlgorithmArgon2id:
+		if config.Argon2Memory < 8*uint32(config.Argon2Threads) || config.Argon2Time < 1 || config.Argon2Threads < 1 {
+			return nil, errors.New("invalid argon2id parameters")
+		}
+	case AlgorithmBcrypt:
+		if config.BcryptCost < bcrypt.MinCost || config.BcryptCost > bcrypt.MaxCost {
+			return nil, errors.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return nil, ErrUnknownAlgorithm
+	}
+	return &PHCHasher{config: config}, nil
+}
+
+func (h *PHCHasher) Hash(password string) (string, error) {
+	if h.config.Algorithm == AlgorithmBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.config.BcryptCost)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to hash password")
+		}
+		return string(hash), nil
+	}
+
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to generate salt")
+	}
+	params := argon2Params{memory: h.config.Argon2Memory, time: h.config.Argon2Time, threads: h.config.Argon2Threads}
+	key := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.memory, params.time, params.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *PHCHasher) Verify(password string, hash string) (bool, error) {
+	switch {
+	case hash == "":
+		// users of external identity providers have no local password
+		return false, nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	case isBcrypt(hash):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrap(err, "failed to compare bcrypt hash")
+		}
+		return true, nil
+	default:
+		return false, ErrUnknownAlgorithm
+	}
+}
+
+func (h *PHCHasher) NeedsRehash(hash string) bool {
+	switch h.config.Algorithm {
+	case AlgorithmArgon2id:
+		params, _, _, err := parseArgon2id(hash)
+		if err != nil {
+			return true
+		}
+		return params.memory < h.config.Argon2Memory || params.time < h.config.Argon2Time || params.threads != h.config.Argon2Threads
+	default:
+		if !isBcrypt(hash) {
+			// argon2id isn't downgraded to bcrypt
+			return !strings.HasPrefix(hash, "$argon2id$")
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost < h.config.BcryptCost
+	}
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// parseArgon2id parses $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func parseArgon2id(hash string) (argon2Params, []byte, []byte, error) {
+	params := argon2Params{}
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[1] != AlgorithmArgon2id {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+	var version int
+	_, err := fmt.Sscanf(fields[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2id version")
+	}
+	_, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return params, nil, nil, errors.Wrap(err, "invalid argon2id parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return params, nil, nil, errors.Wrap(err, "invalid argon2id salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errors.New("invalid argon2id key")
+	}
+	return params, salt, key, nil
+}
+
+// isBcrypt recognizes the modular crypt format of bcrypt, $2a$, $2b$ or $2y$
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
@@ -0,0 +1,162 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fastArgon2 keeps the tests fast, production parameters are much higher
+var fastArgon2 = Config{Algorithm: AlgorithmArgon2id, Argon2Memory: 64, Argon2Time: 1, Argon2Threads: 1}
+
+func newHasher(t *testing.T, config Config) *PHCHasher {
+	t.Helper()
+	h, err := NewPHCHasher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func hash(t *testing.T, config Config, password string) string {
+	t.Helper()
+	hash, err := newHasher(t, config).Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestNewPHCHasher(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "argon2id", config: fastArgon2},
+		{name: "argon2id with 8 KiB per thread", config: Config{Algorithm: AlgorithmArgon2id, Argon2Memory: 32, Argon2Time: 1, Argon2Threads: 4}},
+		{name: "argon2id with less than 8 KiB per thread", config: Config{Algorithm: AlgorithmArgon2id, Argon2Memory: 31, Argon2Time: 1, Argon2Threads: 4}, wantErr: true},
+		{name: "argon2id without passes", config: Config{Algorithm: AlgorithmArgon2id, Argon2Memory: 64, Argon2Time: 0, Argon2Threads: 1}, wantErr: true},
+		{name: "argon2id without threads", config: Config{Algorithm: AlgorithmArgon2id, Argon2Memory: 64, Argon2Time: 1, Argon2Threads: 0}, wantErr: true},
+		{name: "bcrypt minimum cost", config: Config{Algorithm: AlgorithmBcrypt, BcryptCost: bcrypt.MinCost}},
+		{name: "bcrypt cost too low", config: Config{Algorithm: AlgorithmBcrypt, BcryptCost: bcrypt.MinCost - 1}, wantErr: true},
+		{name: "bcrypt cost too high", config: Config{Algorithm: AlgorithmBcrypt, BcryptCost: bcrypt.MaxCost + 1}, wantErr: true},
+		{name: "unknown algorithm", config: Config{Algorithm: "md5"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPHCHasher(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseArgon2id(t *testing.T) {
+	tests := []struct {
+		name       string
+		hash       string
+		wantParams argon2Params
+		wantErr    bool
+	}{
+		{name: "valid", hash: "$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5", wantParams: argon2Params{memory: 65536, time: 3, threads: 2}},
+		{name: "missing key", hash: "$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHRzYWx0c2FsdA", wantErr: true},
+		{name: "empty key", hash: "$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHRzYWx0c2FsdA$", wantErr: true},
+		{name: "argon2i", hash: "$argon2i$v=19$m=65536,t=3,p=2$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5", wantErr: true},
+		{name: "old version", hash: "$argon2id$v=16$m=65536,t=3,p=2$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5", wantErr: true},
+		{name: "missing parameters", hash: "$argon2id$v=19$m=65536$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5", wantErr: true},
+		{name: "padded salt", hash: "$argon2id$v=19$m=65536,t=3,p=2$c2FsdA==$a2V5a2V5a2V5a2V5", wantErr: true},
+		{name: "invalid key", hash: "$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHRzYWx0c2FsdA$!!!", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, _, _, err := parseArgon2id(tt.hash)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && params != tt.wantParams {
+				t.Errorf("got %+v, want %+v", params, tt.wantParams)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	bcryptConfig := Config{Algorithm: AlgorithmBcrypt, BcryptCost: bcrypt.MinCost}
+	argon2Hash := hash(t, fastArgon2, "correct horse")
+	bcryptHash := hash(t, bcryptConfig, "correct horse")
+	tests := []struct {
+		name     string
+		password string
+		hash     string
+		want     bool
+		wantErr  bool
+		// unknown is true if the hash isn't recognized as argon2id or bcrypt
+		unknown bool
+	}{
+		{name: "argon2id", password: "correct horse", hash: argon2Hash, want: true},
+		{name: "argon2id wrong password", password: "battery staple", hash: argon2Hash},
+		{name: "bcrypt", password: "correct horse", hash: bcryptHash, want: true},
+		{name: "bcrypt wrong password", password: "battery staple", hash: bcryptHash},
+		{name: "legacy $2y$ bcrypt", password: "correct horse", hash: "$2y$" + strings.TrimPrefix(bcryptHash, "$2a$"), want: true},
+		{name: "no local password", password: "", hash: ""},
+		{name: "truncated argon2id", password: "correct horse", hash: argon2Hash[:strings.LastIndex(argon2Hash, "$")], wantErr: true},
+		{name: "truncated bcrypt", password: "correct horse", hash: bcryptHash[:20], wantErr: true},
+		{name: "md5 crypt", password: "correct horse", hash: "$1$saltsalt$hash", wantErr: true, unknown: true},
+		{name: "plain text", password: "correct horse", hash: "correct horse", wantErr: true, unknown: true},
+	}
+	// both hashers verify hashes of both algorithms
+	for _, config := range []Config{fastArgon2, bcryptConfig} {
+		h := newHasher(t, config)
+		for _, tt := range tests {
+			t.Run(config.Algorithm+"/"+tt.name, func(t *testing.T) {
+				got, err := h.Verify(tt.password, tt.hash)
+				if (err != nil) != tt.wantErr || errors.Is(err, ErrUnknownAlgorithm) != tt.unknown {
+					t.Fatalf("got %v, want error %v, unknown algorithm %v", err, tt.wantErr, tt.unknown)
+				}
+				if got != tt.want {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// the login rehashes a verified password if NeedsRehash returns true
+func TestNeedsRehash(t *testing.T) {
+	stronger := fastArgon2
+	stronger.Argon2Memory = 128
+	moreThreads := fastArgon2
+	moreThreads.Argon2Threads = 2
+	bcrypt4 := Config{Algorithm: AlgorithmBcrypt, BcryptCost: 4}
+	bcrypt5 := Config{Algorithm: AlgorithmBcrypt, BcryptCost: 5}
+	tests := []struct {
+		name   string
+		config Config
+		hash   string
+		want   bool
+	}{
+		{name: "argon2id with the same parameters", config: fastArgon2, hash: hash(t, fastArgon2, "secret")},
+		{name: "argon2id with stronger parameters", config: fastArgon2, hash: hash(t, stronger, "secret")},
+		{name: "argon2id with less memory", config: stronger, hash: hash(t, fastArgon2, "secret"), want: true},
+		{name: "argon2id with other threads", config: moreThreads, hash: hash(t, fastArgon2, "secret"), want: true},
+		{name: "bcrypt to argon2id", config: fastArgon2, hash: hash(t, bcrypt4, "secret"), want: true},
+		{name: "malformed hash to argon2id", config: fastArgon2, hash: "$argon2id$v=19$m=64", want: true},
+		{name: "bcrypt with the same cost", config: bcrypt4, hash: hash(t, bcrypt4, "secret")},
+		{name: "bcrypt with a higher cost", config: bcrypt4, hash: hash(t, bcrypt5, "secret")},
+		{name: "bcrypt with a lower cost", config: bcrypt5, hash: hash(t, bcrypt4, "secret"), want: true},
+		{name: "argon2id isn't downgraded to bcrypt", config: bcrypt4, hash: hash(t, fastArgon2, "secret")},
+		{name: "unknown hash to bcrypt", config: bcrypt4, hash: "$1$saltsalt$hash", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newHasher(t, tt.config).NeedsRehash(tt.hash)
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Violation is returned when a password is rejected by the policy, its message is safe to show to users
+type Violation struct {
+	Reason string
+}
+
+func (v *Violation) Error() string {
+	return v.Reason
+}
+
+// Policy is checked whenever a user chooses a password, existing passwords aren't affected
+type Policy struct {
+	// Minimum number of characters
+	MinLength int
+	// Known breached passwords, nil disables the check
+	Breached BreachedList
+}
+
+// Check returns a *Violation if the password is not acceptable for the user, other errors are internal
+func (p *Policy) Check(password string, username string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return &Violation{Reason: fmt.Sprintf("the password must be at least %d characters long", p.MinLength)}
+	}
+	if containsUsername(password, username) {
+		return &Violation{Reason: "the password must not contain the username"}
+	}
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			return &Violation{Reason: "the password appeared in a data breach, choose another one"}
+		}
+	}
+	return nil
+}
+
+// containsUsername also checks the local part of email usernames, too short parts are ignored
+func containsUsername(password string, username string) bool {
+	password = strings.ToLower(password)
+	username = strings.ToLower(username)
+	parts := []string{username}
+	if local, _, found := strings.Cut(username, "@"); found {
+		parts = append(parts, local)
+	}
+	for _, part := range parts {
+		if len(part) >= 3 && strings.Contains(password, part) {
+			return true
+		}
+	}
+	return false
+}
+
+type BreachedList interface {
+	// Returns true if the password is a known breached password
+	Contains(password string) (bool, error)
+}
+
+var _ BreachedList = &PrefixDir{}
+
+// PrefixDir is a breached password list split into k-anonymity prefix files, as served by the Pwned Passwords range API
+//
+// Every file is named after the first 5 hex characters of the SHA-1 of the passwords it holds, e.g. 21BD1,
+// and has one SUFFIX:COUNT line per password with the remaining 35 characters. Only one file is read per check.
+type PrefixDir struct {
+	dir string
+}
+
+func NewPrefixDir(dir string) (*PrefixDir, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open breached passwords directory")
+	}
+	if !info.IsDir() {
+		return nil, errors.Errorf("breached passwords path %s is not a directory", dir)
+	}
+	return &PrefixDir{dir: dir}, nil
+}
+
+func (d *PrefixDir) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(d.dir, prefix))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to open breached passwords file")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		candidate, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(candidate, suffix) {
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, errors.Wrap(err, "failed to read breached passwords file")
+	}
+	return false, nil
+}
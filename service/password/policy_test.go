@@ -0,0 +1,83 @@
+package password
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/breachedtest"
+)
+
+func TestPrefixDir(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		want     bool
+		wantErr  bool
+	}{
+		{name: "breached", password: "password1", want: true},
+		{name: "another breached password", password: "qwerty123", want: true},
+		{name: "no prefix file", password: "correct horse battery staple"},
+		{name: "unreadable prefix file", password: "unreadable", wantErr: true},
+	}
+	dir := breachedtest.Dir(t, "password1", "qwerty123")
+	breachedtest.Unreadable(t, dir, "unreadable")
+	d, err := NewPrefixDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := d.Contains(tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPrefixDir(t *testing.T) {
+	dir := breachedtest.Dir(t, "password1")
+	_, err := NewPrefixDir(filepath.Join(dir, "missing"))
+	if err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	_, err = NewPrefixDir(files[0])
+	if err == nil {
+		t.Error("expected an error for a file")
+	}
+}
+
+func TestPolicyBreached(t *testing.T) {
+	dir := breachedtest.Dir(t, "password1-breached")
+	breachedtest.Unreadable(t, dir, "unreadable-password")
+	breached, err := NewPrefixDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Policy{MinLength: 8, Breached: breached}
+	tests := []struct {
+		name          string
+		password      string
+		wantViolation bool
+		wantErr       bool
+	}{
+		{name: "not breached", password: "correct horse battery staple"},
+		{name: "breached", password: "password1-breached", wantViolation: true, wantErr: true},
+		{name: "list can't be read", password: "unreadable-password", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Check(tt.password, "jane@example.com")
+			var violation *Violation
+			if (err != nil) != tt.wantErr || errors.As(err, &violation) != tt.wantViolation {
+				t.Errorf("got %v, want error %v, violation %v", err, tt.wantErr, tt.wantViolation)
+			}
+		})
+	}
+}
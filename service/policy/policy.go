@@ -0,0 +1,356 @@
+package policy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// AuthorSystem is the author of versions which were not created by a person, e.g. the initial seed
+const AuthorSystem = "system"
+
+// ErrUnknownDomain is returned for rules whose domain isn't the ULID of an account, domains used to be account names
+var ErrUnknownDomain = errors.New("the domain is not an account ULID")
+
+// Rule is a single casbin policy line, the first element is the policy type (p, g, g2)
+type Rule []string
+
+func (r Rule) String() string {
+	return strings.Join(r, ", ")
+}
+
+// DomainIndex returns the position of the domain in the rule, false for rules without a domain, e.g. g2
+func (r Rule) DomainIndex() (int, bool) {
+	switch {
+	case len(r) == 5 && r[0] == "p":
+		return 2, true
+	case len(r) == 4 && r[0] == "g":
+		return 3, true
+	default:
+		return 0, false
+	}
+}
+
+// RewriteDomains returns the rules with each domain replaced by the domains rewrite returns, a rule is copied for
+// every domain and dropped if there are none
+func RewriteDomains(rules []Rule, rewrite func(domain string) []string) []Rule {
+	result := []Rule{}
+	seen := map[string]bool{}
+	add := func(rule Rule) {
+		key := strings.Join(rule, "\x00")
+		if !seen[key] {
+			seen[key] = true
+			result = append(result, rule)
+		}
+	}
+	for _, rule := range rules {
+		i, ok := rule.DomainIndex()
+		if !ok {
+			add(rule)
+			continue
+		}
+		for _, domain := range rewrite(rule[i]) {
+			rewritten := append(Rule{}, rule...)
+			rewritten[i] = domain
+			add(rewritten)
+		}
+	}
+	return result
+}
+
+// Version is an immutable snapshot of the whole policy set
+type Version struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	Version int
+	Author  string
+	Comment string
+	Rules   string // JSON encoded []Rule
+}
+
+func (Version) TableName() string {
+	return "policy_versions"
+}
+
+func (v *Version) DecodeRules() ([]Rule, error) {
+	rules := []Rule{}
+	err := json.Unmarshal([]byte(v.Rules), &rules)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode policy rules")
+	}
+	return rules, nil
+}
+
+// Reloader is notified after the policy set has changed, usually it's the casbin enforcer
+type Reloader interface {
+	LoadPolicy() error
+}
+
+type Manager interface {
+	// Returns all versions, newest first
+	Versions() ([]*Version, error)
+	// Returns the rules of the latest version
+	Current() ([]Rule, error)
+	// Stores the rules as a new version and reloads the enforcer, every domain must be the ULID of an account
+	Apply(rules []Rule, author string, comment string) (*Version, error)
+	// Stores a copy of an earlier version as a new version and reloads the enforcer, every domain must be the ULID of an account
+	Rollback(version int, author string, comment string) (*Version, error)
+	// Applies a change to the rules of the latest version, no version is stored if the rules didn't change
+	Update(author string, comment string, change func(rules []Rule) ([]Rule, error)) (*Version, error)
+	// Like Update, the change gets the transaction so that its other writes are committed together with the new version
+	UpdateTx(author string, comment string, change func(tx *gorm.DB, rules []Rule) ([]Rule, error)) (*Version, error)
+}
+
+var _ Manager = &DbManager{}
+var _ persist.Adapter = &DbManager{}
+
+// DbManager stores policy versions in the database, it also acts as a read-only casbin adapter which loads the latest version
+type DbManager struct {
+	db       *gorm.DB
+	logger   *slog.Logger
+	reloader Reloader
+}
+
+func NewDbManager(db *gorm.DB, logger *slog.Logger) *DbManager {
+	return &DbManager{db: db, logger: logger.With("subcomponent", "policy/DbManager")}
+}
+
+// SetReloader sets the enforcer which is reloaded after every change, the enforcer needs the manager as its adapter so this can't be done in the constructor
+func (m *DbManager) SetReloader(reloader Reloader) {
+	m.reloader = reloader
+}
+
+func (m *DbManager) Versions() ([]*Version, error) {
+	versions := []*Version{}
+	err := m.db.Order("version DESC").Find(&versions).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list policy versions")
+	}
+	return versions, nil
+}
+
+func (m *DbManager) Current() ([]Rule, error) {
+	latest, err := latestVersion(m.db)
+	if err != nil {
+		return nil, err
+	}
+	if latest == nil {
+		return []Rule{}, nil
+	}
+	return latest.DecodeRules()
+}
+
+func (m *DbManager) Apply(rules []Rule, author string, comment string) (*Version, error) {
+	return m.UpdateTx(author, comment, func(tx *gorm.DB, _ []Rule) ([]Rule, error) {
+		return rules, checkDomains(tx, rules)
+	})
+}
+
+func (m *DbManager) Rollback(version int, author string, comment string) (*Version, error) {
+	if comment == "" {
+		comment = fmt.Sprintf("rollback to version %d", version)
+	}
+	return m.UpdateTx(author, comment, func(tx *gorm.DB, _ []Rule) ([]Rule, error) {
+		target := &Version{}
+		err := tx.Where("version = ?", version).First(target).Error
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to find policy version %d", version)
+		}
+		rules, err := target.DecodeRules()
+		if err != nil {
+			return nil, err
+		}
+		return rules, checkDomains(tx, rules)
+	})
+}
+
+func (m *DbManager) Update(author string, comment string, change func(rules []Rule) ([]Rule, error)) (*Version, error) {
+	return m.UpdateTx(author, comment, func(_ *gorm.DB, rules []Rule) ([]Rule, error) {
+		return change(rules)
+	})
+}
+
+func (m *DbManager) UpdateTx(author string, comment string, change func(tx *gorm.DB, rules []Rule) ([]Rule, error)) (*Version, error) {
+	newVersion := &Version{
+		Author:  author,
+		Comment: comment,
+	}
+	unchanged := false
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		// serialize writers so that version numbers are sequential and no change is lost
+		err := tx.Exec("LOCK TABLE policy_versions IN EXCLUSIVE MODE").Error
+		if err != nil {
+			return errors.Wrap(err, "failed to lock policy versions")
+		}
+
+		current := []Rule{}
+		latest, err := latestVersion(tx)
+		if err != nil {
+			return err
+		}
+		if latest != nil {
+			current, err = latest.DecodeRules()
+			if err != nil {
+				return err
+			}
+			newVersion.Version = latest.Version + 1
+		} else {
+			newVersion.Version = 1
+		}
+
+		rules, err := change(tx, current)
+		if err != nil {
+			return err
+		}
+		if latest != nil && reflect.DeepEqual(rules, current) {
+			// nothing changed, don't store a new version
+			unchanged = true
+			*newVersion = *latest
+			return nil
+		}
+		encodedRules, err := json.Marshal(rules)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode policy rules")
+		}
+		newVersion.Rules = string(encodedRules)
+
+		return tx.Create(newVersion).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unchanged {
+		return newVersion, nil
+	}
+	m.logger.Info("stored policy version", "version", newVersion.Version, "author", author, "comment", comment)
+
+	if m.reloader != nil {
+		err = m.reloader.LoadPolicy()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to reload policy")
+		}
+	}
+
+	return newVersion, nil
+}
+
+// checkDomains rejects rules whose domain isn't the ULID of an account, e.g. the account names of older versions
+func checkDomains(db *gorm.DB, rules []Rule) error {
+	domains := []string{}
+	for _, rule := range rules {
+		i, ok := rule.DomainIndex()
+		if !ok {
+			continue
+		}
+		_, err := ulid.ParseStrict(rule[i])
+		if err != nil {
+			return errors.Wrapf(ErrUnknownDomain, "%s", rule)
+		}
+		domains = append(domains, rule[i])
+	}
+	if len(domains) == 0 {
+		return nil
+	}
+
+	known := []string{}
+	err := db.Table("accounts").Where("ulid IN ?", domains).Pluck("ulid", &known).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to get accounts")
+	}
+	accounts := map[string]bool{}
+	for _, u := range known {
+		accounts[u] = true
+	}
+	for _, rule := range rules {
+		i, ok := rule.DomainIndex()
+		if ok && !accounts[rule[i]] {
+			return errors.Wrapf(ErrUnknownDomain, "%s", rule)
+		}
+	}
+	return nil
+}
+
+func latestVersion(db *gorm.DB) (*Version, error) {
+	versions := []*Version{}
+	err := db.Order("version DESC").Limit(1).Find(&versions).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get latest policy version")
+	}
+	if len(versions) == 0 {
+		return nil, nil
+	}
+	return versions[0], nil
+}
+
+// LoadPolicy loads the latest version into the casbin model
+func (m *DbManager) LoadPolicy(model model.Model) error {
+	latest, err := latestVersion(m.db)
+	if err != nil || latest == nil {
+		return err
+	}
+	rules, err := latest.DecodeRules()
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		err = persist.LoadPolicyArray(rule, model)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load policy rule %q", rule)
+		}
+	}
+	return nil
+}
+
+var errReadOnly = errors.New("policy changes must go through the policy manager")
+
+func (m *DbManager) SavePolicy(model model.Model) error {
+	return errReadOnly
+}
+
+func (m *DbManager) AddPolicy(sec string, ptype string, rule []string) error {
+	return errReadOnly
+}
+
+func (m *DbManager) RemovePolicy(sec string, ptype string, rule []string) error {
+	return errReadOnly
+}
+
+func (m *DbManager) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	return errReadOnly
+}
+
+// ParseCSV parses rules in the casbin file adapter format, e.g. "p, admin, account, stack, read"
+func ParseCSV(r io.Reader) ([]Rule, error) {
+	rules := []Rule{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := Rule{}
+		for _, token := range strings.Split(line, ",") {
+			rule = append(rule, strings.TrimSpace(token))
+		}
+		if len(rule) < 2 {
+			return nil, errors.Errorf("invalid policy line %q", line)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read policy file")
+	}
+	return rules, nil
+}
@@ -0,0 +1,219 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+func TestParseCSV(t *testing.T) {
+	rules, err := ParseCSV(strings.NewReader("# comment\np, admin, acme, stack, read\n\n  g,jane , admin, acme\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{{"p", "admin", "acme", "stack", "read"}, {"g", "jane", "admin", "acme"}}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("got %v, want %v", rules, want)
+	}
+
+	_, err = ParseCSV(strings.NewReader("p\n"))
+	if err == nil {
+		t.Error("expected an error for a line without values")
+	}
+}
+
+func TestRewriteDomains(t *testing.T) {
+	// acme is the name of two accounts, 01JA and 01JB
+	rewrite := func(domain string) []string {
+		switch domain {
+		case "acme":
+			return []string{"01JA", "01JB"}
+		case "gone":
+			return nil
+		default:
+			return []string{domain}
+		}
+	}
+	tests := []struct {
+		name  string
+		rules []Rule
+		want  []Rule
+	}{
+		{
+			name:  "permission",
+			rules: []Rule{{"p", "admin", "acme", "stack", "read"}},
+			want:  []Rule{{"p", "admin", "01JA", "stack", "read"}, {"p", "admin", "01JB", "stack", "read"}},
+		},
+		{
+			name:  "role",
+			rules: []Rule{{"g", "jane", "admin", "acme"}},
+			want:  []Rule{{"g", "jane", "admin", "01JA"}, {"g", "jane", "admin", "01JB"}},
+		},
+		{
+			name:  "already moved",
+			rules: []Rule{{"g", "jane", "admin", "01JA"}, {"g", "jane", "admin", "acme"}},
+			want:  []Rule{{"g", "jane", "admin", "01JA"}, {"g", "jane", "admin", "01JB"}},
+		},
+		{
+			name:  "global role",
+			rules: []Rule{{"g2", "root", "platform_admin"}},
+			want:  []Rule{{"g2", "root", "platform_admin"}},
+		},
+		{
+			name:  "dropped",
+			rules: []Rule{{"g", "jane", "admin", "gone"}},
+			want:  []Rule{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := RewriteDomains(tt.rules, rewrite)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyChecksDomains(t *testing.T) {
+	db := dbtest.Open(t)
+	acme := dbtest.Account(t, db, "acme")
+	tests := []struct {
+		name    string
+		rules   []Rule
+		wantErr error
+	}{
+		{name: "account ULID", rules: []Rule{{"p", "admin", acme.Ulid, "stack", "read"}, {"g", "jane", "admin", acme.Ulid}}},
+		{name: "global role", rules: []Rule{{"g2", "root", "platform_admin"}}},
+		{name: "account name", rules: []Rule{{"g", "jane", "admin", "acme"}}, wantErr: ErrUnknownDomain},
+		{name: "ULID of no account", rules: []Rule{{"p", "admin", "01JAAAAAAAAAAAAAAAAAAAAAAA", "stack", "read"}}, wantErr: ErrUnknownDomain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDbManager(db, dbtest.Logger()).Apply(tt.rules, "test", "")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRollbackChecksDomains(t *testing.T) {
+	db := dbtest.Open(t)
+	acme := dbtest.Account(t, db, "acme")
+	// a version from before domains were account ULIDs
+	err := db.Create(&Version{Version: 1, Author: "test", Comment: "names", Rules: `[["g", "jane", "admin", "acme"]]`}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewDbManager(db, dbtest.Logger())
+	_, err = m.Apply([]Rule{{"g", "jane", "admin", acme.Ulid}}, "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Rollback(1, "test", "")
+	if !errors.Is(err, ErrUnknownDomain) {
+		t.Errorf("got %v, want %v", err, ErrUnknownDomain)
+	}
+	_, err = m.Rollback(2, "test", "")
+	if err != nil {
+		t.Errorf("got %v, want the rollback to version 2", err)
+	}
+}
+
+// the migration to account ULIDs runs once, before the server starts, on the policy of an existing installation
+func TestPolicyDomainsMigration(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+		// want is nil if no version is stored
+		want []Rule
+	}{
+		{
+			name:  "account names",
+			rules: []Rule{{"p", "admin", "acme", "stack", "read"}, {"g", "jane", "admin", "acme"}, {"g2", "root", "platform_admin"}},
+			want: []Rule{
+				{"p", "admin", "{acme}", "stack", "read"}, {"p", "admin", "{acme2}", "stack", "read"},
+				{"g", "jane", "admin", "{acme}"}, {"g", "jane", "admin", "{acme2}"},
+				{"g2", "root", "platform_admin"},
+			},
+		},
+		{
+			name:  "partly moved",
+			rules: []Rule{{"g", "jane", "admin", "{other}"}, {"g", "jane", "viewer", "other"}, {"g", "john", "admin", "gone"}},
+			want:  []Rule{{"g", "jane", "admin", "{other}"}, {"g", "jane", "viewer", "{other}"}, {"g", "john", "admin", "gone"}},
+		},
+		{
+			name:  "duplicate after the move",
+			rules: []Rule{{"g", "jane", "admin", "other"}, {"g", "jane", "admin", "{other}"}},
+			want:  []Rule{{"g", "jane", "admin", "{other}"}},
+		},
+		{
+			name:  "already moved",
+			rules: []Rule{{"g", "jane", "admin", "{other}"}, {"g", "john", "admin", "gone"}},
+		},
+	}
+	_, file, _, _ := runtime.Caller(0)
+	migration, err := os.ReadFile(filepath.Join(filepath.Dir(file), "..", "..", "db", "migrations", "000022_policy_domains.up.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Open(t)
+			// acme is the name of two accounts
+			ulids := map[string]string{}
+			for _, name := range []string{"acme", "acme2", "other"} {
+				account := dbtest.Account(t, db, strings.TrimSuffix(name, "2"))
+				ulids["{"+name+"}"] = account.Ulid
+			}
+			withUlids := func(rules []Rule) []Rule {
+				return RewriteDomains(rules, func(domain string) []string {
+					if ulid, ok := ulids[domain]; ok {
+						return []string{ulid}
+					}
+					return []string{domain}
+				})
+			}
+			encoded, _ := json.Marshal(withUlids(tt.rules))
+			err := db.Create(&Version{Version: 1, Author: "test", Comment: "before", Rules: string(encoded)}).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = db.Exec(string(migration)).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			versions, err := NewDbManager(db, dbtest.Logger()).Versions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == nil {
+				if len(versions) != 1 {
+					t.Errorf("got %d versions, want no new version", len(versions))
+				}
+				return
+			}
+			if len(versions) != 2 {
+				t.Fatalf("got %d versions, want a new version", len(versions))
+			}
+			got, err := versions[0].DecodeRules()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, withUlids(tt.want)) {
+				t.Errorf("got %v, want %v", got, withUlids(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package scim
+
+import (
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/policy"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+const constraintUniqueGroupName = "uq_scim_groups_display_name"
+
+func (s *DbService) ListGroups(account *model.Account, filter GroupFilter, offset int, limit int) ([]*Group, int64, error) {
+	query := s.db.Model(&Group{}).Where("account_id = ?", account.ID)
+	if filter.DisplayName != "" {
+		query = query.Where("display_name = ?", filter.DisplayName)
+	}
+	if filter.ExternalID != "" {
+		query = query.Where("external_id = ?", filter.ExternalID)
+	}
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	err := query.Count(&total).Error
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to count groups")
+	}
+	groups := []*Group{}
+	err = query.Preload("Members", orderByID).Order("id").Offset(offset).Limit(limit).Find(&groups).Error
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to list groups")
+	}
+	return groups, total, nil
+}
+
+func (s *DbService) GetGroup(account *model.Account, ulid string) (*Group, error) {
+	groups := []*Group{}
+	err := s.db.Preload("Members", orderByID).Where("account_id = ? AND ulid = ?", account.ID, ulid).Limit(1).Find(&groups).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get group")
+	}
+	if len(groups) == 0 {
+		return nil, ErrNotFound
+	}
+	return groups[0], nil
+}
+
+func (s *DbService) CreateGroup(account *model.Account, attrs *GroupAttributes) (*Group, error) {
+	group := &Group{
+		Ulid:        s.ulidManager.NewULID().String(),
+		AccountID:   account.ID,
+		DisplayName: attrs.DisplayName,
+		ExternalID:  attrs.ExternalID,
+	}
+	err := s.update(account, "created group "+attrs.DisplayName+" in "+account.Name, func(tx *gorm.DB, rules []policy.Rule) ([]policy.Rule, []uint, error) {
+		members, err := accountUsers(tx, account, attrs.Members)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = tx.Omit(clause.Associations).Create(group).Error
+		if util.IsUniqueViolation(err, constraintUniqueGroupName) {
+			return nil, nil, ErrGroupNameTaken
+		}
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to create group")
+		}
+		group.Members = members
+		err = addMembers(tx, group)
+		if err != nil {
+			return nil, nil, err
+		}
+		return rules, userIDs(members), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("created group", "group", group.DisplayName, "account", account.Name, "members", len(group.Members))
+	return group, nil
+}
+
+func (s *DbService) UpdateGroup(account *model.Account, group *Group, attrs *GroupAttributes) error {
+	// a renamed group may be mapped to other roles, so all old and new members are synced
+	affected := userIDs(group.Members)
+	members := []*model.User{}
+	err := s.update(account, "updated group "+attrs.DisplayName+" in "+account.Name, func(tx *gorm.DB, rules []policy.Rule) ([]policy.Rule, []uint, error) {
+		var err error
+		members, err = accountUsers(tx, account, attrs.Members)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = tx.Model(group).Omit(clause.Associations).Updates(map[string]interface{}{
+			"display_name": attrs.DisplayName,
+			"external_id":  attrs.ExternalID,
+		}).Error
+		if util.IsUniqueViolation(err, constraintUniqueGroupName) {
+			return nil, nil, ErrGroupNameTaken
+		}
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to update group")
+		}
+		err = tx.Where("group_id = ?", group.ID).Delete(&member{}).Error
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to delete group members")
+		}
+		err = addMembers(tx, &Group{ID: group.ID, Members: members})
+		if err != nil {
+			return nil, nil, err
+		}
+		return rules, append(affected, userIDs(members)...), nil
+	})
+	if err != nil {
+		return err
+	}
+	group.DisplayName = attrs.DisplayName
+	group.ExternalID = attrs.ExternalID
+	group.Members = members
+	s.logger.Info("updated group", "group", group.DisplayName, "account", account.Name, "members", len(group.Members))
+	return nil
+}
+
+func (s *DbService) DeleteGroup(account *model.Account, group *Group) error {
+	err := s.update(account, "deleted group "+group.DisplayName+" in "+account.Name, func(tx *gorm.DB, rules []policy.Rule) ([]policy.Rule, []uint, error) {
+		// members are deleted by the foreign key
+		err := tx.Delete(group).Error
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to delete group")
+		}
+		return rules, userIDs(group.Members), nil
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.Info("deleted group", "group", group.DisplayName, "account", account.Name)
+	return nil
+}
+
+// accountUsers returns the users with the ULIDs, all of them must be users of the account
+func accountUsers(tx *gorm.DB, account *model.Account, ulids []string) ([]*model.User, error) {
+	users := []*model.User{}
+	if len(ulids) == 0 {
+		return users, nil
+	}
+	unique := map[string]bool{}
+	for _, ulid := range ulids {
+		unique[ulid] = true
+	}
+	err := tx.Where("account_id = ? AND ulid IN ?", account.ID, ulids).Order("id").Find(&users).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get users")
+	}
+	if len(users) != len(unique) {
+		return nil, ErrUnknownMember
+	}
+	return users, nil
+}
+
+func addMembers(tx *gorm.DB, group *Group) error {
+	if len(group.Members) == 0 {
+		return nil
+	}
+	members := []*member{}
+	for _, u := range group.Members {
+		members = append(members, &member{GroupID: group.ID, UserID: u.ID})
+	}
+	err := tx.Create(&members).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to add group members")
+	}
+	return nil
+}
+
+func userIDs(users []*model.User) []uint {
+	ids := []uint{}
+	for _, u := range users {
+		ids = append(ids, u.ID)
+	}
+	return ids
+}
+
+func orderByID(db *gorm.DB) *gorm.DB {
+	return db.Order("id")
+}
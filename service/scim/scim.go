@@ -0,0 +1,317 @@
+package scim
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/accesstoken"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/groupsync"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/membership"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/policy"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+// TokenPrefix distinguishes SCIM tokens from personal access tokens and service account keys
+const TokenPrefix = "scim_"
+
+// SubjectPrefix is prepended to the token's ULID to name the directory in audit events
+const SubjectPrefix = "scim:"
+
+// AuthorScim is the author of policy versions created when a directory changes group memberships
+const AuthorScim = "scim"
+
+var (
+	ErrInvalidToken    = errors.New("invalid token")
+	ErrNotFound        = errors.New("not found")
+	ErrUsernameTaken   = errors.New("username is taken")
+	ErrExternalIDTaken = errors.New("external id is taken")
+	ErrGroupNameTaken  = errors.New("group name is taken")
+	ErrUnknownMember   = errors.New("group member is not a user of the account")
+	// a username is global, the directory of one account must not rename a user who is a member of other accounts
+	// or has roles outside the account
+	ErrSharedUser = errors.New("user is a member of other accounts or has roles outside the account")
+)
+
+// Token authenticates a directory which provisions the users and groups of one account, only a hash of the secret is stored
+type Token struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	Ulid       string
+	AccountID  uint
+	Name       string
+	TokenHash  string
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (Token) TableName() string {
+	return "scim_tokens"
+}
+
+// Subject is the name of the directory in audit events
+func (t *Token) Subject() string {
+	return SubjectPrefix + t.Ulid
+}
+
+// User is a user whose home account is the directory's account
+type User struct {
+	User *model.User
+	// ID of the user in the directory, empty if the directory didn't set one
+	ExternalID string
+	Groups     []*Group
+	// When the directory deactivated the user's membership of the account, the user keeps their other accounts
+	DeactivatedAt *time.Time
+}
+
+func (u *User) Active() bool {
+	return u.DeactivatedAt == nil
+}
+
+// UserAttributes are the attributes a directory sets on a user
+type UserAttributes struct {
+	Username   string
+	ExternalID string
+	Active     bool
+}
+
+// UserFilter selects users by an attribute, empty fields match all users
+type UserFilter struct {
+	Username   string
+	ExternalID string
+}
+
+// Group is a directory group, its name is mapped to casbin roles by the account's group role mappings
+type Group struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Ulid        string
+	AccountID   uint
+	DisplayName string
+	ExternalID  string
+	Members     []*model.User `gorm:"many2many:scim_group_members;joinForeignKey:GroupID;joinReferences:UserID"`
+}
+
+func (Group) TableName() string {
+	return "scim_groups"
+}
+
+// GroupAttributes are the attributes a directory sets on a group
+type GroupAttributes struct {
+	DisplayName string
+	ExternalID  string
+	// ULIDs of the member users
+	Members []string
+}
+
+// GroupFilter selects groups by an attribute, empty fields match all groups
+type GroupFilter struct {
+	DisplayName string
+	ExternalID  string
+}
+
+type member struct {
+	GroupID uint
+	UserID  uint
+}
+
+func (member) TableName() string {
+	return "scim_group_members"
+}
+
+type Service interface {
+	// Returns the tokens of the account which are not revoked
+	Tokens(accountID uint) ([]*Token, error)
+	// Creates a token, the plain text token is only returned here
+	CreateToken(accountID uint, name string) (string, *Token, error)
+	// Revokes a token of the account
+	RevokeToken(accountID uint, ulid string) error
+	// Returns the token if it's valid and not revoked
+	Authenticate(plaintext string) (*Token, error)
+
+	// Returns a page of the account's users ordered by creation, and the number of users which match the filter
+	ListUsers(account *model.Account, filter UserFilter, offset int, limit int) ([]*User, int64, error)
+	// Returns a user of the account
+	GetUser(account *model.Account, ulid string) (*User, error)
+	// Creates a user without a local password, the user logs in through SSO
+	CreateUser(account *model.Account, attrs *UserAttributes) (*User, error)
+	// Replaces the attributes of a user, a deactivated user loses the roles granted through groups.
+	// Users who are members of other accounts or have roles outside the account can't be renamed.
+	UpdateUser(account *model.Account, user *User, attrs *UserAttributes) error
+
+	// Returns a page of the account's groups ordered by creation, and the number of groups which match the filter
+	ListGroups(account *model.Account, filter GroupFilter, offset int, limit int) ([]*Group, int64, error)
+	// Returns a group of the account with its members
+	GetGroup(account *model.Account, ulid string) (*Group, error)
+	// Creates a group and grants its members the mapped roles
+	CreateGroup(account *model.Account, attrs *GroupAttributes) (*Group, error)
+	// Replaces the attributes and members of a group and syncs the roles of old and new members
+	UpdateGroup(account *model.Account, group *Group, attrs *GroupAttributes) error
+	// Deletes a group and revokes the mapped roles of its members
+	DeleteGroup(account *model.Account, group *Group) error
+}
+
+var _ Service = &DbService{}
+
+type DbService struct {
+	db            *gorm.DB
+	logger        *slog.Logger
+	ulidManager   *util.UlidManager
+	groupSyncer   groupsync.Syncer
+	policyManager policy.Manager
+}
+
+func NewDbService(db *gorm.DB, logger *slog.Logger, ulidManager *util.UlidManager, groupSyncer groupsync.Syncer, policyManager policy.Manager) *DbService {
+	return &DbService{
+		db:            db,
+		logger:        logger.With("subcomponent", "scim/DbService"),
+		ulidManager:   ulidManager,
+		groupSyncer:   groupSyncer,
+		policyManager: policyManager,
+	}
+}
+
+func (s *DbService) Tokens(accountID uint) ([]*Token, error) {
+	tokens := []*Token{}
+	err := s.db.Where("account_id = ? AND revoked_at IS NULL", accountID).Order("id").Find(&tokens).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list scim tokens")
+	}
+	return tokens, nil
+}
+
+func (s *DbService) CreateToken(accountID uint, name string) (string, *Token, error) {
+	plaintext, err := accesstoken.Generate(TokenPrefix)
+	if err != nil {
+		return "", nil, err
+	}
+	token := &Token{
+		Ulid:      s.ulidManager.NewULID().String(),
+		AccountID: accountID,
+		Name:      name,
+		TokenHash: accesstoken.Hash(plaintext),
+	}
+	err = s.db.Create(token).Error
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to create scim token")
+	}
+	s.logger.Info("created scim token", "accountid", accountID, "token", token.Ulid)
+	return plaintext, token, nil
+}
+
+func (s *DbService) RevokeToken(accountID uint, ulid string) error {
+	result := s.db.Model(&Token{}).
+		Where("account_id = ? AND ulid = ? AND revoked_at IS NULL", accountID, ulid).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "failed to revoke scim token")
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidToken
+	}
+	s.logger.Info("revoked scim token", "accountid", accountID, "token", ulid)
+	return nil
+}
+
+func (s *DbService) Authenticate(plaintext string) (*Token, error) {
+	tokens := []*Token{}
+	err := s.db.
+		Where("token_hash = ? AND revoked_at IS NULL", accesstoken.Hash(plaintext)).
+		Limit(1).
+		Find(&tokens).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get scim token")
+	}
+	if len(tokens) == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	err = s.db.Model(tokens[0]).Update("last_used_at", time.Now()).Error
+	if err != nil {
+		s.logger.Error("failed to update scim token last use", "err", err)
+	}
+	return tokens[0], nil
+}
+
+// update runs the writes of a SCIM request in one transaction with the policy version of the roles they change,
+// the change returns the users whose roles must be synced
+func (s *DbService) update(account *model.Account, comment string, change func(tx *gorm.DB, rules []policy.Rule) ([]policy.Rule, []uint, error)) error {
+	mappings, err := s.groupSyncer.Mappings(account.ID)
+	if err != nil {
+		return err
+	}
+	_, err = s.policyManager.UpdateTx(AuthorScim, comment, func(tx *gorm.DB, rules []policy.Rule) ([]policy.Rule, error) {
+		rules, synced, err := change(tx, rules)
+		if err != nil {
+			return nil, err
+		}
+		return syncRoles(tx, account, mappings, synced, rules)
+	})
+	return err
+}
+
+// syncRoles grants each user of the account the roles mapped from their groups, users whose membership is deactivated get none
+func syncRoles(tx *gorm.DB, account *model.Account, mappings []*groupsync.Mapping, userIDs []uint, rules []policy.Rule) ([]policy.Rule, error) {
+	if len(userIDs) == 0 || len(mappings) == 0 {
+		return rules, nil
+	}
+
+	users := []*model.User{}
+	err := tx.Where("id IN ?", userIDs).Order("id").Find(&users).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get users")
+	}
+	deactivatedIDs := []uint{}
+	err = tx.Model(&membership.Membership{}).
+		Where("account_id = ? AND user_id IN ? AND deactivated_at IS NOT NULL", account.ID, userIDs).
+		Pluck("user_id", &deactivatedIDs).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get memberships")
+	}
+	deactivated := map[uint]bool{}
+	for _, id := range deactivatedIDs {
+		deactivated[id] = true
+	}
+	memberships := []struct {
+		UserID      uint
+		DisplayName string
+	}{}
+	err = tx.Table("scim_group_members").
+		Select("scim_group_members.user_id, scim_groups.display_name").
+		Joins("JOIN scim_groups ON scim_groups.id = scim_group_members.group_id").
+		Where("scim_groups.account_id = ? AND scim_group_members.user_id IN ?", account.ID, userIDs).
+		Scan(&memberships).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get group members")
+	}
+	groups := map[uint]map[string]bool{}
+	for _, m := range memberships {
+		if groups[m.UserID] == nil {
+			groups[m.UserID] = map[string]bool{}
+		}
+		groups[m.UserID][m.DisplayName] = true
+	}
+
+	managed := map[string]bool{}
+	for _, m := range mappings {
+		managed[m.Role] = true
+	}
+	for _, u := range users {
+		desired := map[string]bool{}
+		if !deactivated[u.ID] {
+			for _, m := range mappings {
+				if groups[u.ID][m.GroupName] {
+					desired[m.Role] = true
+				}
+			}
+		}
+		rules = groupsync.SetRoles(rules, u.Username, account.Ulid, managed, desired)
+	}
+	return rules, nil
+}
@@ -0,0 +1,340 @@
+package scim
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/groupsync"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/membership"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/policy"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+func newTestService(t *testing.T) (*DbService, *gorm.DB) {
+	db := dbtest.Open(t)
+	policyManager := policy.NewDbManager(db, dbtest.Logger())
+	syncer := groupsync.NewDbSyncer(db, dbtest.Logger(), policyManager)
+	return NewDbService(db, dbtest.Logger(), util.NewUlidManager(), syncer, policyManager), db
+}
+
+func policyVersions(t *testing.T, db *gorm.DB) int64 {
+	var count int64
+	err := db.Model(&policy.Version{}).Count(&count).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func hasRule(t *testing.T, s *DbService, rule ...string) bool {
+	rules, err := s.policyManager.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rules {
+		if strings.Join(r, ",") == strings.Join(rule, ",") {
+			return true
+		}
+	}
+	return false
+}
+
+func isActiveMember(t *testing.T, db *gorm.DB, user *model.User, account *model.Account) bool {
+	m := &membership.Membership{}
+	err := db.Where("user_id = ? AND account_id = ?", user.ID, account.ID).First(m).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.DeactivatedAt == nil
+}
+
+func TestRenameSubject(t *testing.T) {
+	account := &model.Account{Ulid: "01JAAAAAAAAAAAAAAAAAAAAAAA"}
+	rules := []policy.Rule{
+		{"p", "admin", account.Ulid, "user", "read"},
+		{"g", "jane@example.com", "admin", account.Ulid},
+		{"g", "jane@example.com", "admin", "01JBBBBBBBBBBBBBBBBBBBBBBB"},
+		{"g", "john@example.com", "admin", account.Ulid},
+	}
+	want := []policy.Rule{
+		{"p", "admin", account.Ulid, "user", "read"},
+		{"g", "jane.doe@example.com", "admin", account.Ulid},
+		{"g", "jane@example.com", "admin", "01JBBBBBBBBBBBBBBBBBBBBBBB"},
+		{"g", "john@example.com", "admin", account.Ulid},
+	}
+	got := renameSubject(rules, account, "jane@example.com", "jane.doe@example.com")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestHasRulesOutside(t *testing.T) {
+	account := &model.Account{Ulid: "01JAAAAAAAAAAAAAAAAAAAAAAA"}
+	other := "01JBBBBBBBBBBBBBBBBBBBBBBB"
+	tests := []struct {
+		name  string
+		rules []policy.Rule
+		want  bool
+	}{
+		{name: "roles in the account", rules: []policy.Rule{{"g", "jane@example.com", "admin", account.Ulid}}},
+		{name: "other users outside the account", rules: []policy.Rule{{"g", "john@example.com", "admin", other}, {"g2", "john@example.com", "platform_admin"}}},
+		{name: "role in another account", rules: []policy.Rule{{"g", "jane@example.com", "admin", other}}, want: true},
+		{name: "platform admin", rules: []policy.Rule{{"g2", "jane@example.com", "platform_admin"}}, want: true},
+		{name: "permission in another account", rules: []policy.Rule{{"p", "jane@example.com", other, "user", "read"}}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := hasRulesOutside(tt.rules, account, "jane@example.com")
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	tests := []struct {
+		name string
+		// shared adds the user to another account
+		shared bool
+		// grants are rules of the user outside the account
+		grants       func(other *model.Account) []policy.Rule
+		attrs        UserAttributes
+		wantErr      error
+		wantUsername string
+		wantActive   bool
+		wantRole     bool
+		wantVersions int64
+	}{
+		{
+			name:         "rename",
+			attrs:        UserAttributes{Username: "jane.doe@example.com", Active: true},
+			wantUsername: "jane.doe@example.com",
+			wantActive:   true,
+			wantRole:     true,
+			wantVersions: 1,
+		},
+		{
+			name:         "rename a member of other accounts",
+			shared:       true,
+			attrs:        UserAttributes{Username: "jane.doe@example.com", Active: true},
+			wantErr:      ErrSharedUser,
+			wantUsername: "jane@example.com",
+			wantActive:   true,
+			wantRole:     true,
+		},
+		{
+			name:  "rename a platform admin",
+			attrs: UserAttributes{Username: "jane.doe@example.com", Active: true},
+			grants: func(other *model.Account) []policy.Rule {
+				return []policy.Rule{{"g2", "jane@example.com", "platform_admin"}}
+			},
+			wantErr:      ErrSharedUser,
+			wantUsername: "jane@example.com",
+			wantActive:   true,
+			wantRole:     true,
+		},
+		{
+			name:  "rename a user with roles in another account",
+			attrs: UserAttributes{Username: "jane.doe@example.com", Active: true},
+			grants: func(other *model.Account) []policy.Rule {
+				return []policy.Rule{{"g", "jane@example.com", "admin", other.Ulid}}
+			},
+			wantErr:      ErrSharedUser,
+			wantUsername: "jane@example.com",
+			wantActive:   true,
+			wantRole:     true,
+		},
+		{
+			name:         "deactivate a member of other accounts",
+			shared:       true,
+			attrs:        UserAttributes{Username: "jane@example.com", Active: false},
+			wantUsername: "jane@example.com",
+			wantVersions: 1,
+		},
+		{
+			name:         "rename and deactivate",
+			attrs:        UserAttributes{Username: "jane.doe@example.com", Active: false},
+			wantUsername: "jane.doe@example.com",
+			wantVersions: 1,
+		},
+		{
+			name:         "unchanged",
+			attrs:        UserAttributes{Username: "jane@example.com", Active: true},
+			wantUsername: "jane@example.com",
+			wantActive:   true,
+			wantRole:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newTestService(t)
+			acme := dbtest.Account(t, db, "acme")
+			other := dbtest.Account(t, db, "other")
+			jane := dbtest.User(t, db, acme, "jane@example.com")
+			if tt.shared {
+				dbtest.Member(t, db, jane, other)
+			}
+			if tt.grants != nil {
+				_, err := s.policyManager.Update("test", "grants outside the account", func(rules []policy.Rule) ([]policy.Rule, error) {
+					return append(rules, tt.grants(other)...), nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := s.groupSyncer.AddMapping(acme.ID, "admins", "admin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = s.CreateGroup(acme, &GroupAttributes{DisplayName: "admins", Members: []string{jane.Ulid}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, err := s.GetUser(acme, jane.Ulid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := policyVersions(t, db)
+
+			err = s.UpdateUser(acme, user, &tt.attrs)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			reloaded, err := s.GetUser(acme, jane.Ulid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reloaded.User.Username != tt.wantUsername {
+				t.Errorf("got username %s, want %s", reloaded.User.Username, tt.wantUsername)
+			}
+			if reloaded.Active() != tt.wantActive {
+				t.Errorf("got active %v, want %v", reloaded.Active(), tt.wantActive)
+			}
+			if hasRule(t, s, "g", tt.wantUsername, "admin", acme.Ulid) != tt.wantRole {
+				t.Errorf("got role %v, want %v", !tt.wantRole, tt.wantRole)
+			}
+			if tt.shared && !isActiveMember(t, db, jane, other) {
+				t.Error("the membership of the other account must stay active")
+			}
+			if got := policyVersions(t, db) - before; got != tt.wantVersions {
+				t.Errorf("got %d new policy versions, want %d", got, tt.wantVersions)
+			}
+		})
+	}
+}
+
+func TestCreateUserInactive(t *testing.T) {
+	s, db := newTestService(t)
+	acme := dbtest.Account(t, db, "acme")
+
+	user, err := s.CreateUser(acme, &UserAttributes{Username: "jane@example.com", Active: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Active() {
+		t.Error("expected an inactive user")
+	}
+	if isActiveMember(t, db, user.User, acme) {
+		t.Error("expected a deactivated membership")
+	}
+}
+
+func TestGroupChangesStoreOneVersion(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(s *DbService, account *model.Account, group *Group) error
+		// wantAdmins are the usernames with the mapped role after the change
+		wantAdmins []string
+	}{
+		{
+			name: "replace members",
+			change: func(s *DbService, account *model.Account, group *Group) error {
+				return s.UpdateGroup(account, group, &GroupAttributes{DisplayName: "admins", Members: []string{group.Members[1].Ulid}})
+			},
+			wantAdmins: []string{"john@example.com"},
+		},
+		{
+			name: "rename to an unmapped group",
+			change: func(s *DbService, account *model.Account, group *Group) error {
+				return s.UpdateGroup(account, group, &GroupAttributes{DisplayName: "staff", Members: []string{group.Members[0].Ulid, group.Members[1].Ulid}})
+			},
+		},
+		{
+			name: "delete",
+			change: func(s *DbService, account *model.Account, group *Group) error {
+				return s.DeleteGroup(account, group)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newTestService(t)
+			acme := dbtest.Account(t, db, "acme")
+			jane := dbtest.User(t, db, acme, "jane@example.com")
+			john := dbtest.User(t, db, acme, "john@example.com")
+			_, err := s.groupSyncer.AddMapping(acme.ID, "admins", "admin")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			before := policyVersions(t, db)
+			group, err := s.CreateGroup(acme, &GroupAttributes{DisplayName: "admins", Members: []string{jane.Ulid, john.Ulid}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := policyVersions(t, db) - before; got != 1 {
+				t.Errorf("creating the group stored %d policy versions, want 1", got)
+			}
+
+			before = policyVersions(t, db)
+			err = tt.change(s, acme, group)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := policyVersions(t, db) - before; got != 1 {
+				t.Errorf("got %d new policy versions, want 1", got)
+			}
+			admins := map[string]bool{}
+			for _, username := range tt.wantAdmins {
+				admins[username] = true
+			}
+			for _, u := range []*model.User{jane, john} {
+				if hasRule(t, s, "g", u.Username, "admin", acme.Ulid) != admins[u.Username] {
+					t.Errorf("got role of %s %v, want %v", u.Username, !admins[u.Username], admins[u.Username])
+				}
+			}
+		})
+	}
+}
+
+func TestFailedRequestStoresNoVersion(t *testing.T) {
+	s, db := newTestService(t)
+	acme := dbtest.Account(t, db, "acme")
+	jane := dbtest.User(t, db, acme, "jane@example.com")
+	_, err := s.groupSyncer.AddMapping(acme.ID, "admins", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := policyVersions(t, db)
+
+	// the unknown member rolls back the group together with the roles of its members
+	_, err = s.CreateGroup(acme, &GroupAttributes{DisplayName: "admins", Members: []string{jane.Ulid, "01JCCCCCCCCCCCCCCCCCCCCCCC"}})
+	if !errors.Is(err, ErrUnknownMember) {
+		t.Fatalf("got %v, want %v", err, ErrUnknownMember)
+	}
+	if got := policyVersions(t, db) - before; got != 0 {
+		t.Errorf("got %d new policy versions, want none", got)
+	}
+	_, total, err := s.ListGroups(acme, GroupFilter{}, 0, 10)
+	if err != nil || total != 0 {
+		t.Errorf("got %d groups (%v), want none", total, err)
+	}
+}
@@ -0,0 +1,302 @@
+package scim
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/identity"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/membership"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/policy"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/serviceaccount"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+const constraintUniqueIdentity = "uq_user_identities_provider_subject"
+
+// provider is the identity provider of the external IDs set by the account's directory, external IDs are stored as identities
+func provider(account *model.Account) string {
+	return "scim:" + account.Ulid
+}
+
+func (s *DbService) ListUsers(account *model.Account, filter UserFilter, offset int, limit int) ([]*User, int64, error) {
+	query := s.db.Model(&model.User{}).Where("account_id = ?", account.ID)
+	if filter.Username != "" {
+		query = query.Where("LOWER(username) = LOWER(?)", filter.Username)
+	}
+	if filter.ExternalID != "" {
+		query = query.Where("id IN (?)", s.db.Model(&identity.Identity{}).
+			Select("user_id").
+			Where("provider = ? AND subject = ?", provider(account), filter.ExternalID))
+	}
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	err := query.Count(&total).Error
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to count users")
+	}
+	users := []*model.User{}
+	err = query.Order("id").Offset(offset).Limit(limit).Find(&users).Error
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to list users")
+	}
+
+	result, err := s.withDetails(account, users)
+	if err != nil {
+		return nil, 0, err
+	}
+	return result, total, nil
+}
+
+func (s *DbService) GetUser(account *model.Account, ulid string) (*User, error) {
+	users := []*model.User{}
+	err := s.db.Where("account_id = ? AND ulid = ?", account.ID, ulid).Limit(1).Find(&users).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get user")
+	}
+	if len(users) == 0 {
+		return nil, ErrNotFound
+	}
+	result, err := s.withDetails(account, users)
+	if err != nil {
+		return nil, err
+	}
+	return result[0], nil
+}
+
+func (s *DbService) CreateUser(account *model.Account, attrs *UserAttributes) (*User, error) {
+	// casbin subjects of service accounts must not be claimed by users
+	if serviceaccount.IsSubject(attrs.Username) {
+		return nil, ErrUsernameTaken
+	}
+
+	// users from a directory have no local password, an empty hash never matches
+	user := &model.User{
+		Ulid:      s.ulidManager.NewULID().String(),
+		Username:  attrs.Username,
+		AccountID: account.ID,
+	}
+	var deactivatedAt *time.Time
+	if !attrs.Active {
+		now := time.Now()
+		deactivatedAt = &now
+	}
+	err := s.update(account, "provisioned user "+attrs.Username+" in "+account.Name, func(tx *gorm.DB, rules []policy.Rule) ([]policy.Rule, []uint, error) {
+		err := tx.Create(user).Error
+		if util.IsUniqueViolation(err, util.ConstraintUniqueUsername) {
+			return nil, nil, ErrUsernameTaken
+		}
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to create user")
+		}
+		err = membership.Add(tx, user.ID, account.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if deactivatedAt != nil {
+			err = membership.SetDeactivatedAt(tx, user.ID, account.ID, deactivatedAt)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		err = setExternalID(tx, account, user, attrs.ExternalID)
+		if err != nil {
+			return nil, nil, err
+		}
+		// a new user is in no group yet
+		return rules, nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("provisioned user", "username", user.Username, "account", account.Name)
+
+	return &User{User: user, ExternalID: attrs.ExternalID, Groups: []*Group{}, DeactivatedAt: deactivatedAt}, nil
+}
+
+func (s *DbService) UpdateUser(account *model.Account, user *User, attrs *UserAttributes) error {
+	if serviceaccount.IsSubject(attrs.Username) {
+		return ErrUsernameTaken
+	}
+	oldUsername := user.User.Username
+	renamed := oldUsername != attrs.Username
+	wasActive := user.Active()
+
+	deactivatedAt := user.DeactivatedAt
+	if !attrs.Active && wasActive {
+		now := time.Now()
+		deactivatedAt = &now
+	}
+	if attrs.Active {
+		deactivatedAt = nil
+	}
+	err := s.update(account, "updated user "+attrs.Username+" in "+account.Name, func(tx *gorm.DB, rules []policy.Rule) ([]policy.Rule, []uint, error) {
+		if renamed {
+			// the username is the user's login and casbin subject in every account, which the directory doesn't own
+			var others int64
+			err := tx.Model(&membership.Membership{}).
+				Where("user_id = ? AND account_id <> ?", user.User.ID, account.ID).
+				Count(&others).Error
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "failed to get memberships")
+			}
+			if others > 0 || hasRulesOutside(rules, account, oldUsername) {
+				return nil, nil, ErrSharedUser
+			}
+			err = tx.Model(user.User).Update("username", attrs.Username).Error
+			if util.IsUniqueViolation(err, util.ConstraintUniqueUsername) {
+				return nil, nil, ErrUsernameTaken
+			}
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "failed to update user")
+			}
+			// roles are granted to the username
+			rules = renameSubject(rules, account, oldUsername, attrs.Username)
+		}
+		if wasActive != attrs.Active {
+			err := membership.SetDeactivatedAt(tx, user.User.ID, account.ID, deactivatedAt)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if attrs.ExternalID != user.ExternalID {
+			err := tx.Where("provider = ? AND user_id = ?", provider(account), user.User.ID).Delete(&identity.Identity{}).Error
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "failed to delete external id")
+			}
+			err = setExternalID(tx, account, user.User, attrs.ExternalID)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if wasActive == attrs.Active {
+			return rules, nil, nil
+		}
+		return rules, []uint{user.User.ID}, nil
+	})
+	if err != nil {
+		return err
+	}
+	user.User.Username = attrs.Username
+	user.DeactivatedAt = deactivatedAt
+	user.ExternalID = attrs.ExternalID
+
+	if renamed {
+		s.logger.Info("renamed user", "from", oldUsername, "to", attrs.Username, "account", account.Name)
+	}
+	if wasActive != attrs.Active {
+		s.logger.Info("changed user activation", "username", attrs.Username, "active", attrs.Active, "account", account.Name)
+	}
+	return nil
+}
+
+// hasRulesOutside returns true if the subject has rules outside the account's domain, e.g. a platform admin grant,
+// a directory which renamed the user would free the old name together with those rules
+func hasRulesOutside(rules []policy.Rule, account *model.Account, subject string) bool {
+	for _, rule := range rules {
+		if len(rule) < 2 || rule[1] != subject {
+			continue
+		}
+		i, ok := rule.DomainIndex()
+		if !ok || rule[i] != account.Ulid {
+			return true
+		}
+	}
+	return false
+}
+
+// renameSubject moves the roles of a user to their new username in the account's domain
+func renameSubject(rules []policy.Rule, account *model.Account, from string, to string) []policy.Rule {
+	result := []policy.Rule{}
+	for _, rule := range rules {
+		if len(rule) == 4 && rule[0] == "g" && rule[1] == from && rule[3] == account.Ulid {
+			rule = policy.Rule{"g", to, rule[2], rule[3]}
+		}
+		result = append(result, rule)
+	}
+	return result
+}
+
+func setExternalID(tx *gorm.DB, account *model.Account, user *model.User, externalID string) error {
+	if externalID == "" {
+		return nil
+	}
+	err := tx.Create(&identity.Identity{Provider: provider(account), Subject: externalID, UserID: user.ID}).Error
+	if util.IsUniqueViolation(err, constraintUniqueIdentity) {
+		return ErrExternalIDTaken
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to create external id")
+	}
+	return nil
+}
+
+// withDetails adds the external IDs, groups and membership state of the account to the users
+func (s *DbService) withDetails(account *model.Account, users []*model.User) ([]*User, error) {
+	result := []*User{}
+	if len(users) == 0 {
+		return result, nil
+	}
+	userIDs := []uint{}
+	for _, u := range users {
+		userIDs = append(userIDs, u.ID)
+	}
+
+	identities := []*identity.Identity{}
+	err := s.db.Where("provider = ? AND user_id IN ?", provider(account), userIDs).Find(&identities).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get external ids")
+	}
+	externalIDs := map[uint]string{}
+	for _, i := range identities {
+		externalIDs[i.UserID] = i.Subject
+	}
+
+	members := []*member{}
+	err = s.db.Where("user_id IN ?", userIDs).Find(&members).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get group members")
+	}
+	groupIDs := []uint{}
+	for _, m := range members {
+		groupIDs = append(groupIDs, m.GroupID)
+	}
+	groups := []*Group{}
+	if len(groupIDs) > 0 {
+		err = s.db.Where("account_id = ? AND id IN ?", account.ID, groupIDs).Order("display_name").Find(&groups).Error
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get groups")
+		}
+	}
+	memberOf := map[uint]map[uint]bool{}
+	for _, m := range members {
+		if memberOf[m.UserID] == nil {
+			memberOf[m.UserID] = map[uint]bool{}
+		}
+		memberOf[m.UserID][m.GroupID] = true
+	}
+
+	memberships := []*membership.Membership{}
+	err = s.db.Where("account_id = ? AND user_id IN ?", account.ID, userIDs).Find(&memberships).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get memberships")
+	}
+	deactivatedAt := map[uint]*time.Time{}
+	for _, m := range memberships {
+		deactivatedAt[m.UserID] = m.DeactivatedAt
+	}
+
+	for _, u := range users {
+		user := &User{User: u, ExternalID: externalIDs[u.ID], Groups: []*Group{}, DeactivatedAt: deactivatedAt[u.ID]}
+		for _, g := range groups {
+			if memberOf[u.ID][g.ID] {
+				user.Groups = append(user.Groups, g)
+			}
+		}
+		result = append(result, user)
+	}
+	return result, nil
+}
@@ -0,0 +1,286 @@
+package serviceaccount
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/accesstoken"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/groupsync"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/service/policy"
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util"
+)
+
+// SubjectPrefix is prepended to the ULID to form the casbin subject, usernames with this prefix are reserved
+const SubjectPrefix = "serviceaccount:"
+
+// KeyPrefix makes keys recognizable and distinguishes them from personal access tokens
+const KeyPrefix = "sak_"
+
+var (
+	ErrNotFound   = errors.New("service account not found")
+	ErrInvalidKey = errors.New("invalid key")
+)
+
+// ServiceAccount is a non-human principal of an account, used by automation
+type ServiceAccount struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	Ulid        string
+	AccountID   uint
+	Name        string
+	Description string
+}
+
+func (ServiceAccount) TableName() string {
+	return "service_accounts"
+}
+
+// Subject is the name of the service account in casbin rules and audit events
+func (sa *ServiceAccount) Subject() string {
+	return SubjectPrefix + sa.Ulid
+}
+
+// IsSubject returns true if the name belongs to a service account
+func IsSubject(name string) bool {
+	return strings.HasPrefix(name, SubjectPrefix)
+}
+
+// Key is an API key of a service account, only a hash of the secret is stored
+type Key struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	Ulid             string
+	ServiceAccountID uint
+	Name             string
+	KeyHash          string
+	ExpiresAt        *time.Time
+	LastUsedAt       *time.Time
+	RevokedAt        *time.Time
+}
+
+func (Key) TableName() string {
+	return "service_account_keys"
+}
+
+type Service interface {
+	// Returns the service accounts of the account
+	List(accountID uint) ([]*ServiceAccount, error)
+	// Returns a service account of the account
+	Get(accountID uint, ulid string) (*ServiceAccount, error)
+	// Creates a service account
+	Create(accountID uint, name string, description string) (*ServiceAccount, error)
+	// Updates the name and description of a service account
+	Update(sa *ServiceAccount, name string, description string) error
+	// Deletes a service account with its keys and roles
+	Delete(sa *ServiceAccount, account *model.Account, author string) error
+
+	// Returns the roles of the service account in the account's domain
+	Roles(sa *ServiceAccount, account *model.Account) ([]string, error)
+	// Replaces the roles of the service account in the account's domain
+	SetRoles(sa *ServiceAccount, account *model.Account, roles []string, author string) error
+
+	// Returns the keys of the service account which are not revoked
+	Keys(sa *ServiceAccount) ([]*Key, error)
+	// Creates a key, the plain text key is only returned here
+	CreateKey(sa *ServiceAccount, name string, expiresAt *time.Time) (string, *Key, error)
+	// Revokes a key of a service account of the account
+	RevokeKey(accountID uint, ulid string) error
+	// Returns the service account of the key if the key is valid, not expired and not revoked
+	Authenticate(plaintext string) (*ServiceAccount, error)
+}
+
+var _ Service = &DbService{}
+
+type DbService struct {
+	db            *gorm.DB
+	logger        *slog.Logger
+	ulidManager   *util.UlidManager
+	policyManager policy.Manager
+}
+
+func NewDbService(db *gorm.DB, logger *slog.Logger, ulidManager *util.UlidManager, policyManager policy.Manager) *DbService {
+	return &DbService{
+		db:            db,
+		logger:        logger.With("subcomponent", "serviceaccount/DbService"),
+		ulidManager:   ulidManager,
+		policyManager: policyManager,
+	}
+}
+
+func (s *DbService) List(accountID uint) ([]*ServiceAccount, error) {
+	serviceAccounts := []*ServiceAccount{}
+	err := s.db.Where("account_id = ?", accountID).Order("name").Find(&serviceAccounts).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list service accounts")
+	}
+	return serviceAccounts, nil
+}
+
+func (s *DbService) Get(accountID uint, ulid string) (*ServiceAccount, error) {
+	serviceAccounts := []*ServiceAccount{}
+	err := s.db.Where("account_id = ? AND ulid = ?", accountID, ulid).Limit(1).Find(&serviceAccounts).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get service account")
+	}
+	if len(serviceAccounts) == 0 {
+		return nil, ErrNotFound
+	}
+	return serviceAccounts[0], nil
+}
+
+func (s *DbService) Create(accountID uint, name string, description string) (*ServiceAccount, error) {
+	sa := &ServiceAccount{
+		Ulid:        s.ulidManager.NewULID().String(),
+		AccountID:   accountID,
+		Name:        name,
+		Description: description,
+	}
+	err := s.db.Create(sa).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create service account")
+	}
+	s.logger.Info("created service account", "serviceaccount", sa.Ulid, "accountid", accountID)
+	return sa, nil
+}
+
+func (s *DbService) Update(sa *ServiceAccount, name string, description string) error {
+	err := s.db.Model(sa).Updates(map[string]interface{}{"name": name, "description": description}).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to update service account")
+	}
+	return nil
+}
+
+func (s *DbService) Delete(sa *ServiceAccount, account *model.Account, author string) error {
+	// roles first, a failure leaves a service account without roles rather than roles without a service account
+	err := s.SetRoles(sa, account, []string{}, author)
+	if err != nil {
+		return err
+	}
+	err = s.db.Delete(sa).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to delete service account")
+	}
+	s.logger.Info("deleted service account", "serviceaccount", sa.Ulid, "accountid", sa.AccountID)
+	return nil
+}
+
+func (s *DbService) Roles(sa *ServiceAccount, account *model.Account) ([]string, error) {
+	rules, err := s.policyManager.Current()
+	if err != nil {
+		return nil, err
+	}
+	return rolesOf(rules, sa.Subject(), account.Ulid), nil
+}
+
+func (s *DbService) SetRoles(sa *ServiceAccount, account *model.Account, roles []string, author string) error {
+	comment := fmt.Sprintf("set roles of service account %s in %s", sa.Name, account.Name)
+	_, err := s.policyManager.Update(author, comment, func(rules []policy.Rule) ([]policy.Rule, error) {
+		managed := map[string]bool{}
+		for _, role := range rolesOf(rules, sa.Subject(), account.Ulid) {
+			managed[role] = true
+		}
+		desired := map[string]bool{}
+		for _, role := range roles {
+			managed[role] = true
+			desired[role] = true
+		}
+		return groupsync.SetRoles(rules, sa.Subject(), account.Ulid, managed, desired), nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to set service account roles")
+	}
+	return nil
+}
+
+func (s *DbService) Keys(sa *ServiceAccount) ([]*Key, error) {
+	keys := []*Key{}
+	err := s.db.Where("service_account_id = ? AND revoked_at IS NULL", sa.ID).Order("id").Find(&keys).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list service account keys")
+	}
+	return keys, nil
+}
+
+func (s *DbService) CreateKey(sa *ServiceAccount, name string, expiresAt *time.Time) (string, *Key, error) {
+	plaintext, err := accesstoken.Generate(KeyPrefix)
+	if err != nil {
+		return "", nil, err
+	}
+	key := &Key{
+		Ulid:             s.ulidManager.NewULID().String(),
+		ServiceAccountID: sa.ID,
+		Name:             name,
+		KeyHash:          accesstoken.Hash(plaintext),
+		ExpiresAt:        expiresAt,
+	}
+	err = s.db.Create(key).Error
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to create service account key")
+	}
+	s.logger.Info("created service account key", "serviceaccount", sa.Ulid, "key", key.Ulid)
+	return plaintext, key, nil
+}
+
+func (s *DbService) RevokeKey(accountID uint, ulid string) error {
+	result := s.db.Model(&Key{}).
+		Where("ulid = ? AND revoked_at IS NULL AND service_account_id IN (?)", ulid,
+			s.db.Model(&ServiceAccount{}).Select("id").Where("account_id = ?", accountID)).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "failed to revoke service account key")
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidKey
+	}
+	s.logger.Info("revoked service account key", "key", ulid)
+	return nil
+}
+
+func (s *DbService) Authenticate(plaintext string) (*ServiceAccount, error) {
+	if !strings.HasPrefix(plaintext, KeyPrefix) {
+		return nil, ErrInvalidKey
+	}
+	keys := []*Key{}
+	err := s.db.
+		Where("key_hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", accesstoken.Hash(plaintext), time.Now()).
+		Limit(1).
+		Find(&keys).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get service account key")
+	}
+	if len(keys) == 0 {
+		return nil, ErrInvalidKey
+	}
+
+	sa := &ServiceAccount{}
+	err = s.db.Where("id = ?", keys[0].ServiceAccountID).First(sa).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get service account")
+	}
+	err = s.db.Model(keys[0]).Update("last_used_at", time.Now()).Error
+	if err != nil {
+		s.logger.Error("failed to update key last use", "err", err)
+	}
+	return sa, nil
+}
+
+func rolesOf(rules []policy.Rule, subject string, domain string) []string {
+	roles := []string{}
+	for _, rule := range rules {
+		if len(rule) == 4 && rule[0] == "g" && rule[1] == subject && rule[3] == domain {
+			roles = append(roles, rule[2])
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
@@ -0,0 +1,208 @@
+package usersession
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/gob"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// storedSession is a row of the http_sessions table, the cookie only carries the signed key
+type storedSession struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Key       string
+	Data      []byte
+	ExpiresAt time.Time
+}
+
+func (storedSession) TableName() string {
+	return "http_sessions"
+}
+
+var _ sessions.Store = &DbStore{}
+
+// DbStore is a gorilla sessions.Store which keeps session values in the database
+type DbStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+
+	db     *gorm.DB
+	logger *slog.Logger
+}
+
+// NewDbStore creates a store, keyPairs are used the same way as in sessions.NewCookieStore
+func NewDbStore(db *gorm.DB, logger *slog.Logger, keyPairs ...[]byte) *DbStore {
+	return &DbStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		db:     db,
+		logger: logger.With("subcomponent", "usersession/DbStore"),
+	}
+}
+
+func (s *DbStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *DbStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		// no cookie, new session
+		return session, nil
+	}
+	err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...)
+	if err != nil {
+		return session, err
+	}
+
+	found, err := s.load(session)
+	if err != nil {
+		return session, err
+	}
+	if !found {
+		// expired or deleted, start over with a new session
+		session.ID = ""
+		return session, nil
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+func (s *DbStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	// MaxAge < 0 deletes the session
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			err := s.delete(session.ID)
+			if err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		key := securecookie.GenerateRandomKey(32)
+		if key == nil {
+			return errors.New("failed to generate session key")
+		}
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(key), "=")
+	}
+
+	err := s.save(session)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode session cookie")
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Renew makes the next save store the session under a new ID, the row of the old ID is deleted.
+// It must be called whenever the session's user changes, so that an ID planted before the login (session fixation) doesn't carry over.
+func Renew(session *sessions.Session) error {
+	// the cookie store has no IDs, its cookie is replaced with the new values
+	if store, ok := session.Store().(*DbStore); ok && session.ID != "" {
+		err := store.delete(session.ID)
+		if err != nil {
+			return err
+		}
+	}
+	session.ID = ""
+	return nil
+}
+
+func (s *DbStore) delete(key string) error {
+	err := s.db.Where("key = ?", key).Delete(&storedSession{}).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to delete session")
+	}
+	return nil
+}
+
+func (s *DbStore) load(session *sessions.Session) (bool, error) {
+	rows := []*storedSession{}
+	err := s.db.Where("key = ? AND expires_at > ?", session.ID, time.Now()).Limit(1).Find(&rows).Error
+	if err != nil {
+		return false, errors.Wrap(err, "failed to load session")
+	}
+	if len(rows) == 0 {
+		return false, nil
+	}
+	err = gob.NewDecoder(bytes.NewReader(rows[0].Data)).Decode(&session.Values)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to decode session")
+	}
+	return true, nil
+}
+
+func (s *DbStore) save(session *sessions.Session) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(session.Values)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode session")
+	}
+
+	maxAge := session.Options.MaxAge
+	if maxAge == 0 {
+		// browser session cookie, keep the row for as long as the store's default
+		maxAge = s.Options.MaxAge
+	}
+	row := &storedSession{
+		Key:       session.ID,
+		Data:      buf.Bytes(),
+		ExpiresAt: time.Now().Add(time.Duration(maxAge) * time.Second),
+	}
+	err = s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data", "expires_at", "updated_at"}),
+	}).Create(row).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to save session")
+	}
+	return nil
+}
+
+// Cleanup periodically deletes expired sessions until the context is cancelled
+func (s *DbStore) Cleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			result := s.db.Where("expires_at <= ?", time.Now()).Delete(&storedSession{})
+			if result.Error != nil {
+				s.logger.Error("failed to delete expired sessions", "err", result.Error)
+				continue
+			}
+			s.logger.Debug("deleted expired sessions", "count", result.RowsAffected)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package usersession
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+const testCookieName = "session"
+
+// roundTrip loads the session of the cookie, applies change to it and saves it, renewed first if renew is set.
+// It returns the loaded values and the new cookie, a nil change only loads the session.
+func roundTrip(t *testing.T, store *DbStore, cookie *http.Cookie, renew bool, change func(values map[interface{}]interface{})) (map[interface{}]interface{}, *http.Cookie) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	session, err := store.Get(r, testCookieName)
+	if err != nil {
+		t.Fatalf("failed to get session: %v", err)
+	}
+	loaded := map[interface{}]interface{}{}
+	for k, v := range session.Values {
+		loaded[k] = v
+	}
+	if change == nil {
+		return loaded, cookie
+	}
+	change(session.Values)
+	if renew {
+		err = Renew(session)
+		if err != nil {
+			t.Fatalf("failed to renew session: %v", err)
+		}
+	}
+	w := httptest.NewRecorder()
+	err = session.Save(r, w)
+	if err != nil {
+		t.Fatalf("failed to save session: %v", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected one cookie, got %d", len(cookies))
+	}
+	return loaded, cookies[0]
+}
+
+func sessionID(t *testing.T, store *DbStore, cookie *http.Cookie) string {
+	t.Helper()
+	var id string
+	err := securecookie.DecodeMulti(testCookieName, cookie.Value, &id, store.Codecs...)
+	if err != nil {
+		t.Fatalf("failed to decode cookie: %v", err)
+	}
+	return id
+}
+
+func TestDbStore(t *testing.T) {
+	db := dbtest.Open(t)
+	store := NewDbStore(db, dbtest.Logger(), securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+
+	// a value survives the round trip through the database
+	_, cookie := roundTrip(t, store, nil, false, func(values map[interface{}]interface{}) {
+		values["user"] = "jane"
+	})
+	values, _ := roundTrip(t, store, cookie, false, nil)
+	if values["user"] != "jane" {
+		t.Fatalf("expected the stored value, got %v", values)
+	}
+
+	// a renewed session has a new ID and the old ID is gone
+	oldCookie := cookie
+	_, cookie = roundTrip(t, store, cookie, true, func(values map[interface{}]interface{}) {
+		values["user"] = "john"
+	})
+	if sessionID(t, store, cookie) == sessionID(t, store, oldCookie) {
+		t.Fatal("expected a new session ID after renewing")
+	}
+	values, _ = roundTrip(t, store, oldCookie, false, nil)
+	if len(values) != 0 {
+		t.Fatalf("expected the old session ID to be deleted, got %v", values)
+	}
+	values, _ = roundTrip(t, store, cookie, false, nil)
+	if values["user"] != "john" {
+		t.Fatalf("expected the renewed session to keep its values, got %v", values)
+	}
+
+	// a session deleted by a negative max age can't be loaded
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	session, err := store.Get(r, testCookieName)
+	if err != nil {
+		t.Fatalf("failed to get session: %v", err)
+	}
+	session.Options.MaxAge = -1
+	err = session.Save(r, httptest.NewRecorder())
+	if err != nil {
+		t.Fatalf("failed to delete session: %v", err)
+	}
+	values, _ = roundTrip(t, store, cookie, false, nil)
+	if len(values) != 0 {
+		t.Fatalf("expected the session to be deleted, got %v", values)
+	}
+}
+
+func TestDbStorePlantedID(t *testing.T) {
+	db := dbtest.Open(t)
+	store := NewDbStore(db, dbtest.Logger(), securecookie.GenerateRandomKey(32))
+
+	// an attacker's session, planted in the victim's browser before the login
+	_, planted := roundTrip(t, store, nil, false, func(values map[interface{}]interface{}) {
+		values["pending"] = "yes"
+	})
+	// the login renews the session
+	_, victim := roundTrip(t, store, planted, true, func(values map[interface{}]interface{}) {
+		values["user"] = "victim"
+	})
+
+	values, _ := roundTrip(t, store, planted, false, nil)
+	if _, ok := values["user"]; ok {
+		t.Fatal("the planted session ID must not be logged in")
+	}
+	values, _ = roundTrip(t, store, victim, false, nil)
+	if values["user"] != "victim" {
+		t.Fatalf("expected the victim's session to be logged in, got %v", values)
+	}
+}
@@ -0,0 +1,205 @@
+package usersession
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// Session is the server-side record of a login, the session cookie only carries its ULID
+type Session struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	Ulid       string
+	UserID     uint
+	IP         string
+	UserAgent  string
+	LastSeenAt *time.Time
+	ExpiresAt  time.Time
+	RevokedAt  *time.Time
+}
+
+func (Session) TableName() string {
+	return "user_sessions"
+}
+
+// lastSeenResolution limits how often Touch writes to the database
+const lastSeenResolution = time.Minute
+
+var ErrNotFound = errors.New("session not found")
+
+type Registry interface {
+	// Registers a new session for the user, made from the client IP with the user agent
+	Create(ulid string, userID uint, ttl time.Duration, ip string, userAgent string) (*Session, error)
+	// Returns true if the session exists, is not expired and was not revoked
+	IsActive(ulid string) (bool, error)
+	// Records that the session was used from the IP, at most once per minute
+	Touch(ulid string, ip string) error
+	// Returns the active sessions of the user, newest first
+	ListForUser(userID uint) ([]*Session, error)
+	// Revokes a single session
+	Revoke(ulid string) error
+	// Revokes a single session of the user, returns ErrNotFound if the user has no such active session
+	RevokeForUser(userID uint, ulid string) error
+	// Revokes all sessions of the user except one, returns the number of revoked sessions
+	RevokeOthersForUser(userID uint, keepUlid string) (int64, error)
+	// Revokes all sessions of the user, e.g. after a password change
+	RevokeAllForUser(userID uint) error
+}
+
+var _ Registry = &DbRegistry{}
+
+type DbRegistry struct {
+	db     *gorm.DB
+	logger *slog.Logger
+
+	// touches remembers the recent Touch calls of this replica so that most requests don't reach the database
+	mu       sync.Mutex
+	touches  map[string]touch
+	prunedAt time.Time
+}
+
+type touch struct {
+	at time.Time
+	ip string
+}
+
+func NewDbRegistry(db *gorm.DB, logger *slog.Logger) *DbRegistry {
+	return &DbRegistry{db: db, logger: logger.With("subcomponent", "usersession/DbRegistry"), touches: map[string]touch{}}
+}
+
+func (r *DbRegistry) Create(ulid string, userID uint, ttl time.Duration, ip string, userAgent string) (*Session, error) {
+	now := time.Now()
+	s := &Session{
+		Ulid:       ulid,
+		UserID:     userID,
+		IP:         ip,
+		UserAgent:  userAgent,
+		LastSeenAt: &now,
+		ExpiresAt:  now.Add(ttl),
+	}
+	err := r.db.Create(s).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create session")
+	}
+	return s, nil
+}
+
+func (r *DbRegistry) IsActive(ulid string) (bool, error) {
+	var count int64
+	err := r.db.Model(&Session{}).
+		Where("ulid = ? AND revoked_at IS NULL AND expires_at > ?", ulid, time.Now()).
+		Count(&count).Error
+	if err != nil {
+		return false, errors.Wrap(err, "failed to check session")
+	}
+	return count > 0, nil
+}
+
+func (r *DbRegistry) Touch(ulid string, ip string) error {
+	now := time.Now()
+	if !r.shouldTouch(ulid, ip, now) {
+		return nil
+	}
+	// other replicas may have touched the session in the meantime
+	err := r.db.Model(&Session{}).
+		Where("ulid = ? AND (last_seen_at IS NULL OR last_seen_at < ? OR ip <> ?)", ulid, now.Add(-lastSeenResolution), ip).
+		Updates(map[string]interface{}{"last_seen_at": now, "ip": ip}).Error
+	if err != nil {
+		r.forgetTouch(ulid)
+		return errors.Wrap(err, "failed to update session")
+	}
+	return nil
+}
+
+// shouldTouch returns false if this replica touched the session from the same IP within the last minute, otherwise it
+// records the touch
+func (r *DbRegistry) shouldTouch(ulid string, ip string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	last, ok := r.touches[ulid]
+	if ok && last.ip == ip && now.Sub(last.at) < lastSeenResolution {
+		return false
+	}
+	r.touches[ulid] = touch{at: now, ip: ip}
+
+	// touches older than the resolution don't skip anything, drop them now and then
+	if now.Sub(r.prunedAt) >= lastSeenResolution {
+		for key, t := range r.touches {
+			if now.Sub(t.at) >= lastSeenResolution {
+				delete(r.touches, key)
+			}
+		}
+		r.prunedAt = now
+	}
+	return true
+}
+
+func (r *DbRegistry) forgetTouch(ulid string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.touches, ulid)
+}
+
+func (r *DbRegistry) ListForUser(userID uint) ([]*Session, error) {
+	sessions := []*Session{}
+	err := r.db.
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("id DESC").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list sessions")
+	}
+	return sessions, nil
+}
+
+func (r *DbRegistry) RevokeForUser(userID uint, ulid string) error {
+	result := r.db.Model(&Session{}).
+		Where("user_id = ? AND ulid = ? AND revoked_at IS NULL AND expires_at > ?", userID, ulid, time.Now()).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "failed to revoke session")
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	r.logger.Debug("revoked session", "session", ulid)
+	return nil
+}
+
+func (r *DbRegistry) RevokeOthersForUser(userID uint, keepUlid string) (int64, error) {
+	result := r.db.Model(&Session{}).
+		Where("user_id = ? AND ulid <> ? AND revoked_at IS NULL AND expires_at > ?", userID, keepUlid, time.Now()).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return 0, errors.Wrap(result.Error, "failed to revoke sessions")
+	}
+	r.logger.Debug("revoked other sessions", "userid", userID, "kept", keepUlid, "revoked", result.RowsAffected)
+	return result.RowsAffected, nil
+}
+
+func (r *DbRegistry) Revoke(ulid string) error {
+	err := r.db.Model(&Session{}).
+		Where("ulid = ? AND revoked_at IS NULL", ulid).
+		Update("revoked_at", time.Now()).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to revoke session")
+	}
+	r.logger.Debug("revoked session", "session", ulid)
+	return nil
+}
+
+func (r *DbRegistry) RevokeAllForUser(userID uint) error {
+	err := r.db.Model(&Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to revoke sessions")
+	}
+	r.logger.Debug("revoked all sessions", "userid", userID)
+	return nil
+}
@@ -0,0 +1,61 @@
+package usersession
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/util/dbtest"
+)
+
+func TestShouldTouch(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name string
+		ulid string
+		ip   string
+		// after is the time since the first touch of session A from 192.0.2.1
+		after time.Duration
+		want  bool
+	}{
+		{name: "same request burst", ulid: "A", ip: "192.0.2.1", after: time.Second},
+		{name: "just before the resolution", ulid: "A", ip: "192.0.2.1", after: lastSeenResolution - time.Second},
+		{name: "after the resolution", ulid: "A", ip: "192.0.2.1", after: lastSeenResolution, want: true},
+		{name: "new IP", ulid: "A", ip: "192.0.2.2", after: time.Second, want: true},
+		{name: "other session", ulid: "B", ip: "192.0.2.1", after: time.Second, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewDbRegistry(nil, dbtest.Logger())
+			if !r.shouldTouch("A", "192.0.2.1", start) {
+				t.Fatal("the first touch must reach the database")
+			}
+			got := r.shouldTouch(tt.ulid, tt.ip, start.Add(tt.after))
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldTouchPrunes(t *testing.T) {
+	r := NewDbRegistry(nil, dbtest.Logger())
+	start := time.Now()
+	for _, ulid := range []string{"A", "B", "C"} {
+		r.shouldTouch(ulid, "192.0.2.1", start)
+	}
+	r.shouldTouch("D", "192.0.2.1", start.Add(lastSeenResolution))
+	if len(r.touches) != 1 {
+		t.Errorf("got %d remembered touches, want only the recent one", len(r.touches))
+	}
+}
+
+func TestForgetTouch(t *testing.T) {
+	r := NewDbRegistry(nil, dbtest.Logger())
+	start := time.Now()
+	r.shouldTouch("A", "192.0.2.1", start)
+	// a failed update is retried by the next request
+	r.forgetTouch("A")
+	if !r.shouldTouch("A", "192.0.2.1", start.Add(time.Second)) {
+		t.Error("expected a forgotten touch to reach the database again")
+	}
+}
@@ -0,0 +1,50 @@
+// Package breachedtest gives tests a breached password list, a temporary directory of SHA-1 prefix files in the
+// format of the Pwned Passwords range API.
+package breachedtest
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Dir returns a directory with the prefix files of the passwords, it's removed when the test ends
+func Dir(t *testing.T, passwords ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, password := range passwords {
+		prefix, suffix := split(password)
+		f, err := os.OpenFile(filepath.Join(dir, prefix), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Fatalf("failed to create prefix file: %v", err)
+		}
+		// the range API ends lines with CRLF and pads files with other suffixes
+		_, err = fmt.Fprintf(f, "0000000000000000000000000000000000A:1\r\n%s:42\r\n", suffix)
+		f.Close()
+		if err != nil {
+			t.Fatalf("failed to write prefix file: %v", err)
+		}
+	}
+	return dir
+}
+
+// Unreadable puts a directory in place of the prefix file of the password, reading it fails
+func Unreadable(t *testing.T, dir string, password string) {
+	t.Helper()
+	prefix, _ := split(password)
+	err := os.Mkdir(filepath.Join(dir, prefix), 0o755)
+	if err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+}
+
+// split returns the file name and the line of the password
+func split(password string) (string, string) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	return hash[:5], hash[5:]
+}
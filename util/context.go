@@ -8,9 +8,33 @@ import (
 )
 
 const CookieKeySessionName = "session"
+const CookieKeyOidcName = "oidc"
 
 const SessionKeyAccountID = "account_id"
 const SessionKeyUserID = "user_id"
+const SessionKeySessionID = "session_id"
+
+// A pending session is created after the password was verified, but the second factor is still missing
+const SessionKeyPendingUserID = "pending_user_id"
+const SessionKeyPendingUntil = "pending_until"
+
+// The groups of an identity provider login waiting for its second factor, they are synced once it's verified
+const SessionKeyPendingGroups = "pending_groups"
+
+// An impersonation session acts as another user, the impersonator's identity is kept to restore it when the impersonation ends
+const SessionKeyImpersonatorID = "impersonator_id"
+const SessionKeyImpersonatorAccountID = "impersonator_account_id"
+const SessionKeyImpersonationUntil = "impersonation_until"
+
+// EchoKeyAccessToken holds the personal access token the request was authenticated with, if any
+const EchoKeyAccessToken = "access_token"
+
+// EchoKeyServiceAccount holds the service account the request was authenticated as, if any
+const EchoKeyServiceAccount = "service_account"
+
+// EchoKeyScimToken and EchoKeyScimAccount hold the SCIM token of a directory request and the account it provisions
+const EchoKeyScimToken = "scim_token"
+const EchoKeyScimAccount = "scim_account"
 
 var CtxKeyEchoContext = &contextKey{"echoContext"}
 
@@ -0,0 +1,18 @@
+package util
+
+import (
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pkg/errors"
+)
+
+// ConstraintUniqueUsername is the case-insensitive unique index on users.username
+const ConstraintUniqueUsername = "uq_users_username_lower"
+
+// IsUniqueViolation returns true if err is a postgres unique violation of the constraint or unique index
+func IsUniqueViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == "23505" && pgErr.ConstraintName == constraint
+}
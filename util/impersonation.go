@@ -0,0 +1,41 @@
+package util
+
+import (
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// ImpersonatorID returns the real user of an impersonation session
+func ImpersonatorID(sess *sessions.Session) (uint, bool) {
+	impersonatorID, ok := sess.Values[SessionKeyImpersonatorID].(uint)
+	return impersonatorID, ok
+}
+
+// ImpersonationUntil returns when the impersonation of the session ends
+func ImpersonationUntil(sess *sessions.Session) time.Time {
+	until, _ := sess.Values[SessionKeyImpersonationUntil].(int64)
+	return time.Unix(until, 0)
+}
+
+// StartImpersonation makes the session act as the user in the account until the impersonation expires
+func StartImpersonation(sess *sessions.Session, userID uint, accountUlid string, until time.Time) {
+	sess.Values[SessionKeyImpersonatorID] = sess.Values[SessionKeyUserID]
+	sess.Values[SessionKeyImpersonatorAccountID] = sess.Values[SessionKeyAccountID]
+	sess.Values[SessionKeyImpersonationUntil] = until.Unix()
+	sess.Values[SessionKeyUserID] = userID
+	sess.Values[SessionKeyAccountID] = accountUlid
+}
+
+// EndImpersonation restores the impersonator's identity, the session must be saved by the caller
+func EndImpersonation(sess *sessions.Session) {
+	impersonatorID, ok := ImpersonatorID(sess)
+	if !ok {
+		return
+	}
+	sess.Values[SessionKeyUserID] = impersonatorID
+	sess.Values[SessionKeyAccountID] = sess.Values[SessionKeyImpersonatorAccountID]
+	delete(sess.Values, SessionKeyImpersonatorID)
+	delete(sess.Values, SessionKeyImpersonatorAccountID)
+	delete(sess.Values, SessionKeyImpersonationUntil)
+}
@@ -0,0 +1,58 @@
+package util
+
+import (
+	"context"
+	"time"
+
+	"github.com/mwasilew2/echo-gqlgen-casbin-rbac-example/graph/model"
+)
+
+// PrincipalType is the kind of credential a request was authenticated with
+type PrincipalType string
+
+const (
+	PrincipalTypeSession        PrincipalType = "session"
+	PrincipalTypeAccessToken    PrincipalType = "access_token"
+	PrincipalTypeServiceAccount PrincipalType = "service_account"
+)
+
+// Scope limits the actions of a principal, e.g. to the scopes of a personal access token
+type Scope interface {
+	Allows(resource string, action string) bool
+}
+
+// Principal is the authenticated caller of a request, loaded once per request by the principal middleware
+type Principal struct {
+	Type PrincipalType
+	// The user, a service account gets a user which isn't stored in the database, its username is the casbin subject and its ID is 0
+	User *model.User
+	// The account the request acts in, nil if the session's user is no longer a member of the account they switched to
+	Account *model.Account
+	// Roles of the user in the account
+	Roles []string
+	// Limits the actions of the request, nil allows everything the roles allow
+	Scope Scope
+	// ULID of the session, access token or service account which authenticated the request
+	CredentialID string
+	// The platform admin behind an impersonation session, nil for other requests
+	Impersonator       *model.User
+	ImpersonationUntil time.Time
+}
+
+// IsImpersonated returns true if a platform admin acts as the principal's user
+func (p *Principal) IsImpersonated() bool {
+	return p.Impersonator != nil
+}
+
+var ctxKeyPrincipal = &contextKey{"principal"}
+
+// ContextWithPrincipal returns a copy of the context which carries the principal
+func ContextWithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, ctxKeyPrincipal, principal)
+}
+
+// PrincipalFromContext returns the principal of the request, false for unauthenticated requests
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(ctxKeyPrincipal).(*Principal)
+	return principal, ok && principal != nil
+}